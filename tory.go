@@ -5,12 +5,56 @@ import (
 	"fmt"
 	"os"
 	"os/exec"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/codegangsta/cli"
 	"github.com/modcloth/tory/tory"
+	"github.com/modcloth/tory/tory/client"
 )
 
+// normalizationFlags are given to every command that writes tags and vars
+var normalizationFlags = []cli.Flag{
+	cli.StringFlag{
+		Name:   "tags-normalization",
+		Value:  "lowercase-all",
+		Usage:  "case normalization of stored tags, one of \"preserve\", \"lowercase-keys\", or \"lowercase-all\"",
+		EnvVar: "TORY_TAGS_NORMALIZATION",
+	},
+	cli.StringFlag{
+		Name:   "vars-normalization",
+		Value:  "lowercase-all",
+		Usage:  "case normalization of stored vars, one of \"preserve\", \"lowercase-keys\", or \"lowercase-all\"",
+		EnvVar: "TORY_VARS_NORMALIZATION",
+	},
+}
+
+func normalizationOptions(c *cli.Context) tory.NormalizationOptions {
+	return tory.NormalizationOptions{
+		Tags: c.String("tags-normalization"),
+		Vars: c.String("vars-normalization"),
+	}
+}
+
+// optionalSeconds returns nil for an unset flag, so that a default may
+// apply, and otherwise its value as a number of seconds
+func optionalSeconds(c *cli.Context, name string) *time.Duration {
+	value := c.String(name)
+	if value == "" {
+		return nil
+	}
+
+	seconds, err := strconv.Atoi(value)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid --%s %q: must be a number of seconds\n", name, value)
+		os.Exit(1)
+	}
+
+	d := time.Duration(seconds) * time.Second
+	return &d
+}
+
 func main() {
 	whoami := os.Getenv("USER")
 	if os.Getenv("DATABASE_URL") == "" && whoami == "" {
@@ -32,7 +76,7 @@ func main() {
 			Name:      "serve",
 			ShortName: "s",
 			Usage:     "run the http server",
-			Flags: []cli.Flag{
+			Flags: append([]cli.Flag{
 				cli.BoolFlag{
 					Name:   "vv, verbose",
 					Usage:  "be noisy",
@@ -73,6 +117,27 @@ func main() {
 					Usage:  "public api prefix",
 					EnvVar: "TORY_PREFIX",
 				},
+				cli.StringFlag{
+					Name:   "F, facts-allowlist",
+					Value:  strings.Join(tory.DefaultFactsAllowlist, ","),
+					Usage:  "comma-separated facts to keep from posted ansible facts",
+					EnvVar: "TORY_FACTS_ALLOWLIST",
+				},
+				cli.StringFlag{
+					Name:   "H, ansible-host-labels",
+					Usage:  "comma-separated address labels to render as ansible_host, in order of preference",
+					EnvVar: "TORY_ANSIBLE_HOST_LABELS",
+				},
+				cli.IntFlag{
+					Name:   "R, reap-interval",
+					Usage:  "seconds between reaping stale hosts (0 to disable)",
+					EnvVar: "TORY_REAP_INTERVAL",
+				},
+				cli.StringFlag{
+					Name:   "P, reap-policy",
+					Usage:  "JSON reap policy file (defaults to marking hosts stale after 30 days)",
+					EnvVar: "TORY_REAP_POLICY",
+				},
 				cli.BoolFlag{
 					Name:   "E, new-relic-agent-enabled",
 					Usage:  "Enable the NewRelic agent",
@@ -94,16 +159,52 @@ func main() {
 					Usage:  "Set New Relic agent to report verbosely",
 					EnvVar: "NEW_RELIC_VERBOSE",
 				},
-			},
+				cli.StringFlag{
+					Name:   "G, groups",
+					Usage:  "JSON file configuring inventory group names",
+					EnvVar: "TORY_GROUPS",
+				},
+				cli.StringFlag{
+					Name:   "tokens-file",
+					Usage:  "JSON file of extra auth tokens and the scopes they grant",
+					EnvVar: "TORY_TOKENS_FILE",
+				},
+				cli.StringFlag{
+					Name:   "policy-file",
+					Usage:  "JSON tag policy file (defaults to the rules stored in the database)",
+					EnvVar: "TORY_POLICY_FILE",
+				},
+				cli.StringFlag{
+					Name:   "policy-mode",
+					Value:  "audit",
+					Usage:  "\"audit\" to only report tag policy violations, or \"enforce\" to also reject them",
+					EnvVar: "TORY_POLICY_MODE",
+				},
+				cli.StringFlag{
+					Name:   "secret-key-file",
+					Usage:  "key file for encrypting secret vars, as written by \"tory secrets rotate\"",
+					EnvVar: "TORY_SECRET_KEY_FILE",
+				},
+			}, normalizationFlags...),
 			Action: func(c *cli.Context) {
 				tory.ServerMain(&tory.ServerOptions{
-					Addr:        c.String("server-addr"),
-					AuthToken:   c.String("auth-token"),
-					DatabaseURL: c.String("database-url"),
-					Prefix:      c.String("prefix"),
-					Quiet:       c.Bool("quiet"),
-					StaticDir:   c.String("static-dir"),
-					Verbose:     c.Bool("verbose"),
+					Addr:              c.String("server-addr"),
+					AuthToken:         c.String("auth-token"),
+					DatabaseURL:       c.String("database-url"),
+					Prefix:            c.String("prefix"),
+					Quiet:             c.Bool("quiet"),
+					StaticDir:         c.String("static-dir"),
+					Verbose:           c.Bool("verbose"),
+					FactsAllowlist:    strings.Split(c.String("facts-allowlist"), ","),
+					ReapInterval:      time.Duration(c.Int("reap-interval")) * time.Second,
+					ReapPolicyFile:    c.String("reap-policy"),
+					GroupsFile:        c.String("groups"),
+					TokensFile:        c.String("tokens-file"),
+					SecretKeyFile:     c.String("secret-key-file"),
+					PolicyFile:        c.String("policy-file"),
+					PolicyMode:        c.String("policy-mode"),
+					AnsibleHostLabels: strings.Split(c.String("ansible-host-labels"), ","),
+					Normalization:     normalizationOptions(c),
 					NewRelicOptions: tory.NewRelicOptions{
 						Enabled:    c.Bool("new-relic-agent-enabled"),
 						LicenseKey: c.String("new-relic-license-key"),
@@ -113,21 +214,369 @@ func main() {
 				})
 			},
 		},
+		cli.Command{
+			Name:      "inventory",
+			ShortName: "i",
+			Usage:     "act as an ansible dynamic inventory script",
+			Action: func(c *cli.Context) {
+				tory.InventoryScriptMain(&tory.InventoryScriptOptions{
+					List:       c.Bool("list"),
+					Host:       c.String("host"),
+					URL:        c.String("url"),
+					AuthToken:  c.String("auth-token"),
+					ConfigFile: c.String("config"),
+					CacheDir:   c.String("cache-dir"),
+					CacheTTL:   optionalSeconds(c, "cache-ttl"),
+					Filter: map[string]string{
+						"name":   c.String("name"),
+						"env":    c.String("env"),
+						"team":   c.String("team"),
+						"since":  c.String("since"),
+						"before": c.String("before"),
+					},
+				})
+			},
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "list",
+					Usage: "list the full inventory",
+				},
+				cli.StringFlag{
+					Name:  "host",
+					Usage: "show the vars for a single host",
+				},
+				cli.StringFlag{
+					Name:   "u, url",
+					Usage:  "tory server inventory url (default http://localhost:9462/ansible/hosts)",
+					EnvVar: "TORY_URL",
+				},
+				cli.StringFlag{
+					Name:   "A, auth-token",
+					Usage:  "auth token, whose secrets:read scope includes secret vars in the inventory",
+					EnvVar: "TORY_AUTH_TOKEN",
+				},
+				cli.StringFlag{
+					Name:   "c, config",
+					Usage:  "inventory script config file",
+					EnvVar: "TORY_INVENTORY_CONFIG",
+				},
+				cli.StringFlag{
+					Name:   "cache-dir",
+					Usage:  "inventory cache directory",
+					EnvVar: "TORY_INVENTORY_CACHE_DIR",
+				},
+				cli.StringFlag{
+					Name:   "cache-ttl",
+					Usage:  "inventory cache ttl in seconds, 0 to disable (default 60)",
+					EnvVar: "TORY_INVENTORY_CACHE_TTL",
+				},
+				cli.StringFlag{
+					Name:   "name",
+					Usage:  "only include hosts with names that prefix match this value",
+					EnvVar: "TORY_FILTER_NAME",
+				},
+				cli.StringFlag{
+					Name:   "env",
+					Usage:  "only include hosts with a matching env tag",
+					EnvVar: "TORY_FILTER_ENV",
+				},
+				cli.StringFlag{
+					Name:   "team",
+					Usage:  "only include hosts with a matching team tag",
+					EnvVar: "TORY_FILTER_TEAM",
+				},
+				cli.StringFlag{
+					Name:   "since",
+					Usage:  "only include hosts modified since this RFC3339 timestamp",
+					EnvVar: "TORY_FILTER_SINCE",
+				},
+				cli.StringFlag{
+					Name:   "before",
+					Usage:  "only include hosts modified before this RFC3339 timestamp",
+					EnvVar: "TORY_FILTER_BEFORE",
+				},
+			},
+		},
+		cli.Command{
+			Name:      "register",
+			ShortName: "r",
+			Usage:     "register the local host with a tory server",
+			Action: func(c *cli.Context) {
+				tory.RegisterMain(&tory.RegisterOptions{
+					ConfigFile: c.String("config"),
+					Interval:   time.Duration(c.Int("interval")) * time.Second,
+					Jitter:     time.Duration(c.Int("jitter")) * time.Second,
+					Client:     client.New(c.String("url"), c.String("auth-token")),
+				})
+			},
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:   "u, url",
+					Value:  client.DefaultURL,
+					Usage:  "tory server inventory url",
+					EnvVar: "TORY_URL",
+				},
+				cli.StringFlag{
+					Name:   "A, auth-token",
+					Value:  "swordfish",
+					Usage:  "mutative action auth token",
+					EnvVar: "TORY_AUTH_TOKEN",
+				},
+				cli.StringFlag{
+					Name:   "c, config",
+					Value:  "/etc/tory/register.json",
+					Usage:  "JSON file of tags, vars, and overrides to merge with local facts",
+					EnvVar: "TORY_REGISTER_CONFIG",
+				},
+				cli.IntFlag{
+					Name:   "i, interval",
+					Usage:  "keep registering every this many seconds instead of once",
+					EnvVar: "TORY_REGISTER_INTERVAL",
+				},
+				cli.IntFlag{
+					Name:   "j, jitter",
+					Value:  30,
+					Usage:  "add up to this many random seconds to each interval",
+					EnvVar: "TORY_REGISTER_JITTER",
+				},
+			},
+		},
+		cli.Command{
+			Name:      "export",
+			ShortName: "e",
+			Usage:     "export all hosts as a snapshot",
+			Action: func(c *cli.Context) {
+				tory.ExportMain(&tory.ExportOptions{
+					DatabaseURL: c.String("database-url"),
+					Format:      c.String("format"),
+					Output:      c.String("output"),
+				})
+			},
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:   "d, database-url",
+					Value:  fmt.Sprintf("postgres://%s@localhost/tory?sslmode=disable", whoami),
+					Usage:  "database connection uri",
+					EnvVar: "DATABASE_URL",
+				},
+				cli.StringFlag{
+					Name:  "f, format",
+					Value: "ndjson",
+					Usage: "snapshot format, either \"ndjson\" or \"json\"",
+				},
+				cli.StringFlag{
+					Name:  "o, output",
+					Value: "-",
+					Usage: "output file, or \"-\" for stdout",
+				},
+			},
+		},
+		cli.Command{
+			Name:      "import",
+			ShortName: "I",
+			Usage:     "import hosts from a snapshot or static ansible inventory",
+			Action: func(c *cli.Context) {
+				tory.ImportMain(&tory.ImportOptions{
+					DatabaseURL:   c.String("database-url"),
+					From:          c.String("from"),
+					Input:         c.Args().First(),
+					Mode:          c.String("mode"),
+					DryRun:        c.Bool("dry-run"),
+					Normalization: normalizationOptions(c),
+				})
+			},
+			Flags: append([]cli.Flag{
+				cli.StringFlag{
+					Name:   "d, database-url",
+					Value:  fmt.Sprintf("postgres://%s@localhost/tory?sslmode=disable", whoami),
+					Usage:  "database connection uri",
+					EnvVar: "DATABASE_URL",
+				},
+				cli.StringFlag{
+					Name:  "f, from",
+					Value: "snapshot",
+					Usage: "input format, one of \"snapshot\", \"ansible-ini\", or \"ansible-yaml\"",
+				},
+				cli.StringFlag{
+					Name:  "m, mode",
+					Value: "merge",
+					Usage: "\"merge\" into existing hosts, or \"replace\" all hosts",
+				},
+				cli.BoolFlag{
+					Name:  "n, dry-run",
+					Usage: "report what would change without changing anything",
+				},
+			}, normalizationFlags...),
+		},
+		cli.Command{
+			Name:      "sync",
+			ShortName: "S",
+			Usage:     "sync hosts from an external source",
+			Action: func(c *cli.Context) {
+				tory.SyncMain(&tory.SyncOptions{
+					DatabaseURL:   c.String("database-url"),
+					Provider:      c.String("provider"),
+					File:          c.Args().First(),
+					MappingFile:   c.String("mapping"),
+					DryRun:        c.Bool("dry-run"),
+					Prune:         c.Bool("prune"),
+					Normalization: normalizationOptions(c),
+				})
+			},
+			Flags: append([]cli.Flag{
+				cli.StringFlag{
+					Name:   "d, database-url",
+					Value:  fmt.Sprintf("postgres://%s@localhost/tory?sslmode=disable", whoami),
+					Usage:  "database connection uri",
+					EnvVar: "DATABASE_URL",
+				},
+				cli.StringFlag{
+					Name:  "p, provider",
+					Value: "file",
+					Usage: "one of \"aws\", \"joyent\", \"terraform\", or \"file\"",
+				},
+				cli.StringFlag{
+					Name:  "m, mapping",
+					Usage: "JSON file mapping provider metadata to tags and vars",
+				},
+				cli.BoolFlag{
+					Name:  "n, dry-run",
+					Usage: "write the hosts to stdout instead of syncing them",
+				},
+				cli.BoolFlag{
+					Name:  "prune",
+					Usage: "delete hosts previously synced from the same file that are no longer in it",
+				},
+			}, normalizationFlags...),
+		},
+		cli.Command{
+			Name:      "prune",
+			ShortName: "p",
+			Usage:     "mark stale hosts and delete long-stale ones",
+			Action: func(c *cli.Context) {
+				tory.PruneMain(&tory.PruneOptions{
+					DatabaseURL: c.String("database-url"),
+					PolicyFile:  c.String("policy"),
+					DryRun:      c.Bool("dry-run"),
+				})
+			},
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:   "d, database-url",
+					Value:  fmt.Sprintf("postgres://%s@localhost/tory?sslmode=disable", whoami),
+					Usage:  "database connection uri",
+					EnvVar: "DATABASE_URL",
+				},
+				cli.StringFlag{
+					Name:   "P, policy",
+					Usage:  "JSON reap policy file (defaults to marking hosts stale after 30 days)",
+					EnvVar: "TORY_REAP_POLICY",
+				},
+				cli.BoolFlag{
+					Name:  "n, dry-run",
+					Usage: "report what would be reaped without changing anything",
+				},
+			},
+		},
+		cli.Command{
+			Name:  "secrets",
+			Usage: "manage the keys secret vars are encrypted with",
+			Subcommands: []cli.Command{
+				cli.Command{
+					Name:  "rotate",
+					Usage: "encrypt secrets with a new key, creating the key file if needed",
+					Action: func(c *cli.Context) {
+						tory.SecretsRotateMain(&tory.SecretsRotateOptions{
+							DatabaseURL: c.String("database-url"),
+							KeyFile:     c.String("key-file"),
+						})
+					},
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:   "d, database-url",
+							Value:  fmt.Sprintf("postgres://%s@localhost/tory?sslmode=disable", whoami),
+							Usage:  "database connection uri",
+							EnvVar: "DATABASE_URL",
+						},
+						cli.StringFlag{
+							Name:   "k, key-file",
+							Value:  "tory-secrets.json",
+							Usage:  "secret key file",
+							EnvVar: "TORY_SECRET_KEY_FILE",
+						},
+					},
+				},
+			},
+		},
+		cli.Command{
+			Name:  "vault",
+			Usage: "work with ansible vault-encrypted values",
+			Subcommands: []cli.Command{
+				cli.Command{
+					Name:  "encrypt-var",
+					Usage: "vault-encrypt a var value (or stdin), optionally storing it on a host",
+					Action: func(c *cli.Context) {
+						tory.VaultEncryptVarMain(&tory.VaultEncryptVarOptions{
+							PasswordFile: c.String("vault-password-file"),
+							Name:         c.String("name"),
+							Value:        c.Args().First(),
+							Host:         c.String("host"),
+							Client:       client.New(c.String("url"), c.String("auth-token")),
+						})
+					},
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:   "vault-password-file",
+							Usage:  "file containing the vault password (default $TORY_VAULT_PASSWORD)",
+							EnvVar: "TORY_VAULT_PASSWORD_FILE",
+						},
+						cli.StringFlag{
+							Name:  "n, name",
+							Usage: "var name",
+						},
+						cli.StringFlag{
+							Name:  "H, host",
+							Usage: "store the encrypted value as a vault var on this host",
+						},
+						cli.StringFlag{
+							Name:   "u, url",
+							Value:  client.DefaultURL,
+							Usage:  "tory server inventory url",
+							EnvVar: "TORY_URL",
+						},
+						cli.StringFlag{
+							Name:   "A, auth-token",
+							Value:  "swordfish",
+							Usage:  "mutative action auth token",
+							EnvVar: "TORY_AUTH_TOKEN",
+						},
+					},
+				},
+			},
+		},
 		cli.Command{
 			Name:      "migrate",
 			ShortName: "m",
 			Usage:     "run database migrations",
 			Action: func(c *cli.Context) {
-				tory.MigrateMain(c.String("database-url"))
+				tory.MigrateMain(&tory.MigrateOptions{
+					DatabaseURL:   c.String("database-url"),
+					Renormalize:   c.Bool("renormalize"),
+					Normalization: normalizationOptions(c),
+				})
 			},
-			Flags: []cli.Flag{
+			Flags: append([]cli.Flag{
 				cli.StringFlag{
 					Name:   "d, database-url",
 					Value:  fmt.Sprintf("postgres://%s@localhost/tory?sslmode=disable", whoami),
 					Usage:  "database connection uri",
 					EnvVar: "DATABASE_URL",
 				},
-			},
+				cli.BoolFlag{
+					Name:  "renormalize",
+					Usage: "rewrite the tags and vars of existing hosts according to the normalization flags",
+				},
+			}, normalizationFlags...),
 		},
 	}
 
@@ -0,0 +1,130 @@
+package tory
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/modcloth/tory/tory/api"
+)
+
+var (
+	defaultAddressLabel = "ip"
+
+	invalidAddressError = fmt.Errorf("address must be an IPv4 or IPv6 address")
+	noAddressLabelError = fmt.Errorf("address must have a label")
+)
+
+type hostAddress struct {
+	ID     int64 `db:"id"`
+	HostID int64 `db:"host_id"`
+
+	Label   string `db:"label"`
+	Address *inet  `db:"address"`
+	Family  int    `db:"family"`
+	Primary bool   `db:"is_primary"`
+}
+
+// addressFamily returns 4 or 6 for a valid address, otherwise 0
+func addressFamily(addr string) int {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return 0
+	}
+
+	if ip.To4() != nil {
+		return 4
+	}
+
+	return 6
+}
+
+// normalizeAddresses validates the host's addresses and makes sure that
+// exactly one of them is primary and matches the host's ip, which remains
+// the primary address for backwards compatibility.  When the ip is empty
+// it is taken from the address flagged primary, or else the first one, and
+// when no address matches the ip one is added with the "ip" label.
+func normalizeAddresses(hj *api.HostJSON) error {
+	if hj.Addresses == nil {
+		return nil
+	}
+
+	for _, a := range hj.Addresses {
+		if strings.TrimSpace(a.Label) == "" {
+			return noAddressLabelError
+		}
+
+		a.Label = strings.ToLower(strings.TrimSpace(a.Label))
+		a.Address = normalizeIP(a.Address)
+		a.Family = addressFamily(a.Address)
+		if a.Family == 0 {
+			return invalidAddressError
+		}
+	}
+
+	hj.IP = normalizeIP(hj.IP)
+	if hj.IP == "" {
+		for _, a := range hj.Addresses {
+			if a.Primary {
+				hj.IP = a.Address
+				break
+			}
+		}
+	}
+
+	if hj.IP == "" && len(hj.Addresses) > 0 {
+		hj.IP = hj.Addresses[0].Address
+	}
+
+	found := false
+	for _, a := range hj.Addresses {
+		a.Primary = !found && a.Address == hj.IP
+		if a.Primary {
+			found = true
+		}
+	}
+
+	if !found && hj.IP != "" {
+		hj.Addresses = append([]*api.AddressJSON{&api.AddressJSON{
+			Label:   defaultAddressLabel,
+			Address: hj.IP,
+			Family:  addressFamily(hj.IP),
+			Primary: true,
+		}}, hj.Addresses...)
+	}
+
+	return nil
+}
+
+func addressJSONToHostAddress(a *api.AddressJSON) *hostAddress {
+	return &hostAddress{
+		Label:   a.Label,
+		Address: &inet{Addr: a.Address, Subnet: a.Subnet},
+		Family:  a.Family,
+		Primary: a.Primary,
+	}
+}
+
+func hostAddressToAddressJSON(a *hostAddress) *api.AddressJSON {
+	return &api.AddressJSON{
+		Label:   a.Label,
+		Address: a.Address.Addr,
+		Subnet:  a.Address.Subnet,
+		Family:  a.Family,
+		Primary: a.Primary,
+	}
+}
+
+// AnsibleHost returns the address with the first of the preferred labels
+// that the host has, or "" if none
+func (h *host) AnsibleHost(labels []string) string {
+	for _, label := range labels {
+		for _, a := range h.Addresses {
+			if a.Label == label {
+				return a.Address.Addr
+			}
+		}
+	}
+
+	return ""
+}
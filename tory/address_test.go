@@ -0,0 +1,82 @@
+package tory
+
+import (
+	"testing"
+
+	"github.com/modcloth/tory/tory/api"
+)
+
+func TestNormalizeAddresses(t *testing.T) {
+	hj := &api.HostJSON{
+		Name: "web1.example.com",
+		Addresses: []*api.AddressJSON{
+			&api.AddressJSON{Label: "Public", Address: "54.1.2.3"},
+			&api.AddressJSON{Label: "private", Address: "10.10.1.47", Subnet: "24", Primary: true},
+			&api.AddressJSON{Label: "v6", Address: "2001:db8::1"},
+		},
+	}
+
+	err := normalizeAddresses(hj)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if hj.IP != "10.10.1.47" {
+		t.Fatalf("ip was not taken from the primary address: %q", hj.IP)
+	}
+
+	for i, expected := range []struct {
+		label   string
+		family  int
+		primary bool
+	}{
+		{"public", 4, false},
+		{"private", 4, true},
+		{"v6", 6, false},
+	} {
+		a := hj.Addresses[i]
+		if a.Label != expected.label || a.Family != expected.family || a.Primary != expected.primary {
+			t.Fatalf("unexpected address %#v", a)
+		}
+	}
+
+	hj = &api.HostJSON{
+		IP:        "10.10.1.48",
+		Addresses: []*api.AddressJSON{&api.AddressJSON{Label: "mgmt", Address: "192.168.1.48", Primary: true}},
+	}
+
+	err = normalizeAddresses(hj)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(hj.Addresses) != 2 || hj.Addresses[0].Label != "ip" || !hj.Addresses[0].Primary || hj.Addresses[1].Primary {
+		t.Fatalf("ip was not kept as the primary address: %#v", hj.Addresses)
+	}
+
+	for _, a := range []*api.AddressJSON{
+		&api.AddressJSON{Label: "bogus", Address: "not-an-ip"},
+		&api.AddressJSON{Address: "10.10.1.49"},
+	} {
+		err = normalizeAddresses(&api.HostJSON{Addresses: []*api.AddressJSON{a}})
+		if err == nil {
+			t.Fatalf("invalid address was accepted: %#v", a)
+		}
+	}
+}
+
+func TestHostAnsibleHost(t *testing.T) {
+	h := newHost()
+	h.Addresses = []*hostAddress{
+		&hostAddress{Label: "ip", Address: &inet{Addr: "10.10.1.47"}, Primary: true},
+		&hostAddress{Label: "mgmt", Address: &inet{Addr: "192.168.1.47", Subnet: "24"}},
+	}
+
+	if addr := h.AnsibleHost([]string{"oob", "mgmt", "ip"}); addr != "192.168.1.47" {
+		t.Fatalf("preferred address was not used: %q", addr)
+	}
+
+	if addr := h.AnsibleHost([]string{"oob"}); addr != "" {
+		t.Fatalf("unexpected address: %q", addr)
+	}
+}
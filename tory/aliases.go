@@ -0,0 +1,50 @@
+package tory
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+)
+
+const (
+	// aliasKindRename marks an alias kept from a host's old name
+	aliasKindRename = "rename"
+
+	// aliasKindExplicit marks an alias added through the API, such as a
+	// CNAME-like short name
+	aliasKindExplicit = "explicit"
+)
+
+var (
+	noHostAliasError    = fmt.Errorf("no such alias")
+	hostAliasTakenError = fmt.Errorf("that alias belongs to another host")
+	noRenameNameError   = fmt.Errorf("no \"name\" in rename payload")
+)
+
+// hostAlias is another name a host may be read by
+type hostAlias struct {
+	ID      int64     `db:"id" json:"-"`
+	HostID  int64     `db:"host_id" json:"-"`
+	Alias   string    `db:"alias" json:"alias"`
+	Kind    string    `db:"kind" json:"kind"`
+	Created time.Time `db:"created" json:"created"`
+}
+
+type renamePayload struct {
+	Name string `json:"name"`
+}
+
+func renameFromHTTPBody(in io.Reader) (string, error) {
+	payload := &renamePayload{}
+	err := json.NewDecoder(in).Decode(payload)
+	if err != nil {
+		return "", err
+	}
+
+	if payload.Name == "" {
+		return "", noRenameNameError
+	}
+
+	return payload.Name, nil
+}
@@ -0,0 +1,27 @@
+package tory
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRenameFromHTTPBody(t *testing.T) {
+	name, err := renameFromHTTPBody(strings.NewReader(`{"name": "web2.example.com"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if name != "web2.example.com" {
+		t.Fatalf("expected %q, got %q", "web2.example.com", name)
+	}
+
+	_, err = renameFromHTTPBody(strings.NewReader(`{}`))
+	if err != noRenameNameError {
+		t.Fatalf("expected %v, got %v", noRenameNameError, err)
+	}
+
+	_, err = renameFromHTTPBody(strings.NewReader(`{"name":`))
+	if err == nil {
+		t.Fatalf("expected an error for malformed JSON")
+	}
+}
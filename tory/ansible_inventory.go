@@ -0,0 +1,436 @@
+package tory
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/modcloth/tory/tory/api"
+)
+
+var (
+	ansibleHostRangeRe = regexp.MustCompile(`\[([0-9]+):([0-9]+)\]`)
+
+	ansibleHostVarKeys = []string{"ansible_host", "ansible_ssh_host"}
+)
+
+// ansibleInventory is a static ansible inventory, as parsed from either the
+// INI or YAML format
+type ansibleInventory struct {
+	groups map[string]*ansibleGroup
+	hosts  map[string]map[string]string
+}
+
+type ansibleGroup struct {
+	name     string
+	hosts    []string
+	vars     map[string]string
+	children []string
+}
+
+type ansibleYAMLGroup struct {
+	Hosts    map[string]map[string]interface{} `yaml:"hosts"`
+	Vars     map[string]interface{}            `yaml:"vars"`
+	Children map[string]*ansibleYAMLGroup      `yaml:"children"`
+}
+
+func newAnsibleInventory() *ansibleInventory {
+	return &ansibleInventory{
+		groups: map[string]*ansibleGroup{},
+		hosts:  map[string]map[string]string{},
+	}
+}
+
+func (ai *ansibleInventory) group(name string) *ansibleGroup {
+	if g, ok := ai.groups[name]; ok {
+		return g
+	}
+
+	g := &ansibleGroup{
+		name:     name,
+		hosts:    []string{},
+		vars:     map[string]string{},
+		children: []string{},
+	}
+	ai.groups[name] = g
+	return g
+}
+
+func (ai *ansibleInventory) addHost(group, hostname string, vars map[string]string) {
+	if _, ok := ai.hosts[hostname]; !ok {
+		ai.hosts[hostname] = map[string]string{}
+	}
+
+	for key, value := range vars {
+		ai.hosts[hostname][key] = value
+	}
+
+	g := ai.group(group)
+	g.hosts = append(g.hosts, hostname)
+}
+
+// parseAnsibleINI reads the classic INI inventory format, including
+// [group:vars] and [group:children] sections and numeric host ranges
+func parseAnsibleINI(in io.Reader) (*ansibleInventory, error) {
+	ai := newAnsibleInventory()
+	section, kind := "ungrouped", "hosts"
+
+	scanner := bufio.NewScanner(in)
+	lineno := 0
+	for scanner.Scan() {
+		lineno++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section, kind = line[1:len(line)-1], "hosts"
+			if i := strings.Index(section, ":"); i > -1 {
+				section, kind = section[:i], section[i+1:]
+			}
+			ai.group(section)
+			continue
+		}
+
+		if kind == "vars" {
+			key, value, err := parseAnsibleINIVarLine(line)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", lineno, err)
+			}
+			ai.group(section).vars[key] = value
+			continue
+		}
+
+		fields, err := splitAnsibleINILine(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", lineno, err)
+		}
+
+		switch kind {
+		case "hosts":
+			vars, err := parseAnsibleINIVars(fields[1:])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", lineno, err)
+			}
+			for _, hostname := range expandAnsibleHostRange(fields[0]) {
+				ai.addHost(section, hostname, vars)
+			}
+		case "children":
+			ai.group(fields[0])
+			g := ai.group(section)
+			g.children = append(g.children, fields[0])
+		default:
+			return nil, fmt.Errorf("line %d: unknown section type %q", lineno, kind)
+		}
+	}
+
+	return ai, scanner.Err()
+}
+
+// splitAnsibleINILine splits on whitespace while respecting single and
+// double quotes, which are removed
+func splitAnsibleINILine(line string) ([]string, error) {
+	fields := []string{}
+	cur := []rune{}
+	var quote rune
+	inField := false
+
+	for _, r := range line {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				cur = append(cur, r)
+			}
+		case r == '"' || r == '\'':
+			quote = r
+			inField = true
+		case r == '#' && !inField:
+			return fields, nil
+		case r == ' ' || r == '\t':
+			if inField {
+				fields = append(fields, string(cur))
+				cur = []rune{}
+				inField = false
+			}
+		default:
+			cur = append(cur, r)
+			inField = true
+		}
+	}
+
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated quote in %q", line)
+	}
+
+	if inField {
+		fields = append(fields, string(cur))
+	}
+
+	return fields, nil
+}
+
+func parseAnsibleINIVars(fields []string) (map[string]string, error) {
+	vars := map[string]string{}
+	for _, field := range fields {
+		parts := strings.SplitN(field, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("expected key=value, got %q", field)
+		}
+		vars[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+	}
+
+	return vars, nil
+}
+
+// parseAnsibleINIVarLine reads a whole [group:vars] line as a key, the
+// first "=" and a value running to the end of the line, so that both may
+// be surrounded by spaces and the value may contain them.  A value wholly
+// in single or double quotes has them removed.
+func parseAnsibleINIVarLine(line string) (string, string, error) {
+	parts := strings.SplitN(line, "=", 2)
+	if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+		return "", "", fmt.Errorf("expected key=value, got %q", line)
+	}
+
+	key, value := strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+	if len(value) > 1 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+		value = value[1 : len(value)-1]
+	}
+
+	return key, value, nil
+}
+
+// expandAnsibleHostRange expands a single numeric range such as
+// "web[01:03].example.com", keeping any zero padding
+func expandAnsibleHostRange(pattern string) []string {
+	m := ansibleHostRangeRe.FindStringSubmatchIndex(pattern)
+	if m == nil {
+		return []string{pattern}
+	}
+
+	startStr, endStr := pattern[m[2]:m[3]], pattern[m[4]:m[5]]
+	start, _ := strconv.Atoi(startStr)
+	end, _ := strconv.Atoi(endStr)
+
+	format := "%d"
+	if len(startStr) > 1 && strings.HasPrefix(startStr, "0") {
+		format = fmt.Sprintf("%%0%dd", len(startStr))
+	}
+
+	hostnames := []string{}
+	for i := start; i <= end; i++ {
+		hostnames = append(hostnames, pattern[:m[0]]+fmt.Sprintf(format, i)+pattern[m[1]:])
+	}
+
+	return hostnames
+}
+
+// parseAnsibleYAML reads the YAML inventory format, where every top-level
+// key is a group with optional hosts, vars, and children
+func parseAnsibleYAML(in io.Reader) (*ansibleInventory, error) {
+	b, err := ioutil.ReadAll(in)
+	if err != nil {
+		return nil, err
+	}
+
+	raw := map[string]*ansibleYAMLGroup{}
+	err = yaml.Unmarshal(b, &raw)
+	if err != nil {
+		return nil, err
+	}
+
+	ai := newAnsibleInventory()
+	for name, yg := range raw {
+		ai.addYAMLGroup(name, yg)
+	}
+
+	return ai, nil
+}
+
+func (ai *ansibleInventory) addYAMLGroup(name string, yg *ansibleYAMLGroup) {
+	g := ai.group(name)
+	if yg == nil {
+		return
+	}
+
+	for hostname, vars := range yg.Hosts {
+		for _, expanded := range expandAnsibleHostRange(hostname) {
+			ai.addHost(name, expanded, stringifyAnsibleVars(vars))
+		}
+	}
+
+	for key, value := range stringifyAnsibleVars(yg.Vars) {
+		g.vars[key] = value
+	}
+
+	for childName, child := range yg.Children {
+		g.children = append(g.children, childName)
+		ai.addYAMLGroup(childName, child)
+	}
+}
+
+func stringifyAnsibleVars(in map[string]interface{}) map[string]string {
+	out := map[string]string{}
+	for key, value := range in {
+		if value == nil {
+			out[key] = ""
+			continue
+		}
+		out[key] = fmt.Sprintf("%v", value)
+	}
+
+	return out
+}
+
+// groupsFor returns every group containing hostname, directly or via
+// children, ordered from the most distant ancestor to the direct groups so
+// that vars may be applied in ansible's precedence order
+func (ai *ansibleInventory) groupsFor(hostname string) []string {
+	parents := map[string][]string{}
+	for _, g := range ai.groups {
+		for _, child := range g.children {
+			parents[child] = append(parents[child], g.name)
+		}
+	}
+
+	depth := map[string]int{}
+	queue := []string{}
+	for _, g := range ai.groups {
+		for _, h := range g.hosts {
+			if h == hostname {
+				depth[g.name] = 0
+				queue = append(queue, g.name)
+			}
+		}
+	}
+
+	for len(queue) > 0 {
+		cur := queue[0]
+		queue = queue[1:]
+		for _, parent := range parents[cur] {
+			if _, seen := depth[parent]; !seen {
+				depth[parent] = depth[cur] + 1
+				queue = append(queue, parent)
+			}
+		}
+	}
+
+	groups := []string{}
+	for name := range depth {
+		groups = append(groups, name)
+	}
+
+	sort.Sort(&groupsByDepth{groups: groups, depth: depth})
+	return groups
+}
+
+type groupsByDepth struct {
+	groups []string
+	depth  map[string]int
+}
+
+func (gd *groupsByDepth) Len() int      { return len(gd.groups) }
+func (gd *groupsByDepth) Swap(i, j int) { gd.groups[i], gd.groups[j] = gd.groups[j], gd.groups[i] }
+func (gd *groupsByDepth) Less(i, j int) bool {
+	di, dj := gd.depth[gd.groups[i]], gd.depth[gd.groups[j]]
+	if di != dj {
+		return di > dj
+	}
+	return gd.groups[i] < gd.groups[j]
+}
+
+// HostJSONs maps the inventory onto tory hosts.  Group membership becomes a
+// "{group}=true" tag, group vars and inline host vars become host vars (in
+// that order of precedence, with the "all" group lowest), and the ip comes
+// from ansible_host, ansible_ssh_host, or the hostname itself, resolving
+// names via DNS.  Hosts without a resolvable ip are returned separately.
+func (ai *ansibleInventory) HostJSONs() ([]*api.HostJSON, []string) {
+	hostnames := []string{}
+	for hostname := range ai.hosts {
+		hostnames = append(hostnames, hostname)
+	}
+	sort.Strings(hostnames)
+
+	hjs := []*api.HostJSON{}
+	unresolved := []string{}
+	for _, hostname := range hostnames {
+		hj := api.NewHostJSON()
+		hj.Name = hostname
+
+		if all, ok := ai.groups["all"]; ok {
+			for key, value := range all.vars {
+				hj.Vars[key] = value
+			}
+		}
+
+		for _, group := range ai.groupsFor(hostname) {
+			for key, value := range ai.groups[group].vars {
+				hj.Vars[key] = value
+			}
+
+			if group != "all" && group != "ungrouped" {
+				hj.Tags[group] = "true"
+			}
+		}
+
+		for key, value := range ai.hosts[hostname] {
+			hj.Vars[key] = value
+		}
+
+		candidates := []string{}
+		for _, key := range ansibleHostVarKeys {
+			if value, ok := hj.Vars[key]; ok {
+				candidates = append(candidates, fmt.Sprintf("%v", value))
+			}
+		}
+		candidates = append(candidates, hostname)
+
+		hj.IP = resolveAnsibleHostIP(candidates)
+		if hj.IP == "" {
+			unresolved = append(unresolved, hostname)
+			continue
+		}
+
+		hjs = append(hjs, hj)
+	}
+
+	return hjs, unresolved
+}
+
+func resolveAnsibleHostIP(candidates []string) string {
+	for _, candidate := range candidates {
+		if ip := net.ParseIP(candidate); ip != nil {
+			return ip.String()
+		}
+	}
+
+	for _, candidate := range candidates {
+		ips, err := net.LookupIP(candidate)
+		if err != nil {
+			continue
+		}
+
+		for _, ip := range ips {
+			if ip4 := ip.To4(); ip4 != nil {
+				return ip4.String()
+			}
+		}
+
+		if len(ips) > 0 {
+			return ips[0].String()
+		}
+	}
+
+	return ""
+}
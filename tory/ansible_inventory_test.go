@@ -0,0 +1,157 @@
+package tory
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/modcloth/tory/tory/api"
+)
+
+var (
+	testAnsibleINI = `
+mail.example.com ansible_host=10.10.5.1
+
+[all:vars]
+ntp_server = ntp.example.com
+
+[webservers]
+web[01:03].example.com ansible_host=10.10.5.10
+db-ish.example.com ansible_ssh_host="10.10.5.20" java_home='/opt/JDK 7'
+
+[webservers:vars]
+http_port=80
+
+[prod:children]
+webservers
+
+[prod:vars]
+http_port=8080
+env=prod
+
+[broken]
+nowhere.invalid
+`
+	testAnsibleYAML = `
+all:
+  vars:
+    ntp_server: ntp.example.com
+  hosts:
+    mail.example.com:
+      ansible_host: 10.10.5.1
+  children:
+    prod:
+      vars:
+        env: prod
+        http_port: 8080
+      children:
+        webservers:
+          vars:
+            http_port: 80
+          hosts:
+            web[01:03].example.com:
+              ansible_host: 10.10.5.10
+            db-ish.example.com:
+              ansible_ssh_host: 10.10.5.20
+              java_home: /opt/JDK 7
+    broken:
+      hosts:
+        nowhere.invalid:
+`
+)
+
+func TestAnsibleInventoryImport(t *testing.T) {
+	for format, content := range map[string]string{
+		"ansible-ini":  testAnsibleINI,
+		"ansible-yaml": testAnsibleYAML,
+	} {
+		var (
+			ai  *ansibleInventory
+			err error
+		)
+		if format == "ansible-ini" {
+			ai, err = parseAnsibleINI(strings.NewReader(content))
+		} else {
+			ai, err = parseAnsibleYAML(strings.NewReader(content))
+		}
+		if err != nil {
+			t.Fatalf("%s: %v", format, err)
+		}
+
+		hjs, unresolved := ai.HostJSONs()
+		if len(unresolved) != 1 || unresolved[0] != "nowhere.invalid" {
+			t.Fatalf("%s: unexpected unresolved hosts: %v", format, unresolved)
+		}
+
+		byName := map[string]*api.HostJSON{}
+		for _, hj := range hjs {
+			byName[hj.Name] = hj
+		}
+
+		if len(byName) != 5 {
+			t.Fatalf("%s: expected 5 hosts, got %v", format, len(byName))
+		}
+
+		web := byName["web02.example.com"]
+		if web == nil {
+			t.Fatalf("%s: host range was not expanded", format)
+		}
+
+		if web.IP != "10.10.5.10" {
+			t.Fatalf("%s: ansible_host was not used as ip: %q", format, web.IP)
+		}
+
+		if web.Tags["webservers"] != "true" || web.Tags["prod"] != "true" {
+			t.Fatalf("%s: group membership was not mapped to tags: %#v", format, web.Tags)
+		}
+
+		if web.Vars["http_port"] != "80" {
+			t.Fatalf("%s: child group vars do not take precedence: %v", format, web.Vars["http_port"])
+		}
+
+		if web.Vars["env"] != "prod" || web.Vars["ntp_server"] != "ntp.example.com" {
+			t.Fatalf("%s: ancestor group vars were not inherited: %#v", format, web.Vars)
+		}
+
+		db := byName["db-ish.example.com"]
+		if db.IP != "10.10.5.20" || db.Vars["java_home"] != "/opt/JDK 7" {
+			t.Fatalf("%s: inline host vars were not parsed: %q %#v", format, db.IP, db.Vars)
+		}
+
+		mail := byName["mail.example.com"]
+		if len(mail.Tags) != 0 {
+			t.Fatalf("%s: ungrouped host has group tags: %#v", format, mail.Tags)
+		}
+	}
+}
+
+func TestAnsibleINIGroupVars(t *testing.T) {
+	ai, err := parseAnsibleINI(strings.NewReader(`
+[webservers:vars]
+motd = Welcome to the web tier
+java_home='/opt/JDK 7'
+greeting = "a = b"
+empty =
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vars := ai.group("webservers").vars
+	for key, value := range map[string]string{
+		"motd":      "Welcome to the web tier",
+		"java_home": "/opt/JDK 7",
+		"greeting":  "a = b",
+		"empty":     "",
+	} {
+		if actual, ok := vars[key]; !ok || actual != value {
+			t.Fatalf("%s is not %q: %#v", key, value, vars)
+		}
+	}
+
+	for _, line := range []string{"no_value", "= value"} {
+		_, err := parseAnsibleINI(strings.NewReader("[webservers:vars]\n" + line + "\n"))
+		if err == nil {
+			t.Fatalf("expected an error for %q", line)
+		}
+	}
+}
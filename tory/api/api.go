@@ -0,0 +1,71 @@
+// Package api holds the JSON types of the tory http API, shared by the
+// server and its client
+package api
+
+import (
+	"time"
+)
+
+// HostJSON is a host as the tory http API reads and writes it
+type HostJSON struct {
+	ID int64 `json:"id,omitempty"`
+
+	Name string `json:"name"`
+	IP   string `json:"ip"`
+
+	Package string `json:"package,omitempty"`
+	Image   string `json:"image,omitempty"`
+	Type    string `json:"type,omitempty"`
+
+	Tags  map[string]interface{} `json:"tags,omitempty"`
+	Vars  map[string]interface{} `json:"vars,omitempty"`
+	Facts map[string]interface{} `json:"facts,omitempty"`
+
+	Addresses []*AddressJSON `json:"addresses,omitempty"`
+
+	// Secrets are only ever written by tory, with values redacted for
+	// callers without the "secrets:read" scope, and are ignored on updates
+	Secrets map[string]string `json:"secrets,omitempty"`
+
+	// VaultVars are ansible vault text, also ignored on updates
+	VaultVars map[string]string `json:"vault_vars,omitempty"`
+
+	State         string     `json:"state,omitempty"`
+	StateModified *time.Time `json:"state_modified,omitempty"`
+	StaleAt       *time.Time `json:"stale_at,omitempty"`
+	DeletedAt     *time.Time `json:"deleted_at,omitempty"`
+
+	LastRunPlaybook string     `json:"last_run_playbook,omitempty"`
+	LastRunStatus   string     `json:"last_run_status,omitempty"`
+	LastRunStarted  *time.Time `json:"last_run_started,omitempty"`
+	LastRunFinished *time.Time `json:"last_run_finished,omitempty"`
+
+	// LastSuccess* describe the newest run without failed or unreachable
+	// tasks, which may be older than the last run
+	LastSuccessPlaybook string     `json:"last_success_playbook,omitempty"`
+	LastSuccessStarted  *time.Time `json:"last_success_started,omitempty"`
+	LastSuccessFinished *time.Time `json:"last_success_finished,omitempty"`
+}
+
+// HostPayload wraps a single host in request and response bodies
+type HostPayload struct {
+	Host *HostJSON `json:"host"`
+}
+
+// AddressJSON is one of a host's addresses, where Subnet is the optional
+// prefix length of the network the address is on
+type AddressJSON struct {
+	Label   string `json:"label"`
+	Address string `json:"address"`
+	Subnet  string `json:"subnet,omitempty"`
+	Family  int    `json:"family,omitempty"`
+	Primary bool   `json:"primary,omitempty"`
+}
+
+// NewHostJSON returns a HostJSON with empty tags and vars
+func NewHostJSON() *HostJSON {
+	return &HostJSON{
+		Tags: map[string]interface{}{},
+		Vars: map[string]interface{}{},
+	}
+}
@@ -1,26 +1,87 @@
 package tory
 
 import (
+	"encoding/json"
 	"fmt"
 	"net/http"
+	"os"
 	"strings"
 )
 
+const (
+	// writeScope allows creating, updating, and deleting hosts
+	writeScope = "write"
+
+	// secretsReadScope allows reading secret vars in the clear
+	secretsReadScope = "secrets:read"
+)
+
 type authMiddleware struct {
-	Token string
+	Token  string
+	Tokens map[string][]string
 }
 
-func newAuthMiddleware(token string) *authMiddleware {
-	return &authMiddleware{Token: token}
+// newAuthMiddleware authorizes requests bearing either the token, which
+// grants the write scope, or one of the tokens, which grant their listed
+// scopes
+func newAuthMiddleware(token string, tokens map[string][]string) *authMiddleware {
+	return &authMiddleware{Token: token, Tokens: tokens}
+}
+
+// readTokensFile reads a JSON object of tokens to the scopes they grant,
+// e.g. {"TOKEN": ["write", "secrets:read"]}
+func readTokensFile(filename string) (map[string][]string, error) {
+	tokens := map[string][]string{}
+	if filename == "" {
+		return tokens, nil
+	}
+
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	err = json.NewDecoder(f).Decode(&tokens)
+	if err != nil {
+		return nil, err
+	}
+
+	return tokens, nil
 }
 
 func (a *authMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
 	r.Header.Set("Tory-Authorized", "nope")
+	r.Header.Del("Tory-Scopes")
+
+	scopes := a.scopes(strings.TrimSpace(r.Header.Get("Authorization")))
+	for _, scope := range scopes {
+		if scope == writeScope {
+			r.Header.Set("Tory-Authorized", "yep")
+		}
+	}
 
-	authHeader := r.Header.Get("Authorization")
-	if strings.TrimSpace(authHeader) == fmt.Sprintf("token %s", a.Token) {
-		r.Header.Set("Tory-Authorized", "yep")
+	if len(scopes) > 0 {
+		r.Header.Set("Tory-Scopes", strings.Join(scopes, " "))
 	}
 
 	next(w, r)
 }
+
+func (a *authMiddleware) scopes(authHeader string) []string {
+	if authHeader == fmt.Sprintf("token %s", a.Token) {
+		return []string{writeScope}
+	}
+
+	if !strings.HasPrefix(authHeader, "token ") {
+		return nil
+	}
+
+	token := strings.TrimSpace(strings.TrimPrefix(authHeader, "token "))
+	if token == "" {
+		return nil
+	}
+
+	return a.Tokens[token]
+}
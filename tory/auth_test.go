@@ -0,0 +1,39 @@
+package tory
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestAuthMiddlewareScopes(t *testing.T) {
+	a := newAuthMiddleware("writer", map[string][]string{
+		"reader": []string{secretsReadScope},
+		"admin":  []string{writeScope, secretsReadScope},
+	})
+
+	for _, tc := range []struct {
+		header     string
+		authorized string
+		scopes     string
+	}{
+		{"token writer", "yep", "write"},
+		{"token reader", "nope", "secrets:read"},
+		{"token admin", "yep", "write secrets:read"},
+		{"token bogus", "nope", ""},
+		{"", "nope", ""},
+	} {
+		r, _ := http.NewRequest("GET", "/", nil)
+		r.Header.Set("Authorization", tc.header)
+		r.Header.Set("Tory-Scopes", "secrets:read")
+
+		a.ServeHTTP(nil, r, func(w http.ResponseWriter, r *http.Request) {})
+
+		if r.Header.Get("Tory-Authorized") != tc.authorized {
+			t.Fatalf("%q: expected authorized %q, got %q", tc.header, tc.authorized, r.Header.Get("Tory-Authorized"))
+		}
+
+		if r.Header.Get("Tory-Scopes") != tc.scopes {
+			t.Fatalf("%q: expected scopes %q, got %q", tc.header, tc.scopes, r.Header.Get("Tory-Scopes"))
+		}
+	}
+}
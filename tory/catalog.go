@@ -0,0 +1,14 @@
+package tory
+
+// catalogKey is a tag or var key along with how many hosts have it
+type catalogKey struct {
+	Key   string `db:"key" json:"key"`
+	Count int    `db:"count" json:"count"`
+}
+
+// catalogValue is a value of a tag or var key along with how many hosts
+// have it
+type catalogValue struct {
+	Value string `db:"value" json:"value"`
+	Count int    `db:"count" json:"count"`
+}
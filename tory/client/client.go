@@ -0,0 +1,296 @@
+package client
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/modcloth/tory/tory/api"
+)
+
+var (
+	// DefaultURL is the inventory url of a tory server running locally with
+	// default options
+	DefaultURL = "http://localhost:9462/ansible/hosts"
+
+	// DefaultMaxRetries is the number of times a failed request is retried
+	DefaultMaxRetries = 3
+
+	// DefaultBackoff is the initial delay between retries, doubled after
+	// each attempt
+	DefaultBackoff = 250 * time.Millisecond
+)
+
+// Client talks to the tory http API
+type Client struct {
+	URL        string
+	Token      string
+	MaxRetries int
+	Backoff    time.Duration
+	HTTPClient *http.Client
+}
+
+// Filter contains the inventory query string variables
+type Filter struct {
+	Name        string
+	Env         string
+	Team        string
+	Since       time.Time
+	Before      time.Time
+	ExcludeVars bool
+}
+
+type valueJSON struct {
+	Value string `json:"value"`
+	Vault bool   `json:"vault,omitempty"`
+}
+
+// New builds a Client for the tory server at the given inventory url, e.g.
+// "http://tory.example.com/ansible/hosts"
+func New(serverURL, token string) *Client {
+	if serverURL == "" {
+		serverURL = DefaultURL
+	}
+
+	return &Client{
+		URL:        strings.TrimRight(serverURL, "/"),
+		Token:      token,
+		MaxRetries: DefaultMaxRetries,
+		Backoff:    DefaultBackoff,
+		HTTPClient: &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// GetInventory fetches the ansible inventory, optionally filtered
+func (c *Client) GetInventory(f *Filter) (*Inventory, error) {
+	inv := newInventory()
+	err := c.do("GET", c.URL+f.queryString(), nil, inv)
+	if err != nil {
+		return nil, err
+	}
+
+	return inv, nil
+}
+
+// GetHost fetches a single host by name or ip
+func (c *Client) GetHost(name string) (*api.HostJSON, error) {
+	payload := &api.HostPayload{}
+	err := c.do("GET", c.hostURL(name), nil, payload)
+	if err != nil {
+		return nil, err
+	}
+
+	return payload.Host, nil
+}
+
+// PutHost creates or updates a host, returning the host as stored
+func (c *Client) PutHost(hj *api.HostJSON) (*api.HostJSON, error) {
+	payload := &api.HostPayload{}
+	err := c.do("PUT", c.hostURL(hj.Name), &api.HostPayload{Host: hj}, payload)
+	if err != nil {
+		return nil, err
+	}
+
+	return payload.Host, nil
+}
+
+// DeleteHost deletes a host by name or ip
+func (c *Client) DeleteHost(name string) error {
+	return c.do("DELETE", c.hostURL(name), nil, nil)
+}
+
+// GetTag fetches the value of a single host tag
+func (c *Client) GetTag(name, key string) (string, error) {
+	return c.getKey("tags", name, key)
+}
+
+// PutTag creates or updates a single host tag
+func (c *Client) PutTag(name, key, value string) error {
+	return c.putKey("tags", name, key, value)
+}
+
+// DeleteTag deletes a single host tag
+func (c *Client) DeleteTag(name, key string) error {
+	return c.deleteKey("tags", name, key)
+}
+
+// GetVar fetches the value of a single host var
+func (c *Client) GetVar(name, key string) (string, error) {
+	return c.getKey("vars", name, key)
+}
+
+// PutVar creates or updates a single host var
+func (c *Client) PutVar(name, key, value string) error {
+	return c.putKey("vars", name, key, value)
+}
+
+// PutVaultVar creates or updates a single host var whose value is ansible
+// vault text, which the server emits as a vault-encrypted value
+func (c *Client) PutVaultVar(name, key, value string) error {
+	return c.do("PUT", c.keyURL("vars", name, key), &valueJSON{Value: value, Vault: true}, nil)
+}
+
+// DeleteVar deletes a single host var
+func (c *Client) DeleteVar(name, key string) error {
+	return c.deleteKey("vars", name, key)
+}
+
+func (c *Client) getKey(keyType, name, key string) (string, error) {
+	v := &valueJSON{}
+	err := c.do("GET", c.keyURL(keyType, name, key), nil, v)
+	if err != nil {
+		return "", err
+	}
+
+	return v.Value, nil
+}
+
+func (c *Client) putKey(keyType, name, key, value string) error {
+	return c.do("PUT", c.keyURL(keyType, name, key), &valueJSON{Value: value}, nil)
+}
+
+func (c *Client) deleteKey(keyType, name, key string) error {
+	return c.do("DELETE", c.keyURL(keyType, name, key), nil, nil)
+}
+
+func (c *Client) hostURL(name string) string {
+	return c.URL + "/" + pathEscape(name)
+}
+
+func (c *Client) keyURL(keyType, name, key string) string {
+	return c.hostURL(name) + "/" + keyType + "/" + pathEscape(key)
+}
+
+// pathEscape escapes s as a single path segment, where unlike in a query
+// string a space is "%20" rather than "+"
+func pathEscape(s string) string {
+	return strings.Replace(url.QueryEscape(s), "+", "%20", -1)
+}
+
+func (f *Filter) queryString() string {
+	if f == nil {
+		return ""
+	}
+
+	q := url.Values{}
+	if f.Name != "" {
+		q.Set("name", f.Name)
+	}
+
+	if f.Env != "" {
+		q.Set("env", f.Env)
+	}
+
+	if f.Team != "" {
+		q.Set("team", f.Team)
+	}
+
+	if !f.Since.IsZero() {
+		q.Set("since", f.Since.Format(time.RFC3339))
+	}
+
+	if !f.Before.IsZero() {
+		q.Set("before", f.Before.Format(time.RFC3339))
+	}
+
+	if f.ExcludeVars {
+		q.Set("exclude-vars", "1")
+	}
+
+	if len(q) == 0 {
+		return ""
+	}
+
+	return "?" + q.Encode()
+}
+
+// do performs the request, retrying with backoff on connection errors and
+// 5xx responses, and decodes the response body into out when non-nil
+func (c *Client) do(method, urlStr string, in, out interface{}) error {
+	var body []byte
+	if in != nil {
+		var err error
+		body, err = json.Marshal(in)
+		if err != nil {
+			return err
+		}
+	}
+
+	backoff := c.Backoff
+	var err error
+	for attempt := 0; attempt <= c.MaxRetries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+
+		var retry bool
+		retry, err = c.doOnce(method, urlStr, body, out)
+		if err == nil || !retry {
+			return err
+		}
+	}
+
+	return err
+}
+
+func (c *Client) doOnce(method, urlStr string, body []byte, out interface{}) (bool, error) {
+	var bodyReader io.Reader
+	if body != nil {
+		bodyReader = bytes.NewReader(body)
+	}
+
+	req, err := http.NewRequest(method, urlStr, bodyReader)
+	if err != nil {
+		return false, err
+	}
+
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Accept-Encoding", "gzip")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	if c.Token != "" {
+		req.Header.Set("Authorization", fmt.Sprintf("token %s", c.Token))
+	}
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return true, err
+	}
+
+	defer resp.Body.Close()
+
+	var respBody io.Reader = resp.Body
+	if resp.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			return true, err
+		}
+		defer gz.Close()
+		respBody = gz
+	}
+
+	respBytes, err := ioutil.ReadAll(respBody)
+	if err != nil {
+		return true, err
+	}
+
+	if resp.StatusCode >= 400 {
+		return resp.StatusCode >= 500, newError(resp.StatusCode, respBytes)
+	}
+
+	if out == nil || resp.StatusCode == http.StatusNoContent || len(respBytes) == 0 {
+		return false, nil
+	}
+
+	return false, json.Unmarshal(respBytes, out)
+}
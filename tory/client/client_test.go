@@ -0,0 +1,315 @@
+package client
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/modcloth/tory/tory/api"
+)
+
+var (
+	testToken = "swordfish"
+)
+
+// fakeTory is a tiny in-memory stand-in for the tory server routes
+type fakeTory struct {
+	sync.Mutex
+
+	hosts    map[string]*api.HostJSON
+	failures int
+	requests int
+}
+
+func newFakeTory() *fakeTory {
+	return &fakeTory{hosts: map[string]*api.HostJSON{}}
+}
+
+func (ft *fakeTory) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ft.Lock()
+	defer ft.Unlock()
+
+	ft.requests++
+	if ft.failures > 0 {
+		ft.failures--
+		sendJSON(w, map[string]string{"error": "kaboom"}, http.StatusInternalServerError)
+		return
+	}
+
+	if r.Method != "GET" && r.Header.Get("Authorization") != "token "+testToken {
+		sendJSON(w, map[string]string{"error": "unauthorized"}, http.StatusUnauthorized)
+		return
+	}
+
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/ansible/hosts"), "/")
+	switch len(parts) {
+	case 1:
+		ft.serveInventory(w, r)
+	case 2:
+		ft.serveHost(w, r, parts[1])
+	case 4:
+		ft.serveKey(w, r, parts[1], parts[2], parts[3])
+	default:
+		sendJSON(w, map[string]string{"message": "not found"}, http.StatusNotFound)
+	}
+}
+
+func (ft *fakeTory) serveInventory(w http.ResponseWriter, r *http.Request) {
+	inv := map[string]interface{}{}
+	hostvars := map[string]map[string]string{}
+	for name, hj := range ft.hosts {
+		if !strings.HasPrefix(name, r.FormValue("name")) {
+			continue
+		}
+		inv[hj.IP] = []string{name}
+		hostvars[name] = map[string]string{"ip": hj.IP}
+	}
+	inv["all"] = map[string][]string{"children": []string{"ungrouped"}}
+	inv["_meta"] = map[string]interface{}{"hostvars": hostvars}
+
+	w.Header().Set("Content-Encoding", "gzip")
+	w.Header().Set("Content-Type", "application/json")
+	gz := gzip.NewWriter(w)
+	defer gz.Close()
+	json.NewEncoder(gz).Encode(inv)
+}
+
+func (ft *fakeTory) serveHost(w http.ResponseWriter, r *http.Request, name string) {
+	switch r.Method {
+	case "GET":
+		hj, ok := ft.hosts[name]
+		if !ok {
+			sendJSON(w, map[string]string{"message": "no such host"}, http.StatusNotFound)
+			return
+		}
+		sendJSON(w, &api.HostPayload{Host: hj}, http.StatusOK)
+	case "PUT":
+		payload := &api.HostPayload{}
+		err := json.NewDecoder(r.Body).Decode(payload)
+		if err != nil || payload.Host == nil {
+			sendJSON(w, map[string]string{"error": "bad payload"}, http.StatusBadRequest)
+			return
+		}
+		st := http.StatusOK
+		if _, ok := ft.hosts[name]; !ok {
+			st = http.StatusCreated
+		}
+		payload.Host.ID = int64(len(ft.hosts) + 1)
+		ft.hosts[name] = payload.Host
+		sendJSON(w, payload, st)
+	case "DELETE":
+		if _, ok := ft.hosts[name]; !ok {
+			sendJSON(w, map[string]string{"message": "no such host"}, http.StatusNotFound)
+			return
+		}
+		delete(ft.hosts, name)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (ft *fakeTory) serveKey(w http.ResponseWriter, r *http.Request, name, keyType, key string) {
+	hj, ok := ft.hosts[name]
+	if !ok {
+		sendJSON(w, map[string]string{"message": "no such host"}, http.StatusNotFound)
+		return
+	}
+
+	m := hj.Tags
+	if keyType == "vars" {
+		m = hj.Vars
+	}
+
+	switch r.Method {
+	case "GET":
+		value, ok := m[key]
+		if !ok {
+			sendJSON(w, map[string]string{"message": fmt.Sprintf("could not find %q", key)}, http.StatusNotFound)
+			return
+		}
+		sendJSON(w, map[string]interface{}{"value": value}, http.StatusOK)
+	case "PUT":
+		v := &valueJSON{}
+		json.NewDecoder(r.Body).Decode(v)
+		m[key] = v.Value
+		sendJSON(w, v, http.StatusOK)
+	case "DELETE":
+		delete(m, key)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func sendJSON(w http.ResponseWriter, j interface{}, status int) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(j)
+}
+
+func newTestClient(t *testing.T) (*Client, *fakeTory, *httptest.Server) {
+	ft := newFakeTory()
+	ts := httptest.NewServer(ft)
+	c := New(ts.URL+"/ansible/hosts", testToken)
+	c.Backoff = time.Millisecond
+	return c, ft, ts
+}
+
+func newTestHost() *api.HostJSON {
+	hj := api.NewHostJSON()
+	hj.Name = "test.example.com"
+	hj.IP = "10.10.1.1"
+	hj.Tags["team"] = "fribbles"
+	hj.Vars["memory"] = "512"
+	return hj
+}
+
+func TestHostLifecycle(t *testing.T) {
+	c, _, ts := newTestClient(t)
+	defer ts.Close()
+
+	hj, err := c.PutHost(newTestHost())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if hj.ID == 0 {
+		t.Fatalf("stored host has no id")
+	}
+
+	hj, err = c.GetHost("test.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if hj.IP != "10.10.1.1" {
+		t.Fatalf("ip does not match: %q != 10.10.1.1", hj.IP)
+	}
+
+	err = c.DeleteHost("test.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = c.GetHost("test.example.com")
+	if !IsNotFound(err) {
+		t.Fatalf("expected not found error, got %v", err)
+	}
+
+	if err.(*Error).Message != "no such host" {
+		t.Fatalf("message was not decoded: %#v", err)
+	}
+}
+
+func TestTagsAndVars(t *testing.T) {
+	c, ft, ts := newTestClient(t)
+	defer ts.Close()
+
+	_, err := c.PutHost(newTestHost())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = c.PutTag("test.example.com", "env", "prod")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	value, err := c.GetTag("test.example.com", "env")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if value != "prod" {
+		t.Fatalf("tag value does not match: %q != prod", value)
+	}
+
+	err = c.PutVar("test.example.com", "release notes", "a+b")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := ft.hosts["test.example.com"].Vars["release notes"]; !ok {
+		t.Fatalf("var key was not escaped as a path: %#v", ft.hosts["test.example.com"].Vars)
+	}
+
+	err = c.DeleteVar("test.example.com", "memory")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = c.GetVar("test.example.com", "memory")
+	if !IsNotFound(err) {
+		t.Fatalf("expected not found error, got %v", err)
+	}
+}
+
+func TestGetInventoryGzip(t *testing.T) {
+	c, _, ts := newTestClient(t)
+	defer ts.Close()
+
+	_, err := c.PutHost(newTestHost())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	inv, err := c.GetInventory(&Filter{Name: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := inv.Meta.Hostvars["test.example.com"]; !ok {
+		t.Fatalf("inventory does not contain hostvars by name")
+	}
+
+	if g, ok := inv.Groups["10.10.1.1"]; !ok || len(g) != 1 {
+		t.Fatalf("inventory does not contain IP as group: %#v", inv.Groups)
+	}
+
+	if _, ok := inv.Groups["all"]; !ok || len(inv.Children["all"]) != 1 || inv.Children["all"][0] != "ungrouped" {
+		t.Fatalf("inventory does not contain the nested all group: %#v %#v", inv.Groups, inv.Children)
+	}
+}
+
+func TestUnauthorized(t *testing.T) {
+	c, _, ts := newTestClient(t)
+	defer ts.Close()
+
+	c.Token = "bogus"
+	_, err := c.PutHost(newTestHost())
+	if !IsUnauthorized(err) {
+		t.Fatalf("expected unauthorized error, got %v", err)
+	}
+
+	if err.(*Error).ErrorText != "unauthorized" {
+		t.Fatalf("error was not decoded: %#v", err)
+	}
+}
+
+func TestRetryWithBackoff(t *testing.T) {
+	c, ft, ts := newTestClient(t)
+	defer ts.Close()
+
+	ft.failures = 2
+	_, err := c.PutHost(newTestHost())
+	if err != nil {
+		t.Fatalf("request was not retried: %v", err)
+	}
+
+	if ft.requests != 3 {
+		t.Fatalf("expected 3 requests, got %v", ft.requests)
+	}
+
+	ft.failures = c.MaxRetries + 1
+	_, err = c.GetHost("test.example.com")
+	if err == nil {
+		t.Fatalf("expected error after exhausting retries")
+	}
+
+	if e, ok := err.(*Error); !ok || e.StatusCode != 500 || e.ErrorText != "kaboom" {
+		t.Fatalf("unexpected error: %#v", err)
+	}
+}
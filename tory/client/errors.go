@@ -0,0 +1,52 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// Error is returned for any non-2xx response from the tory server, carrying
+// whichever of the "error" or "message" JSON keys was present in the body
+type Error struct {
+	StatusCode int    `json:"-"`
+	ErrorText  string `json:"error"`
+	Message    string `json:"message"`
+}
+
+func newError(statusCode int, body []byte) *Error {
+	e := &Error{StatusCode: statusCode}
+	err := json.Unmarshal(body, e)
+	if err != nil || (e.ErrorText == "" && e.Message == "") {
+		e.ErrorText = http.StatusText(statusCode)
+	}
+
+	return e
+}
+
+func (e *Error) Error() string {
+	text := e.ErrorText
+	if text == "" {
+		text = e.Message
+	}
+
+	return fmt.Sprintf("tory: %v %s", e.StatusCode, text)
+}
+
+// IsNotFound is true when err is an *Error for a 404 response
+func IsNotFound(err error) bool {
+	return hasStatus(err, http.StatusNotFound)
+}
+
+// IsUnauthorized is true when err is an *Error for a 401 response
+func IsUnauthorized(err error) bool {
+	return hasStatus(err, http.StatusUnauthorized)
+}
+
+func hasStatus(err error, statusCode int) bool {
+	if e, ok := err.(*Error); ok {
+		return e.StatusCode == statusCode
+	}
+
+	return false
+}
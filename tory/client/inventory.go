@@ -0,0 +1,87 @@
+package client
+
+import (
+	"encoding/json"
+)
+
+// Meta is the "_meta" portion of an inventory
+type Meta struct {
+	Hostvars map[string]map[string]interface{} `json:"hostvars"`
+}
+
+// Inventory is the ansible-compatible inventory returned by the tory server,
+// where Groups holds the hosts of each group and Children the child groups
+// of those that have any
+type Inventory struct {
+	Meta     *Meta
+	Groups   map[string][]string
+	Children map[string][]string
+}
+
+// group is the ansible JSON form of a group that has children
+type group struct {
+	Hosts    []string `json:"hosts"`
+	Children []string `json:"children"`
+}
+
+func newInventory() *Inventory {
+	return &Inventory{
+		Meta:     &Meta{Hostvars: map[string]map[string]interface{}{}},
+		Groups:   map[string][]string{},
+		Children: map[string][]string{},
+	}
+}
+
+// UnmarshalJSON splits "_meta" from the groups, which are either plain lists
+// of hostnames or objects with "hosts" and "children"
+func (inv *Inventory) UnmarshalJSON(b []byte) error {
+	raw := map[string]json.RawMessage{}
+	err := json.Unmarshal(b, &raw)
+	if err != nil {
+		return err
+	}
+
+	if inv.Groups == nil {
+		inv.Groups = map[string][]string{}
+	}
+
+	if inv.Children == nil {
+		inv.Children = map[string][]string{}
+	}
+
+	for key, value := range raw {
+		if key == "_meta" {
+			m := &Meta{}
+			err := json.Unmarshal(value, m)
+			if err != nil {
+				return err
+			}
+			inv.Meta = m
+			continue
+		}
+
+		hosts := []string{}
+		err := json.Unmarshal(value, &hosts)
+		if err == nil {
+			inv.Groups[key] = hosts
+			continue
+		}
+
+		g := &group{}
+		err = json.Unmarshal(value, g)
+		if err != nil {
+			return err
+		}
+
+		inv.Groups[key] = g.Hosts
+		if inv.Groups[key] == nil {
+			inv.Groups[key] = []string{}
+		}
+
+		if len(g.Children) > 0 {
+			inv.Children[key] = g.Children
+		}
+	}
+
+	return nil
+}
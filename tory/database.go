@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/jmoiron/sqlx"
@@ -16,21 +18,54 @@ import (
 
 var (
 	noHostInDatabaseError = fmt.Errorf("no such host")
+	noHostInTrashError    = fmt.Errorf("no such deleted host")
+	hostNameTakenError    = fmt.Errorf("a host with that name already exists")
 	createHostFailedError = fmt.Errorf("failed to create host")
 	noVarError            = fmt.Errorf("no such var")
 	noTagError            = fmt.Errorf("no such tag")
+	ambiguousHostError    = fmt.Errorf("more than one host has that address")
 )
 
 type database struct {
 	conn *sqlx.DB
 	l    *log.Logger
 	Log  *logrus.Logger
+
+	Normalization NormalizationOptions
 }
 
+// hostMatchSQL matches the live hosts identified by $1, which may be a
+// name, an ip or other address, or an alias
+const hostMatchSQL = `(name = $1 OR host(ip) = $1
+		OR id IN (SELECT host_id FROM host_addresses WHERE host(address) = $1)
+		OR id IN (SELECT host_id FROM host_aliases WHERE alias = $1))
+	AND deleted_at IS NULL`
+
+// hostIDSQL selects the id of the one host matched by hostMatchSQL that is
+// read and written by that identifier: the host of that name, else the most
+// recently modified host with that address, else the host with that alias
+const hostIDSQL = `(
+	SELECT id FROM hosts
+	WHERE ` + hostMatchSQL + `
+	ORDER BY name = $1 DESC,
+		id IN (SELECT host_id FROM host_aliases WHERE alias = $1),
+		modified DESC
+	LIMIT 1)`
+
 type idRow struct {
 	ID int `db:"id"`
 }
 
+type hostMatchRow struct {
+	ID     int64 `db:"id"`
+	ByName bool  `db:"by_name"`
+}
+
+type hostNameRow struct {
+	ID   int64  `db:"id"`
+	Name string `db:"name"`
+}
+
 type valueRow struct {
 	Value sql.NullString `db:"value"`
 }
@@ -50,19 +85,15 @@ func newDatabase(urlString string) (*database, error) {
 	return db, nil
 }
 
-func (db *database) CreateHost(h *host) (*host, error) {
-	tx, err := db.conn.Beginx()
-	if err != nil {
-		return nil, err
-	}
-
-	stmt, err := tx.PrepareNamed(`
-		INSERT INTO hosts (name, package, image, type, ip, tags, vars) 
-		VALUES (:name, :package, :image, :type, :ip, :tags, :vars)
-		RETURNING id`)
+// createHost inserts the host, setting its id
+func (db *database) createHost(tx *sqlx.Tx, h *host) error {
+	stmt, err := tx.PrepareNamed(fmt.Sprintf(`
+		INSERT INTO hosts (name, package, image, type, ip, tags, vars, state)
+		VALUES (:name, :package, :image, :type, :ip, :tags, :vars,
+			COALESCE(NULLIF(:state, ''), '%s'))
+		RETURNING id`, defaultHostState))
 	if err != nil {
-		defer tx.Rollback()
-		return nil, err
+		return err
 	}
 
 	err = stmt.Get(h, h)
@@ -73,27 +104,17 @@ func (db *database) CreateHost(h *host) (*host, error) {
 		} else {
 			db.Log.WithFields(errFields).Warn("failed to scan struct")
 		}
-		defer tx.Rollback()
-		return nil, err
+		return err
 	}
 
 	db.Log.WithField("host", h).Info("created host")
-	err = tx.Commit()
-	if err != nil {
-		return nil, err
-	}
-
-	return db.ReadHost(h.Name)
+	return nil
 }
 
 func (db *database) ReadHost(identifier string) (*host, error) {
+	identifier = normalizeIP(identifier)
 	h := newHost()
-	err := db.conn.Get(h, `
-		SELECT * FROM hosts
-		WHERE name = $1 OR host(ip) = $1
-		ORDER BY modified DESC
-		LIMIT 1`, identifier)
-
+	err := db.conn.Get(h, `SELECT * FROM hosts WHERE id = `+hostIDSQL, identifier)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return nil, noHostInDatabaseError
@@ -101,6 +122,31 @@ func (db *database) ReadHost(identifier string) (*host, error) {
 		return nil, err
 	}
 
+	if h.Name != identifier {
+		aliased := false
+		err = db.conn.Get(&aliased, `
+			SELECT EXISTS (
+				SELECT 1 FROM host_aliases WHERE alias = $1 AND host_id = $2)`,
+			identifier, h.ID)
+		if err != nil {
+			return nil, err
+		}
+
+		if aliased {
+			h.ResolvedAlias = identifier
+		}
+	}
+
+	err = db.loadAddresses([]*host{h})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.loadSecrets([]*host{h})
+	if err != nil {
+		return nil, err
+	}
+
 	return h, nil
 }
 
@@ -108,7 +154,7 @@ func (db *database) ReadAllHosts(hf *hostFilter) ([]*host, error) {
 	query := `SELECT * FROM hosts `
 	whereClause, binds := hf.BuildWhereClause()
 
-	query += whereClause
+	query += whereClause + ` ORDER BY name`
 
 	db.Log.WithFields(logrus.Fields{
 		"filter": hf,
@@ -136,37 +182,128 @@ func (db *database) ReadAllHosts(hf *hostFilter) ([]*host, error) {
 		count++
 	}
 
+	err = db.loadAddresses(hosts)
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.loadSecrets(hosts)
+	if err != nil {
+		return nil, err
+	}
+
 	db.Log.WithField("count", count).Info("returning all hosts")
 	return hosts, nil
 }
 
-func (db *database) UpdateHost(h *host) (*host, error) {
-	tx, err := db.conn.Beginx()
+// EachHostBatch reads the hosts matching the filter ordered by name,
+// starting after the given name, and calls fn with batches of at most
+// batchSize hosts as they come off the cursor, so that memory use does not
+// grow with the number of hosts.  A zero limit reads every matching host.
+func (db *database) EachHostBatch(hf *hostFilter, after string, limit, batchSize int, fn func([]*host) error) error {
+	whereClause, binds := hf.BuildWhereClause()
+	if after != "" {
+		binds = append(binds, after)
+		whereClause += fmt.Sprintf(" AND name > $%d", len(binds))
+	}
+
+	query := `SELECT * FROM hosts ` + whereClause + ` ORDER BY name`
+	if limit > 0 {
+		binds = append(binds, limit)
+		query += fmt.Sprintf(" LIMIT $%d", len(binds))
+	}
+
+	db.Log.WithFields(logrus.Fields{
+		"filter": hf,
+		"query":  query,
+		"binds":  binds,
+	}).Debug("iterating hosts with query and binds")
+
+	rows, err := db.conn.Queryx(query, binds...)
 	if err != nil {
-		return nil, err
+		return err
+	}
+
+	defer rows.Close()
+
+	flush := func(batch []*host) error {
+		if len(batch) == 0 {
+			return nil
+		}
+
+		err := db.loadAddresses(batch)
+		if err != nil {
+			return err
+		}
+
+		err = db.loadSecrets(batch)
+		if err != nil {
+			return err
+		}
+
+		return fn(batch)
+	}
+
+	batch := []*host{}
+	for rows.Next() {
+		h := newHost()
+		err = rows.StructScan(h)
+		if err != nil {
+			return err
+		}
+
+		batch = append(batch, h)
+		if len(batch) >= batchSize {
+			err = flush(batch)
+			if err != nil {
+				return err
+			}
+			batch = []*host{}
+		}
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return err
 	}
 
+	return flush(batch)
+}
+
+// updateHost merges the host into the live host of the same name, setting
+// its id and moving it to any given state by the usual transition rules,
+// or returns noHostInDatabaseError
+func (db *database) updateHost(tx *sqlx.Tx, h *host) error {
 	curHost, err := db.ReadHost(h.Name)
 	if err != nil {
-		defer tx.Rollback()
-		return nil, err
+		return err
 	}
 
-	stmt, err := tx.PrepareNamed(`
+	// a host found by one of its addresses is another host, but one found
+	// by an alias is this one renamed, which is updated in place rather
+	// than brought back under its old name
+	if curHost.Name != h.Name && curHost.ResolvedAlias == "" {
+		return noHostInDatabaseError
+	}
+
+	h.ID = curHost.ID
+	h.Name = curHost.Name
+
+	stmt, err := tx.PrepareNamed(fmt.Sprintf(`
 		UPDATE hosts
 		SET package = :package,
 			image = :image,
 			type = :type,
 			ip = :ip,
-			tags = tags || :tags,
-			vars = vars || :vars,
-			modified = current_timestamp
-		WHERE name = :name
-		RETURNING id`)
+			tags = %s,
+			vars = %s,
+			modified = current_timestamp,
+			stale_at = NULL
+		WHERE id = :id AND deleted_at IS NULL
+		RETURNING id`, mergeHstoreSQL("tags", ":tags"), mergeHstoreSQL("vars", ":vars")))
 
 	if err != nil {
-		defer tx.Rollback()
-		return nil, err
+		return err
 	}
 
 	if h.Package.String == "" {
@@ -184,152 +321,1569 @@ func (db *database) UpdateHost(h *host) (*host, error) {
 	err = stmt.Get(h, h)
 	if err != nil {
 		errFields := logrus.Fields{"err": err}
-		defer tx.Rollback()
 		if err == sql.ErrNoRows {
-			// this is not considered an error because the server update is
-			// doing a bit of tell-don't-ask in order to fall back to host
+			// this is not considered an error because the upsert is doing
+			// a bit of tell-don't-ask in order to fall back to host
 			// creation
 			db.Log.WithFields(errFields).Info("failed to update host")
-			return nil, noHostInDatabaseError
-		} else {
-			db.Log.WithFields(errFields).Warn("failed to scan struct")
-			return nil, err
+			return noHostInDatabaseError
 		}
+		db.Log.WithFields(errFields).Warn("failed to scan struct")
+		return err
 	}
 
-	db.Log.WithField("host", h).Info("updated host")
-	err = tx.Commit()
-	if err != nil {
-		return nil, err
+	if h.State != "" {
+		err = db.transitionState(tx, curHost, h.State)
+		if err != nil {
+			return err
+		}
 	}
 
-	return db.ReadHost(h.Name)
+	db.Log.WithField("host", h).Info("updated host")
+	return nil
 }
 
-func (db *database) DeleteHost(identifier string) error {
-	stmt, err := db.conn.Preparex(`
-		DELETE FROM hosts
-		WHERE name = $1 OR host(ip) = $1
-		RETURNING id`)
+// UpsertHost updates the host by name or alias, falling back to creating
+// it, and returns whether it was created.  The host's addresses are
+// replaced when given, all in one transaction.
+func (db *database) UpsertHost(h *host) (*host, bool, error) {
+	db.Normalization.Apply(h)
+
+	tx, err := db.conn.Beginx()
 	if err != nil {
-		return err
+		return nil, false, err
 	}
 
-	one := &idRow{}
-	err = stmt.Get(one, identifier)
-	if err != nil && err == sql.ErrNoRows {
-		return noHostInDatabaseError
+	defer tx.Rollback()
+
+	created := false
+	err = db.updateHost(tx, h)
+	if err == noHostInDatabaseError {
+		db.Log.WithFields(logrus.Fields{
+			"host": h.Name,
+		}).Info("failed to update, so trying to create instead")
+
+		created = true
+		err = db.createHost(tx, h)
 	}
 
-	return err
-}
+	if err != nil {
+		return nil, false, err
+	}
 
-func (db *database) ReadVarOrTag(which, identifier, key string) (string, error) {
-	stmt, err := db.conn.Preparex(fmt.Sprintf(`
-		SELECT %s -> $2 AS value
-		FROM hosts
-		WHERE name = $1 OR host(ip) = $1
-		ORDER BY modified DESC
-		LIMIT 1`, which))
+	err = writeAddresses(tx, h)
 	if err != nil {
-		return "", err
+		return nil, false, err
 	}
 
-	v := &valueRow{Value: sql.NullString{}}
-	err = stmt.Get(v, identifier, key)
+	err = tx.Commit()
 	if err != nil {
-		if err == sql.ErrNoRows {
-			return "", noHostInDatabaseError
+		return nil, false, err
+	}
+
+	hu, err := db.ReadHost(h.Name)
+	if err != nil {
+		return nil, false, err
+	}
+
+	return hu, created, nil
+}
+
+// writeAddresses replaces the host's addresses when it has any, and
+// otherwise keeps its primary address in step with its ip
+func writeAddresses(tx *sqlx.Tx, h *host) error {
+	if h.Addresses == nil {
+		return syncPrimaryAddress(tx, h)
+	}
+
+	return replaceAddresses(tx, h.ID, h.Addresses)
+}
+
+// writeSealedSecrets stores the host's secrets as they are, without
+// decrypting them, replacing any secret with the same key.  With replace,
+// the host's other secrets are dropped first.
+func writeSealedSecrets(tx *sqlx.Tx, h *host, replace bool) error {
+	if replace {
+		_, err := tx.Exec(`DELETE FROM host_secrets WHERE host_id = $1`, h.ID)
+		if err != nil {
+			return err
 		}
-		return "", err
 	}
 
-	if !v.Value.Valid {
-		switch which {
-		case "vars":
-			return "", noVarError
-		case "tags":
-			return "", noTagError
+	for _, hs := range h.Secrets {
+		_, err := tx.Exec(`DELETE FROM host_secrets WHERE host_id = $1 AND lower(key) = lower($2)`,
+			h.ID, hs.Key)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(`
+			INSERT INTO host_secrets (host_id, key, key_id, wrapped_key, ciphertext, modified)
+			VALUES ($1, $2, $3, $4, $5, $6)`,
+			h.ID, hs.Key, hs.KeyID, hs.WrappedKey, hs.Ciphertext, hs.Modified)
+		if err != nil {
+			return err
 		}
 	}
 
-	return v.Value.String, nil
+	return nil
 }
 
-func (db *database) UpdateVarOrTag(which, identifier, key, value string) error {
-	stmt, err := db.conn.Preparex(fmt.Sprintf(`
-		UPDATE hosts
-		SET %s = %s || $2,
-			modified = current_timestamp
-		WHERE name = $1 OR host(ip) = $1
-		RETURNING id`,
-		which, which))
+// replaceAddresses replaces all of the host's addresses
+func replaceAddresses(tx *sqlx.Tx, hostID int64, addrs []*hostAddress) error {
+	_, err := tx.Exec(`DELETE FROM host_addresses WHERE host_id = $1`, hostID)
+	if err != nil {
+		return err
+	}
 
+	stmt, err := tx.PrepareNamed(`
+		INSERT INTO host_addresses (host_id, label, address, family, is_primary)
+		VALUES (:host_id, :label, :address, :family, :is_primary)
+		RETURNING id`)
 	if err != nil {
 		return err
 	}
 
-	id := &idRow{}
-	err = stmt.Get(id, identifier, &hstore.Hstore{
-		Map: map[string]sql.NullString{
-			key: sql.NullString{
-				String: value,
-				Valid:  true,
-			},
-		},
-	})
+	for _, a := range addrs {
+		a.HostID = hostID
+		err = stmt.Get(a, a)
+		if err != nil {
+			return err
+		}
+	}
 
-	if err != nil && err == sql.ErrNoRows {
-		return noHostInDatabaseError
+	return nil
+}
+
+// syncPrimaryAddress points the host's primary address at its ip, adding
+// one with the "ip" label if there is none
+func syncPrimaryAddress(tx *sqlx.Tx, h *host) error {
+	res, err := tx.Exec(`
+		UPDATE host_addresses
+		SET address = $2::inet,
+			family = family($2::inet)
+		WHERE host_id = $1 AND is_primary`, h.ID, h.IP)
+	if err != nil {
+		return err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil || n > 0 {
+		return err
 	}
 
+	_, err = tx.Exec(`
+		INSERT INTO host_addresses (host_id, label, address, family, is_primary)
+		VALUES ($1, $2, $3::inet, family($3::inet), true)`, h.ID, defaultAddressLabel, h.IP)
 	return err
 }
 
-func (db *database) DeleteVarOrTag(which, identifier, key string) error {
-	stmt, err := db.conn.Preparex(fmt.Sprintf(`
-		UPDATE hosts
-		SET %s = delete(%s, $2),
-			modified = current_timestamp
-		WHERE name = $1 OR host(ip) = $1
-		RETURNING id`,
-		which, which))
+// loadAddresses reads the addresses of all of the given hosts in one query
+func (db *database) loadAddresses(hosts []*host) error {
+	if len(hosts) == 0 {
+		return nil
+	}
+
+	byID := map[int64]*host{}
+	ids := []string{}
+	for _, h := range hosts {
+		h.Addresses = []*hostAddress{}
+		byID[h.ID] = h
+		ids = append(ids, fmt.Sprintf("%d", h.ID))
+	}
 
+	addrs := []*hostAddress{}
+	err := db.conn.Select(&addrs, `
+		SELECT * FROM host_addresses
+		WHERE host_id = ANY($1::integer[])
+		ORDER BY host_id, is_primary DESC, label`, "{"+strings.Join(ids, ",")+"}")
 	if err != nil {
 		return err
 	}
 
-	id := &idRow{}
-	err = stmt.Get(id, identifier, key)
-	if err != nil && err == sql.ErrNoRows {
-		return noHostInDatabaseError
+	for _, a := range addrs {
+		if h, ok := byID[a.HostID]; ok {
+			h.Addresses = append(h.Addresses, a)
+		}
 	}
 
-	return err
+	return nil
 }
 
-func (db *database) ReadVar(name, key string) (string, error) {
-	return db.ReadVarOrTag("vars", name, key)
-}
+// loadSecrets reads the still-encrypted secrets of all of the given hosts
+// in one query
+func (db *database) loadSecrets(hosts []*host) error {
+	if len(hosts) == 0 {
+		return nil
+	}
 
-func (db *database) UpdateVar(identifier, key, value string) error {
-	return db.UpdateVarOrTag("vars", identifier, key, value)
-}
+	byID := map[int64]*host{}
+	ids := []string{}
+	for _, h := range hosts {
+		h.Secrets = []*hostSecret{}
+		byID[h.ID] = h
+		ids = append(ids, fmt.Sprintf("%d", h.ID))
+	}
 
-func (db *database) DeleteVar(identifier, key string) error {
-	return db.DeleteVarOrTag("vars", identifier, key)
+	secrets := []*hostSecret{}
+	err := db.conn.Select(&secrets, `
+		SELECT * FROM host_secrets
+		WHERE host_id = ANY($1::integer[])
+		ORDER BY host_id, key`, "{"+strings.Join(ids, ",")+"}")
+	if err != nil {
+		return err
+	}
+
+	for _, s := range secrets {
+		if h, ok := byID[s.HostID]; ok {
+			h.Secrets = append(h.Secrets, s)
+		}
+	}
+
+	return nil
 }
 
-func (db *database) ReadTag(name, key string) (string, error) {
-	return db.ReadVarOrTag("tags", name, key)
+// PruneSourceHosts deletes every host whose "tory_source" var is source and
+// whose name is not in keep, returning the deleted names
+func (db *database) PruneSourceHosts(source string, keep map[string]bool) ([]string, error) {
+	rows := []*hostNameRow{}
+	err := db.conn.Select(&rows, `
+		SELECT id, name FROM hosts
+		WHERE lower(vars -> $1) = lower($2)
+		AND deleted_at IS NULL`, syncSourceVar, source)
+	if err != nil {
+		return nil, err
+	}
+
+	pruned := []string{}
+	for _, row := range rows {
+		if keep[row.Name] {
+			continue
+		}
+
+		_, err = db.conn.Exec(`
+			UPDATE hosts
+			SET deleted_at = current_timestamp
+			WHERE id = $1
+			AND deleted_at IS NULL`, row.ID)
+		if err != nil {
+			return pruned, err
+		}
+		pruned = append(pruned, row.Name)
+	}
+
+	return pruned, nil
 }
 
-func (db *database) UpdateTag(identifier, key, value string) error {
-	return db.UpdateVarOrTag("tags", identifier, key, value)
+// DeleteHost soft-deletes the host with the name or alias, or else the one
+// host with the ip or other address.  An address that more than one host
+// has is refused with ambiguousHostError rather than deleting them all.
+func (db *database) DeleteHost(identifier string) error {
+	identifier = normalizeIP(identifier)
+	matches := []*hostMatchRow{}
+	err := db.conn.Select(&matches, `
+		SELECT id, name = $1 OR id IN (
+			SELECT host_id FROM host_aliases WHERE alias = $1) AS by_name
+		FROM hosts
+		WHERE `+hostMatchSQL+`
+		ORDER BY by_name DESC`, identifier)
+	if err != nil {
+		return err
+	}
+
+	if len(matches) == 0 {
+		return noHostInDatabaseError
+	}
+
+	if len(matches) > 1 && !matches[0].ByName {
+		return ambiguousHostError
+	}
+
+	_, err = db.conn.Exec(`
+		UPDATE hosts
+		SET deleted_at = current_timestamp
+		WHERE id = $1
+		AND deleted_at IS NULL`, matches[0].ID)
+	return err
 }
 
-func (db *database) DeleteTag(identifier, key string) error {
-	return db.DeleteVarOrTag("tags", identifier, key)
+// ReadDeletedHosts returns every soft-deleted host, most recently deleted
+// first
+func (db *database) ReadDeletedHosts() ([]*host, error) {
+	rows, err := db.conn.Queryx(`
+		SELECT * FROM hosts
+		WHERE deleted_at IS NOT NULL
+		ORDER BY deleted_at DESC, name`)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	hosts := []*host{}
+	for rows.Next() {
+		h := newHost()
+		err = rows.StructScan(h)
+		if err != nil {
+			db.Log.WithField("err", err).Error("failed to scan struct")
+			return nil, err
+		}
+		hosts = append(hosts, h)
+	}
+
+	return hosts, nil
+}
+
+// RestoreHost undeletes the most recently deleted host with the given name,
+// which may not be restored over a live host of the same name
+func (db *database) RestoreHost(name string) (*host, error) {
+	tx, err := db.conn.Beginx()
+	if err != nil {
+		return nil, err
+	}
+
+	defer tx.Rollback()
+
+	live := []string{}
+	err = tx.Select(&live, `
+		SELECT name FROM hosts
+		WHERE name = $1 AND deleted_at IS NULL`, name)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(live) > 0 {
+		return nil, hostNameTakenError
+	}
+
+	id := &idRow{}
+	err = tx.Get(id, `
+		UPDATE hosts
+		SET deleted_at = NULL,
+			stale_at = NULL,
+			modified = current_timestamp
+		WHERE id = (
+			SELECT id FROM hosts
+			WHERE name = $1 AND deleted_at IS NOT NULL
+			ORDER BY deleted_at DESC
+			LIMIT 1
+		)
+		RETURNING id`, name)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, noHostInTrashError
+		}
+		return nil, err
+	}
+
+	db.Log.WithField("host", name).Info("restored host")
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+
+	return db.ReadHost(name)
+}
+
+// RenameHost moves a live host to a new name, keeping its old name as an
+// alias
+func (db *database) RenameHost(identifier, name string) (*host, error) {
+	h, err := db.ReadHost(identifier)
+	if err != nil {
+		return nil, err
+	}
+
+	if h.Name == name {
+		return h, nil
+	}
+
+	tx, err := db.conn.Beginx()
+	if err != nil {
+		return nil, err
+	}
+
+	defer tx.Rollback()
+
+	live := []string{}
+	err = tx.Select(&live, `
+		SELECT name FROM hosts
+		WHERE name = $1 AND deleted_at IS NULL`, name)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(live) > 0 {
+		return nil, hostNameTakenError
+	}
+
+	err = releaseAlias(tx, h.ID, name)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = tx.Exec(`
+		UPDATE hosts
+		SET name = $2,
+			modified = current_timestamp,
+			stale_at = NULL
+		WHERE id = $1`, h.ID, name)
+	if err != nil {
+		return nil, err
+	}
+
+	err = claimAlias(tx, h.ID, h.Name, aliasKindRename)
+	if err != nil {
+		return nil, err
+	}
+
+	db.Log.WithFields(logrus.Fields{"from": h.Name, "to": name}).Info("renamed host")
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+
+	return db.ReadHost(name)
+}
+
+// ReadHostAliases returns the aliases of a live host, oldest first
+func (db *database) ReadHostAliases(identifier string) ([]*hostAlias, error) {
+	h, err := db.ReadHost(identifier)
+	if err != nil {
+		return nil, err
+	}
+
+	aliases := []*hostAlias{}
+	err = db.conn.Select(&aliases, `
+		SELECT * FROM host_aliases
+		WHERE host_id = $1
+		ORDER BY created, alias`, h.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	return aliases, nil
+}
+
+// CreateHostAlias adds an explicit alias to a live host, which may not be
+// the name of a live host or an alias of another one
+func (db *database) CreateHostAlias(identifier, alias string) error {
+	h, err := db.ReadHost(identifier)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.conn.Beginx()
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	live := []string{}
+	err = tx.Select(&live, `
+		SELECT name FROM hosts
+		WHERE name = $1 AND deleted_at IS NULL`, alias)
+	if err != nil {
+		return err
+	}
+
+	if len(live) > 0 {
+		return hostNameTakenError
+	}
+
+	err = claimAlias(tx, h.ID, alias, aliasKindExplicit)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// DeleteHostAlias removes an alias of a live host, whether explicit or
+// kept from a rename
+func (db *database) DeleteHostAlias(identifier, alias string) error {
+	h, err := db.ReadHost(identifier)
+	if err != nil {
+		return err
+	}
+
+	res, err := db.conn.Exec(`
+		DELETE FROM host_aliases
+		WHERE host_id = $1 AND alias = $2`, h.ID, alias)
+	if err != nil {
+		return err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if n == 0 {
+		return noHostAliasError
+	}
+
+	return nil
+}
+
+// claimAlias gives the alias to the host, taking it from a deleted host
+// but not from a live one
+func claimAlias(tx *sqlx.Tx, hostID int64, alias, kind string) error {
+	err := releaseAlias(tx, hostID, alias)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO host_aliases (host_id, alias, kind)
+		VALUES ($1, $2, $3)`, hostID, alias, kind)
+	return err
+}
+
+// releaseAlias removes the alias from the host or a deleted host, so that
+// it may be used as a name or claimed again
+func releaseAlias(tx *sqlx.Tx, hostID int64, alias string) error {
+	owners := []*hostAlias{}
+	err := tx.Select(&owners, `
+		SELECT host_aliases.* FROM host_aliases
+		JOIN hosts ON hosts.id = host_aliases.host_id
+		WHERE host_aliases.alias = $1
+		AND (hosts.deleted_at IS NULL AND hosts.id <> $2)
+		FOR UPDATE`, alias, hostID)
+	if err != nil {
+		return err
+	}
+
+	if len(owners) > 0 {
+		return hostAliasTakenError
+	}
+
+	_, err = tx.Exec(`DELETE FROM host_aliases WHERE alias = $1`, alias)
+	return err
+}
+
+// ImportHosts upserts every host in a single transaction, keeping each
+// host's modified timestamp.  In "merge" mode tags, vars, facts, vault vars,
+// and secrets are merged into any existing ones, while in "replace" mode
+// they are overwritten and any host not present in hosts is deleted.  When
+// dryRun is true the transaction is rolled back after counting.
+func (db *database) ImportHosts(hosts []*host, mode string, dryRun bool) (*importResult, error) {
+	if mode != "merge" && mode != "replace" {
+		return nil, invalidImportModeError
+	}
+
+	tx, err := db.conn.Beginx()
+	if err != nil {
+		return nil, err
+	}
+
+	defer tx.Rollback()
+
+	tagsExpr, varsExpr := mergeHstoreSQL("tags", ":tags"), mergeHstoreSQL("vars", ":vars")
+	factsExpr := mergeHstoreSQL("COALESCE(facts, CAST('' AS hstore))", ":facts")
+	vaultVarsExpr := mergeHstoreSQL("COALESCE(vault_vars, CAST('' AS hstore))", ":vault_vars")
+	if mode == "replace" {
+		tagsExpr, varsExpr = ":tags", ":vars"
+		factsExpr, vaultVarsExpr = ":facts", ":vault_vars"
+	}
+
+	updateStmt, err := tx.PrepareNamed(fmt.Sprintf(`
+		UPDATE hosts
+		SET package = :package,
+			image = :image,
+			type = :type,
+			ip = :ip,
+			tags = %s,
+			vars = %s,
+			facts = %s,
+			vault_vars = %s,
+			modified = :modified,
+			stale_at = NULL
+		WHERE name = :name AND deleted_at IS NULL
+		RETURNING id`, tagsExpr, varsExpr, factsExpr, vaultVarsExpr))
+	if err != nil {
+		return nil, err
+	}
+
+	insertStmt, err := tx.PrepareNamed(fmt.Sprintf(`
+		INSERT INTO hosts (name, package, image, type, ip, tags, vars, facts, vault_vars,
+			modified, state)
+		VALUES (:name, :package, :image, :type, :ip, :tags, :vars, :facts, :vault_vars,
+			:modified, COALESCE(NULLIF(:state, ''), '%s'))
+		RETURNING id`, defaultHostState))
+	if err != nil {
+		return nil, err
+	}
+
+	res := &importResult{}
+	names := map[string]bool{}
+	for _, h := range hosts {
+		names[h.Name] = true
+		db.Normalization.Apply(h)
+		if h.Facts == nil {
+			h.Facts = &hstore.Hstore{Map: map[string]sql.NullString{}}
+		}
+		if h.VaultVars == nil {
+			h.VaultVars = &hstore.Hstore{Map: map[string]sql.NullString{}}
+		}
+
+		id := &idRow{}
+		err = updateStmt.Get(id, h)
+		if err == nil {
+			res.Updated++
+		} else if err == sql.ErrNoRows {
+			err = insertStmt.Get(id, h)
+			if err != nil {
+				db.Log.WithFields(logrus.Fields{"err": err, "host": h.Name}).Error("failed to import host")
+				return nil, err
+			}
+			res.Created++
+		} else {
+			db.Log.WithFields(logrus.Fields{"err": err, "host": h.Name}).Error("failed to import host")
+			return nil, err
+		}
+
+		h.ID = int64(id.ID)
+		err = writeAddresses(tx, h)
+		if err != nil {
+			db.Log.WithFields(logrus.Fields{"err": err, "host": h.Name}).Error("failed to import host addresses")
+			return nil, err
+		}
+
+		err = writeSealedSecrets(tx, h, mode == "replace")
+		if err != nil {
+			db.Log.WithFields(logrus.Fields{"err": err, "host": h.Name}).Error("failed to import host secrets")
+			return nil, err
+		}
+	}
+
+	if mode == "replace" {
+		existing := []string{}
+		err = tx.Select(&existing, `SELECT name FROM hosts WHERE deleted_at IS NULL`)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, name := range existing {
+			if names[name] {
+				continue
+			}
+
+			_, err = tx.Exec(`
+				UPDATE hosts
+				SET deleted_at = current_timestamp
+				WHERE name = $1 AND deleted_at IS NULL`, name)
+			if err != nil {
+				return nil, err
+			}
+			res.Deleted++
+		}
+	}
+
+	if dryRun {
+		return res, nil
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+// UpdateFacts replaces the host's facts, since each payload is a complete
+// snapshot of what was gathered
+func (db *database) UpdateFacts(identifier string, facts map[string]string) error {
+	identifier = normalizeIP(identifier)
+	stmt, err := db.conn.Preparex(`
+		UPDATE hosts
+		SET facts = $2,
+			modified = current_timestamp,
+			stale_at = NULL
+		WHERE id = ` + hostIDSQL + `
+		RETURNING id`)
+	if err != nil {
+		return err
+	}
+
+	id := &idRow{}
+	err = stmt.Get(id, identifier, factsToHstore(facts))
+	if err != nil && err == sql.ErrNoRows {
+		return noHostInDatabaseError
+	}
+
+	return err
+}
+
+// CreateRun records a run for each of its hosts that exists, returning the
+// recorded and unknown hostnames
+func (db *database) CreateRun(run *RunJSON) ([]string, []string, error) {
+	tx, err := db.conn.Beginx()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	defer tx.Rollback()
+
+	stmt, err := tx.PrepareNamed(`
+		INSERT INTO host_runs (host_id, playbook, started, finished, status, ok, changed, failed, unreachable)
+		VALUES (:host_id, :playbook, :started, :finished, :status, :ok, :changed, :failed, :unreachable)
+		RETURNING id`)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	recorded, unknown := []string{}, []string{}
+	for hostname, stats := range run.Hosts {
+		if stats == nil {
+			stats = &RunStatsJSON{}
+		}
+
+		id := &idRow{}
+		err = tx.Get(id, `
+			SELECT id FROM hosts
+			WHERE id = `+hostIDSQL, normalizeIP(hostname))
+		if err == sql.ErrNoRows {
+			unknown = append(unknown, hostname)
+			continue
+		}
+
+		if err != nil {
+			return nil, nil, err
+		}
+
+		hr := &hostRun{
+			HostID:      int64(id.ID),
+			Playbook:    run.Playbook,
+			Started:     run.Start,
+			Finished:    run.End,
+			Status:      stats.Status(),
+			OK:          stats.OK,
+			Changed:     stats.Changed,
+			Failed:      stats.Failed,
+			Unreachable: stats.Unreachable,
+		}
+
+		err = stmt.Get(id, hr)
+		if err != nil {
+			db.Log.WithFields(logrus.Fields{"err": err, "host": hostname}).Error("failed to record run")
+			return nil, nil, err
+		}
+		recorded = append(recorded, hostname)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return recorded, unknown, nil
+}
+
+// ReadLastRun returns the host's most recently finished run, or nil if it
+// has never been run
+func (db *database) ReadLastRun(hostID int64) (*hostRun, error) {
+	run := &hostRun{}
+	err := db.conn.Get(run, `
+		SELECT * FROM host_runs
+		WHERE host_id = $1
+		ORDER BY finished DESC
+		LIMIT 1`, hostID)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return run, nil
+}
+
+// ReadLastSuccessfulRun returns the host's most recently finished run with
+// no failed or unreachable tasks, or nil if there is none
+func (db *database) ReadLastSuccessfulRun(hostID int64) (*hostRun, error) {
+	run := &hostRun{}
+	err := db.conn.Get(run, `
+		SELECT * FROM host_runs
+		WHERE host_id = $1
+		AND failed = 0
+		AND unreachable = 0
+		ORDER BY finished DESC
+		LIMIT 1`, hostID)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return run, nil
+}
+
+// UpdateState moves the host to a new state if the transition is allowed,
+// recording it along with the time it happened
+func (db *database) UpdateState(identifier, state string) (*host, error) {
+	identifier = normalizeIP(identifier)
+	tx, err := db.conn.Beginx()
+	if err != nil {
+		return nil, err
+	}
+
+	defer tx.Rollback()
+
+	cur := newHost()
+	err = tx.Get(cur, `
+		SELECT * FROM hosts
+		WHERE id = `+hostIDSQL+`
+		FOR UPDATE`, identifier)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, noHostInDatabaseError
+		}
+		return nil, err
+	}
+
+	err = db.transitionState(tx, cur, state)
+	if err != nil {
+		return nil, err
+	}
+
+	if cur.State == state {
+		return cur, nil
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+
+	return db.ReadHost(cur.Name)
+}
+
+// transitionState moves the host to the state if the transition is
+// allowed, recording it unless the host is already in that state
+func (db *database) transitionState(tx *sqlx.Tx, cur *host, state string) error {
+	err := checkStateTransition(cur.State, state)
+	if err != nil || cur.State == state {
+		return err
+	}
+
+	_, err = tx.Exec(`
+		UPDATE hosts
+		SET state = $2,
+			state_modified = current_timestamp,
+			modified = current_timestamp,
+			stale_at = NULL
+		WHERE id = $1`, cur.ID, state)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO host_state_transitions (host_id, from_state, to_state)
+		VALUES ($1, $2, $3)`, cur.ID, cur.State, state)
+	if err != nil {
+		return err
+	}
+
+	db.Log.WithFields(logrus.Fields{
+		"host": cur.Name,
+		"from": cur.State,
+		"to":   state,
+	}).Info("transitioned host state")
+
+	return nil
+}
+
+// ReadStateTransitions returns the host's state transitions, oldest first
+func (db *database) ReadStateTransitions(hostID int64) ([]*hostStateTransition, error) {
+	transitions := []*hostStateTransition{}
+	err := db.conn.Select(&transitions, `
+		SELECT from_state, to_state, created FROM host_state_transitions
+		WHERE host_id = $1
+		ORDER BY created, id`, hostID)
+	if err != nil {
+		return nil, err
+	}
+
+	return transitions, nil
+}
+
+// ReapHosts marks and deletes hosts according to the policy and purges
+// hosts deleted longer ago than its trash retention in a single
+// transaction, holding an advisory lock so that concurrent reapers skip
+// rather than race.  When dryRun is true the transaction is rolled back.
+func (db *database) ReapHosts(policy *ReapPolicy, now time.Time, dryRun bool) (*reapResult, error) {
+	tx, err := db.conn.Beginx()
+	if err != nil {
+		return nil, err
+	}
+
+	defer tx.Rollback()
+
+	locked := false
+	err = tx.Get(&locked, `SELECT pg_try_advisory_xact_lock($1)`, reaperLockID)
+	if err != nil {
+		return nil, err
+	}
+
+	if !locked {
+		return nil, reaperLockedError
+	}
+
+	rows, err := tx.Queryx(`SELECT * FROM hosts WHERE deleted_at IS NULL`)
+	if err != nil {
+		return nil, err
+	}
+
+	hosts := []*host{}
+	for rows.Next() {
+		h := newHost()
+		err = rows.StructScan(h)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		hosts = append(hosts, h)
+	}
+	rows.Close()
+
+	stale, del := policy.Plan(hosts, now)
+	res := &reapResult{Stale: []string{}, Deleted: []string{}, Purged: []string{}}
+
+	for _, h := range stale {
+		_, err = tx.Exec(`UPDATE hosts SET stale_at = $2 WHERE id = $1`, h.ID, now)
+		if err != nil {
+			return nil, err
+		}
+		res.Stale = append(res.Stale, h.Name)
+	}
+
+	for _, h := range del {
+		_, err = tx.Exec(`UPDATE hosts SET deleted_at = $2 WHERE id = $1`, h.ID, now)
+		if err != nil {
+			return nil, err
+		}
+		res.Deleted = append(res.Deleted, h.Name)
+	}
+
+	if policy.TrashRetentionDays > 0 {
+		purged := []string{}
+		err = tx.Select(&purged, `
+			DELETE FROM hosts
+			WHERE deleted_at < $1
+			RETURNING name`, now.Add(-days(policy.TrashRetentionDays)))
+		if err != nil {
+			return nil, err
+		}
+		res.Purged = purged
+	}
+
+	if dryRun {
+		return res, nil
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+func (db *database) ReadVarOrTag(which, identifier, key string) (string, error) {
+	identifier = normalizeIP(identifier)
+	stmt, err := db.conn.Preparex(fmt.Sprintf(`
+		SELECT (
+			SELECT value FROM each(%s)
+			WHERE lower(key) = lower($2)
+			ORDER BY key = $2 DESC
+			LIMIT 1
+		) AS value
+		FROM hosts
+		WHERE id = `+hostIDSQL, which))
+	if err != nil {
+		return "", err
+	}
+
+	v := &valueRow{Value: sql.NullString{}}
+	err = stmt.Get(v, identifier, key)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return "", noHostInDatabaseError
+		}
+		return "", err
+	}
+
+	if !v.Value.Valid {
+		switch which {
+		case "vars", "vault_vars":
+			return "", noVarError
+		case "tags":
+			return "", noTagError
+		}
+	}
+
+	return v.Value.String, nil
+}
+
+// UpdateVarOrTag sets the key, normalized according to db.Normalization,
+// replacing any existing key that differs only in case
+func (db *database) UpdateVarOrTag(which, identifier, key, value string) error {
+	identifier = normalizeIP(identifier)
+	key, value = normalizeKeyValue(db.Normalization.Policy(which), key, value)
+	stmt, err := db.conn.Preparex(fmt.Sprintf(`
+		UPDATE hosts
+		SET %s = delete(%s, ARRAY(
+				SELECT key FROM each(%s) WHERE lower(key) = lower($3))) || $2,
+			modified = current_timestamp,
+			stale_at = NULL
+		WHERE id = `+hostIDSQL+`
+		RETURNING id`,
+		which, which, which))
+
+	if err != nil {
+		return err
+	}
+
+	id := &idRow{}
+	err = stmt.Get(id, identifier, &hstore.Hstore{
+		Map: map[string]sql.NullString{
+			key: sql.NullString{
+				String: value,
+				Valid:  true,
+			},
+		},
+	}, key)
+
+	if err != nil && err == sql.ErrNoRows {
+		return noHostInDatabaseError
+	}
+
+	return err
+}
+
+func (db *database) DeleteVarOrTag(which, identifier, key string) error {
+	identifier = normalizeIP(identifier)
+	stmt, err := db.conn.Preparex(fmt.Sprintf(`
+		UPDATE hosts
+		SET %s = delete(%s, ARRAY(
+				SELECT key FROM each(%s) WHERE lower(key) = lower($2))),
+			modified = current_timestamp,
+			stale_at = NULL
+		WHERE id = `+hostIDSQL+`
+		RETURNING id`,
+		which, which, which))
+
+	if err != nil {
+		return err
+	}
+
+	id := &idRow{}
+	err = stmt.Get(id, identifier, key)
+	if err != nil && err == sql.ErrNoRows {
+		return noHostInDatabaseError
+	}
+
+	return err
+}
+
+func (db *database) ReadVar(name, key string) (string, error) {
+	return db.ReadVarOrTag("vars", name, key)
+}
+
+func (db *database) UpdateVar(identifier, key, value string) error {
+	return db.UpdateVarOrTag("vars", identifier, key, value)
+}
+
+func (db *database) DeleteVar(identifier, key string) error {
+	return db.DeleteVarOrTag("vars", identifier, key)
+}
+
+func (db *database) ReadTag(name, key string) (string, error) {
+	return db.ReadVarOrTag("tags", name, key)
+}
+
+func (db *database) UpdateTag(identifier, key, value string) error {
+	return db.UpdateVarOrTag("tags", identifier, key, value)
+}
+
+func (db *database) DeleteTag(identifier, key string) error {
+	return db.DeleteVarOrTag("tags", identifier, key)
+}
+
+// ReadSecret returns the host's secret var, still encrypted
+func (db *database) ReadSecret(identifier, key string) (*hostSecret, error) {
+	identifier = normalizeIP(identifier)
+	s := &hostSecret{}
+	err := db.conn.Get(s, `
+		SELECT * FROM host_secrets
+		WHERE lower(key) = lower($2)
+		AND host_id = `+hostIDSQL, identifier, key)
+
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, noVarError
+		}
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// UpdateSecret stores the sealed secret var, replacing any plain var or
+// secret with the same key
+func (db *database) UpdateSecret(identifier, key string, sealed *sealedSecret) error {
+	identifier = normalizeIP(identifier)
+	key, _ = normalizeKeyValue(db.Normalization.Policy("vars"), key, "")
+
+	tx, err := db.conn.Beginx()
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	id := &idRow{}
+	err = tx.Get(id, `
+		UPDATE hosts
+		SET vars = delete(vars, ARRAY(
+				SELECT key FROM each(vars) WHERE lower(key) = lower($2))),
+			vault_vars = delete(vault_vars, ARRAY(
+				SELECT key FROM each(vault_vars) WHERE lower(key) = lower($2))),
+			modified = current_timestamp,
+			stale_at = NULL
+		WHERE id = `+hostIDSQL+`
+		RETURNING id`, identifier, key)
+
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return noHostInDatabaseError
+		}
+		return err
+	}
+
+	_, err = tx.Exec(`DELETE FROM host_secrets WHERE host_id = $1 AND lower(key) = lower($2)`,
+		id.ID, key)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO host_secrets (host_id, key, key_id, wrapped_key, ciphertext)
+		VALUES ($1, $2, $3, $4, $5)`,
+		id.ID, key, sealed.KeyID, sealed.WrappedKey, sealed.Ciphertext)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// UpdatePlainVar stores the plain var, replacing any secret or vault var
+// with the same key
+func (db *database) UpdatePlainVar(identifier, key, value string) error {
+	identifier = normalizeIP(identifier)
+	key, value = normalizeKeyValue(db.Normalization.Policy("vars"), key, value)
+
+	tx, err := db.conn.Beginx()
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	id := &idRow{}
+	err = tx.Get(id, `
+		UPDATE hosts
+		SET vars = delete(vars, ARRAY(
+				SELECT key FROM each(vars) WHERE lower(key) = lower($3))) || $2,
+			vault_vars = delete(vault_vars, ARRAY(
+				SELECT key FROM each(vault_vars) WHERE lower(key) = lower($3))),
+			modified = current_timestamp,
+			stale_at = NULL
+		WHERE id = `+hostIDSQL+`
+		RETURNING id`, identifier, &hstore.Hstore{
+		Map: map[string]sql.NullString{
+			key: sql.NullString{
+				String: value,
+				Valid:  true,
+			},
+		},
+	}, key)
+
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return noHostInDatabaseError
+		}
+		return err
+	}
+
+	_, err = tx.Exec(`DELETE FROM host_secrets WHERE host_id = $1 AND lower(key) = lower($2)`,
+		id.ID, key)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// PurgeVar removes the host's plain var, vault var and secret with the key,
+// if any
+func (db *database) PurgeVar(identifier, key string) error {
+	identifier = normalizeIP(identifier)
+
+	tx, err := db.conn.Beginx()
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	id := &idRow{}
+	err = tx.Get(id, `
+		UPDATE hosts
+		SET vars = delete(vars, ARRAY(
+				SELECT key FROM each(vars) WHERE lower(key) = lower($2))),
+			vault_vars = delete(vault_vars, ARRAY(
+				SELECT key FROM each(vault_vars) WHERE lower(key) = lower($2))),
+			modified = current_timestamp,
+			stale_at = NULL
+		WHERE id = `+hostIDSQL+`
+		RETURNING id`, identifier, key)
+
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return noHostInDatabaseError
+		}
+		return err
+	}
+
+	_, err = tx.Exec(`DELETE FROM host_secrets WHERE host_id = $1 AND lower(key) = lower($2)`,
+		id.ID, key)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// ReadVaultVar returns the ansible vault text of the host's vault var
+func (db *database) ReadVaultVar(identifier, key string) (string, error) {
+	return db.ReadVarOrTag("vault_vars", identifier, key)
+}
+
+// UpdateVaultVar stores the ansible vault text as-is, replacing any plain
+// var or secret with the same key
+func (db *database) UpdateVaultVar(identifier, key, value string) error {
+	identifier = normalizeIP(identifier)
+	key, _ = normalizeKeyValue(db.Normalization.Policy("vars"), key, "")
+
+	tx, err := db.conn.Beginx()
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	id := &idRow{}
+	err = tx.Get(id, `
+		UPDATE hosts
+		SET vars = delete(vars, ARRAY(
+				SELECT key FROM each(vars) WHERE lower(key) = lower($3))),
+			vault_vars = delete(COALESCE(vault_vars, ''::hstore), ARRAY(
+				SELECT key FROM each(vault_vars) WHERE lower(key) = lower($3))) || $2,
+			modified = current_timestamp,
+			stale_at = NULL
+		WHERE id = `+hostIDSQL+`
+		RETURNING id`, identifier, &hstore.Hstore{
+		Map: map[string]sql.NullString{
+			key: sql.NullString{
+				String: value,
+				Valid:  true,
+			},
+		},
+	}, key)
+
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return noHostInDatabaseError
+		}
+		return err
+	}
+
+	_, err = tx.Exec(`DELETE FROM host_secrets WHERE host_id = $1 AND lower(key) = lower($2)`,
+		id.ID, key)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// RewrapSecrets rewraps the data key of every secret with the keyring's
+// current key, returning how many were rewrapped
+func (db *database) RewrapSecrets(kr *secretKeyring) (int, error) {
+	tx, err := db.conn.Beginx()
+	if err != nil {
+		return 0, err
+	}
+
+	defer tx.Rollback()
+
+	secrets := []*hostSecret{}
+	err = tx.Select(&secrets, `SELECT * FROM host_secrets ORDER BY id FOR UPDATE`)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, s := range secrets {
+		err = kr.Rewrap(&s.sealedSecret)
+		if err != nil {
+			return 0, err
+		}
+
+		_, err = tx.Exec(`
+			UPDATE host_secrets
+			SET key_id = $2, wrapped_key = $3
+			WHERE id = $1`, s.ID, s.KeyID, s.WrappedKey)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return 0, err
+	}
+
+	return len(secrets), nil
+}
+
+// ReadCatalogKeys counts the hosts matching the filter that have each tag
+// or var key
+func (db *database) ReadCatalogKeys(which string, hf *hostFilter) ([]*catalogKey, error) {
+	whereClause, binds := hf.BuildWhereClause()
+	keys := []*catalogKey{}
+	err := db.conn.Select(&keys, fmt.Sprintf(`
+		SELECT key, count(*) AS count
+		FROM (SELECT skeys(%s) AS key FROM hosts %s) AS k
+		GROUP BY key
+		ORDER BY key`, which, whereClause), binds...)
+	if err != nil {
+		return nil, err
+	}
+
+	return keys, nil
+}
+
+// ReadCatalogValues counts the hosts matching the filter that have each
+// value of the tag or var key, matching the key case-insensitively
+func (db *database) ReadCatalogValues(which, key string, hf *hostFilter) ([]*catalogValue, error) {
+	whereClause, binds := hf.BuildWhereClause()
+	binds = append(binds, key)
+	values := []*catalogValue{}
+	err := db.conn.Select(&values, fmt.Sprintf(`
+		SELECT value, count(*) AS count
+		FROM (SELECT (each(%s)).* FROM hosts %s) AS e
+		WHERE lower(key) = lower($%d) AND value IS NOT NULL
+		GROUP BY value
+		ORDER BY count DESC, value`, which, whereClause, len(binds)), binds...)
+	if err != nil {
+		return nil, err
+	}
+
+	return values, nil
+}
+
+// ReadSummary counts the hosts matching the filter grouped by each of the
+// dimensions, buckets them by the age of their modified time, and lists
+// those missing any of the required tags
+func (db *database) ReadSummary(hf *hostFilter, dims, required []string, now time.Time) (*summaryReport, error) {
+	report := &summaryReport{
+		By:           dims,
+		Groups:       []*summaryGroup{},
+		AgeHistogram: newAgeHistogram(),
+		MissingTags:  map[string][]string{},
+	}
+
+	whereClause, binds := hf.BuildWhereClause()
+
+	cases := []string{}
+	ageBinds := append([]interface{}{}, binds...)
+	for i, b := range report.AgeHistogram {
+		if b.Max == 0 {
+			cases = append(cases, fmt.Sprintf("ELSE %d", i))
+			continue
+		}
+		ageBinds = append(ageBinds, now.Add(-b.Max))
+		cases = append(cases, fmt.Sprintf("WHEN modified > $%d THEN %d", len(ageBinds), i))
+	}
+
+	rows, err := db.conn.Queryx(fmt.Sprintf(`
+		SELECT CASE %s END AS bucket, count(*) AS count
+		FROM hosts %s
+		GROUP BY bucket`, strings.Join(cases, " "), whereClause), ageBinds...)
+	if err != nil {
+		return nil, err
+	}
+
+	for rows.Next() {
+		var bucket, count int
+		err = rows.Scan(&bucket, &count)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+
+		report.AgeHistogram[bucket].Count = count
+		report.Total += count
+	}
+
+	rows.Close()
+
+	if len(dims) > 0 {
+		groupBinds := append([]interface{}{}, binds...)
+		exprs := []string{}
+		positions := []string{}
+		for i, dim := range dims {
+			exprs = append(exprs, summaryExpr(dim, &groupBinds))
+			positions = append(positions, fmt.Sprintf("%d", i+1))
+		}
+
+		rows, err = db.conn.Queryx(fmt.Sprintf(`
+			SELECT %s, count(*) AS count
+			FROM hosts %s
+			GROUP BY %s
+			ORDER BY count DESC, %s`,
+			strings.Join(exprs, ", "), whereClause,
+			strings.Join(positions, ", "), strings.Join(positions, ", ")), groupBinds...)
+		if err != nil {
+			return nil, err
+		}
+
+		defer rows.Close()
+
+		for rows.Next() {
+			values := make([]sql.NullString, len(dims))
+			dest := []interface{}{}
+			for i := range values {
+				dest = append(dest, &values[i])
+			}
+
+			g := &summaryGroup{Values: map[string]string{}}
+			err = rows.Scan(append(dest, &g.Count)...)
+			if err != nil {
+				return nil, err
+			}
+
+			for i, dim := range dims {
+				g.Values[dim] = values[i].String
+			}
+
+			report.Groups = append(report.Groups, g)
+		}
+
+		err = rows.Err()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, key := range required {
+		missingBinds := append(append([]interface{}{}, binds...), key)
+		names := []string{}
+		err = db.conn.Select(&names, fmt.Sprintf(`
+			SELECT name FROM hosts %s
+			AND NOT EXISTS (
+				SELECT 1 FROM each(tags)
+				WHERE lower(key) = lower($%d) AND value <> '')
+			ORDER BY name`, whereClause, len(missingBinds)), missingBinds...)
+		if err != nil {
+			return nil, err
+		}
+
+		report.MissingTags[key] = names
+	}
+
+	return report, nil
+}
+
+// ReadTagPolicy returns the policy rules stored in the database
+func (db *database) ReadTagPolicy() (*TagPolicy, error) {
+	rows := []*policyRuleRow{}
+	err := db.conn.Select(&rows, `
+		SELECT key, required, allowed, exempt_types
+		FROM policy_rules
+		ORDER BY lower(key)`)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &TagPolicy{Rules: []*PolicyRule{}}
+	for _, row := range rows {
+		rule, err := policyRuleFromRow(row)
+		if err != nil {
+			return nil, err
+		}
+
+		p.Rules = append(p.Rules, rule)
+	}
+
+	return p, nil
+}
+
+// ReplaceTagPolicy swaps every stored policy rule for those of the policy
+func (db *database) ReplaceTagPolicy(p *TagPolicy) error {
+	tx, err := db.conn.Beginx()
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`DELETE FROM policy_rules`)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	for _, rule := range p.Rules {
+		row, err := policyRuleToRow(rule)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+
+		_, err = tx.NamedExec(`
+			INSERT INTO policy_rules (key, required, allowed, exempt_types)
+			VALUES (:key, :required, :allowed, :exempt_types)`, row)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// Renormalize rewrites the keys and values of every host's tags and vars
+// according to db.Normalization
+func (db *database) Renormalize() error {
+	for _, which := range []string{"tags", "vars"} {
+		expr := renormalizeSQL(db.Normalization.Policy(which), which)
+		if expr == "" {
+			continue
+		}
+
+		_, err := db.conn.Exec(fmt.Sprintf(`UPDATE hosts SET %s = %s`, which, expr))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
 }
 
 func (db *database) Setup(migrations map[string][]string) error {
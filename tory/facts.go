@@ -0,0 +1,115 @@
+package tory
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/lib/pq/hstore"
+)
+
+var (
+	// DefaultFactsAllowlist is the set of facts kept by default, named
+	// without their "ansible_" prefix
+	DefaultFactsAllowlist = []string{
+		"distribution",
+		"kernel",
+		"memtotal_mb",
+		"processor_vcpus",
+		"default_ipv4",
+	}
+
+	factsHostvarPrefix = "tory_facts_"
+
+	noFactsJSONError = fmt.Errorf("no JSON object in facts payload")
+)
+
+// parseFacts reads either the JSON output of `ansible -m setup`, optionally
+// still prefixed with its "host | SUCCESS =>" line, or a jsonfile fact cache
+// entry, and returns the allowed facts.  Facts are keyed without their
+// "ansible_" prefix, and nested objects such as "default_ipv4" are flattened
+// with "." separators, e.g. "default_ipv4.address".
+func parseFacts(in io.Reader, allowlist map[string]bool) (map[string]string, error) {
+	body, err := ioutil.ReadAll(in)
+	if err != nil {
+		return nil, err
+	}
+
+	start := bytes.IndexByte(body, '{')
+	if start < 0 {
+		return nil, noFactsJSONError
+	}
+
+	raw := map[string]interface{}{}
+	err = json.Unmarshal(body[start:], &raw)
+	if err != nil {
+		return nil, err
+	}
+
+	if nested, ok := raw["ansible_facts"].(map[string]interface{}); ok {
+		raw = nested
+	}
+
+	facts := map[string]string{}
+	for key, value := range raw {
+		key = strings.TrimPrefix(key, "ansible_")
+		if !allowlist[key] {
+			continue
+		}
+		flattenFact(key, value, facts)
+	}
+
+	return facts, nil
+}
+
+func flattenFact(key string, value interface{}, out map[string]string) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for nestedKey, nested := range v {
+			flattenFact(key+"."+nestedKey, nested, out)
+		}
+	case []interface{}:
+		b, err := json.Marshal(v)
+		if err == nil {
+			out[key] = string(b)
+		}
+	case nil:
+	default:
+		out[key] = fmt.Sprintf("%v", v)
+	}
+}
+
+func newFactsAllowlist(facts []string) map[string]bool {
+	if len(facts) == 0 {
+		facts = DefaultFactsAllowlist
+	}
+
+	allowlist := map[string]bool{}
+	for _, fact := range facts {
+		fact = strings.TrimPrefix(strings.TrimSpace(fact), "ansible_")
+		if fact != "" {
+			allowlist[fact] = true
+		}
+	}
+
+	return allowlist
+}
+
+func factsToHstore(facts map[string]string) *hstore.Hstore {
+	hs := &hstore.Hstore{Map: map[string]sql.NullString{}}
+	for key, value := range facts {
+		hs.Map[key] = sql.NullString{String: value, Valid: true}
+	}
+
+	return hs
+}
+
+// factHostvarKey returns the hostvar name for a stored fact key, e.g.
+// "default_ipv4.address" -> "tory_facts_default_ipv4_address"
+func factHostvarKey(key string) string {
+	return factsHostvarPrefix + strings.Replace(strings.ToLower(key), ".", "_", -1)
+}
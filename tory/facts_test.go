@@ -0,0 +1,68 @@
+package tory
+
+import (
+	"strings"
+	"testing"
+)
+
+var (
+	testSetupOutput = `web1.example.com | SUCCESS => {
+    "ansible_facts": {
+        "ansible_distribution": "Ubuntu",
+        "ansible_kernel": "3.13.0-32-generic",
+        "ansible_memtotal_mb": 3953,
+        "ansible_processor_vcpus": 2,
+        "ansible_default_ipv4": {"address": "10.10.1.47", "interface": "eth0"},
+        "ansible_env": {"HOME": "/root"},
+        "ansible_all_ipv4_addresses": ["10.10.1.47"]
+    },
+    "changed": false
+}`
+	testFactCache = `{"ansible_distribution": "CentOS", "ansible_kernel": "2.6.32", "facter_uptime": "1 day"}`
+)
+
+func TestParseFacts(t *testing.T) {
+	facts, err := parseFacts(strings.NewReader(testSetupOutput), newFactsAllowlist(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for key, value := range map[string]string{
+		"distribution":         "Ubuntu",
+		"kernel":               "3.13.0-32-generic",
+		"memtotal_mb":          "3953",
+		"processor_vcpus":      "2",
+		"default_ipv4.address": "10.10.1.47",
+	} {
+		if facts[key] != value {
+			t.Fatalf("fact %q is %q, not %q", key, facts[key], value)
+		}
+	}
+
+	if _, ok := facts["env.HOME"]; ok {
+		t.Fatalf("fact not in allowlist was kept: %#v", facts)
+	}
+
+	facts, err = parseFacts(strings.NewReader(testFactCache),
+		newFactsAllowlist([]string{"ansible_distribution", "facter_uptime"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(facts) != 2 || facts["distribution"] != "CentOS" || facts["facter_uptime"] != "1 day" {
+		t.Fatalf("fact cache was not parsed with the configured allowlist: %#v", facts)
+	}
+}
+
+func TestParseFactsInvalid(t *testing.T) {
+	_, err := parseFacts(strings.NewReader("web1.example.com | UNREACHABLE!"), newFactsAllowlist(nil))
+	if err != noFactsJSONError {
+		t.Fatalf("expected %v, got %v", noFactsJSONError, err)
+	}
+}
+
+func TestFactHostvarKey(t *testing.T) {
+	if key := factHostvarKey("default_ipv4.address"); key != "tory_facts_default_ipv4_address" {
+		t.Fatalf("unexpected hostvar key %q", key)
+	}
+}
@@ -0,0 +1,241 @@
+package tory
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"text/template"
+)
+
+var (
+	// DefaultGroupConfig groups hosts by ip, type, and every tag, as tory
+	// always has
+	DefaultGroupConfig = &GroupConfig{}
+)
+
+// GroupConfig sets which inventory groups each host is put in.  The ip,
+// type, and "tag_KEY_VALUE" groups are on unless disabled, and every
+// enabled template adds a group named after what it renders to.
+//
+// Each of the Hierarchies is a list of tag keys such as ["env", "team",
+// "role"] that nests groups of hosts by tag value, e.g. "tag_env_prod" with
+// the child "prod_fribbles", which has the child "prod_fribbles_web".
+type GroupConfig struct {
+	DisableIPGroups   bool             `json:"disable_ip_groups"`
+	DisableTypeGroups bool             `json:"disable_type_groups"`
+	DisableTagGroups  bool             `json:"disable_tag_groups"`
+	Templates         []*GroupTemplate `json:"templates"`
+	Hierarchies       [][]string       `json:"hierarchies"`
+}
+
+// GroupTemplate is a text/template such as "env_{{.Tags.env}}" rendered
+// against each host's name, ip, package, image, type, state, tags, and
+// vars.  Hosts missing a key the template refers to are left out of its
+// group.
+type GroupTemplate struct {
+	Name     string `json:"name"`
+	Template string `json:"template"`
+	Disabled bool   `json:"disabled"`
+
+	tmpl *template.Template
+}
+
+type groupTemplateData struct {
+	Name    string
+	IP      string
+	Package string
+	Image   string
+	Type    string
+	State   string
+	Tags    map[string]string
+	Vars    map[string]string
+}
+
+func readGroupConfig(filename string) (*GroupConfig, error) {
+	if filename == "" {
+		return DefaultGroupConfig, nil
+	}
+
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	gc := &GroupConfig{}
+	err = json.NewDecoder(f).Decode(gc)
+	if err != nil {
+		return nil, err
+	}
+
+	err = gc.Compile()
+	if err != nil {
+		return nil, err
+	}
+
+	return gc, nil
+}
+
+// Compile parses every enabled template
+func (gc *GroupConfig) Compile() error {
+	for i, gt := range gc.Templates {
+		if gt.Disabled {
+			continue
+		}
+
+		name := gt.Name
+		if name == "" {
+			name = fmt.Sprintf("template%d", i)
+		}
+
+		tmpl, err := template.New(name).Option("missingkey=error").Parse(gt.Template)
+		if err != nil {
+			return err
+		}
+
+		gt.tmpl = tmpl
+	}
+
+	return nil
+}
+
+// AddHost adds the host to each of its groups in the inventory
+func (gc *GroupConfig) AddHost(inv *inventory, h *host) {
+	inv.AddHost(h.Name)
+
+	if !gc.DisableIPGroups && h.IP != nil {
+		inv.AddHostnameToIPGroup(h.IP.Addr, h.Name)
+	}
+
+	if !gc.DisableTypeGroups && h.Type.String != "" {
+		inv.AddHostnameToGroup(fmt.Sprintf("type_%s",
+			strings.ToLower(h.Type.String)), h.Name)
+	}
+
+	if h.State != "" {
+		inv.AddHostnameToGroup(fmt.Sprintf("state_%s", h.State), h.Name)
+	}
+
+	if h.StaleAt != nil {
+		inv.AddHostnameToGroup("stale", h.Name)
+	}
+
+	if !gc.DisableTagGroups && h.Tags != nil && h.Tags.Map != nil {
+		for key, value := range h.Tags.Map {
+			if value.String == "" {
+				continue
+			}
+			invKey := fmt.Sprintf("tag_%s_%s",
+				strings.ToLower(key), strings.ToLower(value.String))
+			inv.AddHostnameToGroup(invKey, h.Name)
+		}
+	}
+
+	for _, group := range gc.templateGroups(h) {
+		inv.AddHostnameToGroup(group, h.Name)
+	}
+
+	for _, keys := range gc.Hierarchies {
+		addHostToHierarchy(inv, h, keys)
+	}
+}
+
+// addHostToHierarchy adds the host to the deepest group of the hierarchy
+// that its tags reach, creating the parent/child links along the way.  The
+// top group is the host's "tag_KEY_VALUE" group and each one below is named
+// after the tag values so far, joined with underscores.
+func addHostToHierarchy(inv *inventory, h *host, keys []string) {
+	if len(keys) == 0 || h.Tags == nil {
+		return
+	}
+
+	tags := newGroupTemplateData(h).Tags
+	values := []string{}
+	group := ""
+	for _, key := range keys {
+		value, ok := tags[strings.ToLower(key)]
+		if !ok {
+			break
+		}
+
+		values = append(values, value)
+		child := strings.Join(values, "_")
+		if len(values) == 1 {
+			child = fmt.Sprintf("tag_%s_%s", key, value)
+		} else {
+			inv.AddChildToGroup(group, child)
+		}
+
+		group = child
+	}
+
+	if group != "" {
+		inv.AddHostnameToGroup(group, h.Name)
+	}
+}
+
+// templateGroups renders every enabled template for the host, skipping
+// those that fail or render empty
+func (gc *GroupConfig) templateGroups(h *host) []string {
+	if len(gc.Templates) == 0 {
+		return nil
+	}
+
+	data := newGroupTemplateData(h)
+	groups := []string{}
+	for _, gt := range gc.Templates {
+		if gt.Disabled || gt.tmpl == nil {
+			continue
+		}
+
+		buf := &bytes.Buffer{}
+		if err := gt.tmpl.Execute(buf, data); err != nil {
+			continue
+		}
+
+		if group := strings.TrimSpace(buf.String()); group != "" {
+			groups = append(groups, group)
+		}
+	}
+
+	return groups
+}
+
+// newGroupTemplateData lowercases tag and var keys so that templates match
+// regardless of how they are stored
+func newGroupTemplateData(h *host) *groupTemplateData {
+	data := &groupTemplateData{
+		Name:    h.Name,
+		Package: h.Package.String,
+		Image:   h.Image.String,
+		Type:    h.Type.String,
+		State:   h.State,
+		Tags:    map[string]string{},
+		Vars:    map[string]string{},
+	}
+
+	if h.IP != nil {
+		data.IP = h.IP.Addr
+	}
+
+	if h.Tags != nil {
+		for key, value := range h.Tags.Map {
+			if value.String != "" {
+				data.Tags[strings.ToLower(key)] = value.String
+			}
+		}
+	}
+
+	if h.Vars != nil {
+		for key, value := range h.Vars.Map {
+			if value.String != "" {
+				data.Vars[strings.ToLower(key)] = value.String
+			}
+		}
+	}
+
+	return data
+}
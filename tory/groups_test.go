@@ -0,0 +1,102 @@
+package tory
+
+import (
+	"database/sql"
+	"testing"
+
+	"github.com/lib/pq/hstore"
+)
+
+func testGroupsHost() *host {
+	return &host{
+		Name: "web1.example.com",
+		IP:   &inet{Addr: "10.10.1.7"},
+		Type: sql.NullString{String: "virtualmachine", Valid: true},
+		Tags: &hstore.Hstore{Map: map[string]sql.NullString{
+			"Role": sql.NullString{String: "web", Valid: true},
+			"env":  sql.NullString{String: "Prod", Valid: true},
+		}},
+	}
+}
+
+func TestDefaultGroupConfig(t *testing.T) {
+	inv := newInventory()
+	DefaultGroupConfig.AddHost(inv, testGroupsHost())
+
+	for _, group := range []string{"10.10.1.7", "type_virtualmachine", "tag_role_web", "tag_env_prod"} {
+		if inv.GetGroup(group) == nil {
+			t.Fatalf("expected group %q in %v", group, inv.groups)
+		}
+	}
+}
+
+func TestGroupConfigTemplates(t *testing.T) {
+	gc := &GroupConfig{
+		DisableIPGroups:   true,
+		DisableTypeGroups: true,
+		DisableTagGroups:  true,
+		Templates: []*GroupTemplate{
+			&GroupTemplate{Template: "role_{{.Tags.role}}"},
+			&GroupTemplate{Template: "env_{{.Tags.env}}"},
+			&GroupTemplate{Template: "team_{{.Tags.team}}"},
+			&GroupTemplate{Template: "{{.Type}}", Disabled: true},
+		},
+	}
+
+	err := gc.Compile()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	inv := newInventory()
+	gc.AddHost(inv, testGroupsHost())
+
+	for _, group := range []string{"role_web", "env_prod"} {
+		if inv.GetGroup(group) == nil {
+			t.Fatalf("expected group %q in %v", group, inv.groups)
+		}
+	}
+
+	for _, group := range []string{"10.10.1.7", "type_virtualmachine", "tag_role_web", "team_", "virtualmachine"} {
+		if inv.GetGroup(group) != nil {
+			t.Fatalf("unexpected group %q in %v", group, inv.groups)
+		}
+	}
+}
+
+func TestGroupConfigCompileError(t *testing.T) {
+	gc := &GroupConfig{Templates: []*GroupTemplate{&GroupTemplate{Template: "{{.Tags.role"}}}
+	if gc.Compile() == nil {
+		t.Fatalf("expected a template parse error")
+	}
+}
+
+func TestGroupConfigHierarchies(t *testing.T) {
+	gc := &GroupConfig{Hierarchies: [][]string{[]string{"env", "team", "role"}}}
+
+	h := testGroupsHost()
+	h.Tags.Map["team"] = sql.NullString{String: "Fribbles", Valid: true}
+
+	partial := testGroupsHost()
+	partial.Name = "web2.example.com"
+
+	inv := newInventory()
+	gc.AddHost(inv, h)
+	gc.AddHost(inv, partial)
+
+	if children := inv.GetChildren("tag_env_prod"); len(children) != 1 || children[0] != "prod_fribbles" {
+		t.Fatalf("expected tag_env_prod children [prod_fribbles], got %v", children)
+	}
+
+	if children := inv.GetChildren("prod_fribbles"); len(children) != 1 || children[0] != "prod_fribbles_web" {
+		t.Fatalf("expected prod_fribbles children [prod_fribbles_web], got %v", children)
+	}
+
+	if hosts := inv.GetGroup("prod_fribbles_web"); len(hosts) != 1 || hosts[0] != h.Name {
+		t.Fatalf("expected prod_fribbles_web hosts [%s], got %v", h.Name, hosts)
+	}
+
+	if hosts := inv.GetGroup("tag_env_prod"); len(hosts) != 2 {
+		t.Fatalf("expected tag_env_prod to hold both hosts once, got %v", hosts)
+	}
+}
@@ -9,6 +9,7 @@ import (
 	"time"
 
 	"github.com/lib/pq/hstore"
+	"github.com/modcloth/tory/tory/api"
 )
 
 var (
@@ -25,32 +26,31 @@ type host struct {
 	Image   sql.NullString `db:"image"`
 	Type    sql.NullString `db:"type"`
 
-	Tags *hstore.Hstore `db:"tags"`
-	Vars *hstore.Hstore `db:"vars"`
+	Tags  *hstore.Hstore `db:"tags"`
+	Vars  *hstore.Hstore `db:"vars"`
+	Facts *hstore.Hstore `db:"facts"`
 
-	Modified time.Time `db:"modified"`
-}
-
-type HostJSON struct {
-	ID int64 `json:"id,omitempty"`
+	// VaultVars hold ansible vault text, kept apart from Vars so that it is
+	// never normalized
+	VaultVars *hstore.Hstore `db:"vault_vars"`
 
-	Name string `json:"name"`
-	IP   string `json:"ip"`
+	State         string    `db:"state"`
+	StateModified time.Time `db:"state_modified"`
 
-	Package string `json:"package,omitempty"`
-	Image   string `json:"image,omitempty"`
-	Type    string `json:"type,omitempty"`
+	Modified  time.Time  `db:"modified"`
+	StaleAt   *time.Time `db:"stale_at"`
+	DeletedAt *time.Time `db:"deleted_at"`
 
-	Tags map[string]interface{} `json:"tags,omitempty"`
-	Vars map[string]interface{} `json:"vars,omitempty"`
-}
+	Addresses []*hostAddress `db:"-"`
+	Secrets   []*hostSecret  `db:"-"`
 
-type HostPayload struct {
-	Host *HostJSON `json:"host"`
+	// ResolvedAlias is the alias the host was read by, if it was not read
+	// by its name or an address
+	ResolvedAlias string `db:"-"`
 }
 
-func hostJSONFromHTTPBody(in io.Reader) (*HostJSON, error) {
-	payload := &HostPayload{}
+func hostJSONFromHTTPBody(in io.Reader) (*api.HostJSON, error) {
+	payload := &api.HostPayload{}
 	err := json.NewDecoder(in).Decode(payload)
 	if payload.Host == nil {
 		return nil, invalidHostPayloadError
@@ -60,40 +60,43 @@ func hostJSONFromHTTPBody(in io.Reader) (*HostJSON, error) {
 
 func newHost() *host {
 	return &host{
-		Tags: &hstore.Hstore{},
-		Vars: &hstore.Hstore{},
-	}
-}
-
-func NewHostJSON() *HostJSON {
-	return &HostJSON{
-		Tags: map[string]interface{}{},
-		Vars: map[string]interface{}{},
+		Tags:      &hstore.Hstore{},
+		Vars:      &hstore.Hstore{},
+		Facts:     &hstore.Hstore{},
+		VaultVars: &hstore.Hstore{},
 	}
 }
 
-func hostJSONToHost(hj *HostJSON) *host {
+func hostJSONToHost(hj *api.HostJSON) *host {
 	h := &host{
 		ID:      hj.ID,
 		Name:    hj.Name,
-		IP:      &inet{Addr: hj.IP},
+		IP:      &inet{Addr: normalizeIP(hj.IP)},
 		Package: sql.NullString{String: hj.Package, Valid: true},
 		Image:   sql.NullString{String: hj.Image, Valid: true},
 		Type:    sql.NullString{String: hj.Type, Valid: true},
 		Tags:    &hstore.Hstore{Map: map[string]sql.NullString{}},
 		Vars:    &hstore.Hstore{Map: map[string]sql.NullString{}},
+		State:   strings.ToLower(hj.State),
+	}
+
+	if hj.Addresses != nil {
+		h.Addresses = []*hostAddress{}
+		for _, a := range hj.Addresses {
+			h.Addresses = append(h.Addresses, addressJSONToHostAddress(a))
+		}
 	}
 
 	for key, value := range hj.Tags {
-		h.Tags.Map[strings.ToLower(fmt.Sprintf("%s", key))] = sql.NullString{
-			String: strings.ToLower(fmt.Sprintf("%s", value)),
+		h.Tags.Map[fmt.Sprintf("%s", key)] = sql.NullString{
+			String: fmt.Sprintf("%s", value),
 			Valid:  true,
 		}
 	}
 
 	for key, value := range hj.Vars {
-		h.Vars.Map[strings.ToLower(fmt.Sprintf("%s", key))] = sql.NullString{
-			String: strings.ToLower(fmt.Sprintf("%s", value)),
+		h.Vars.Map[fmt.Sprintf("%s", key)] = sql.NullString{
+			String: fmt.Sprintf("%s", value),
 			Valid:  true,
 		}
 	}
@@ -101,16 +104,25 @@ func hostJSONToHost(hj *HostJSON) *host {
 	return h
 }
 
-func hostToHostJSON(h *host) *HostJSON {
-	hj := &HostJSON{
-		ID:      h.ID,
-		Name:    h.Name,
-		IP:      h.IP.Addr,
-		Package: h.Package.String,
-		Image:   h.Image.String,
-		Type:    h.Type.String,
-		Tags:    map[string]interface{}{},
-		Vars:    map[string]interface{}{},
+func hostToHostJSON(h *host) *api.HostJSON {
+	hj := &api.HostJSON{
+		ID:        h.ID,
+		Name:      h.Name,
+		IP:        h.IP.Addr,
+		Package:   h.Package.String,
+		Image:     h.Image.String,
+		Type:      h.Type.String,
+		Tags:      map[string]interface{}{},
+		Vars:      map[string]interface{}{},
+		Facts:     map[string]interface{}{},
+		State:     h.State,
+		StaleAt:   h.StaleAt,
+		DeletedAt: h.DeletedAt,
+	}
+
+	if !h.StateModified.IsZero() {
+		stateModified := h.StateModified
+		hj.StateModified = &stateModified
 	}
 
 	for key, value := range h.Tags.Map {
@@ -121,27 +133,56 @@ func hostToHostJSON(h *host) *HostJSON {
 		hj.Vars[fmt.Sprintf("%s", key)] = value.String
 	}
 
+	if h.Facts != nil {
+		for key, value := range h.Facts.Map {
+			hj.Facts[fmt.Sprintf("%s", key)] = value.String
+		}
+	}
+
+	for _, a := range h.Addresses {
+		hj.Addresses = append(hj.Addresses, hostAddressToAddressJSON(a))
+	}
+
+	if h.VaultVars != nil && len(h.VaultVars.Map) > 0 {
+		hj.VaultVars = map[string]string{}
+		for key, value := range h.VaultVars.Map {
+			hj.VaultVars[key] = value.String
+		}
+	}
+
 	return hj
 }
 
-func (h *host) CollapsedVars() map[string]string {
+// CollapsedVars merges the host's own fields, tags, and vars, with the
+// hostname, image, package, and type normalized by the vars policy, so
+// that, e.g., a mixed-case AMI ID keeps its case under "preserve"
+func (h *host) CollapsedVars(policy string) map[string]string {
 	varsMap := map[string]string{}
 
 	for key, value := range map[string]string{
-		"hostname": strings.ToLower(h.Name),
-		"image":    strings.ToLower(h.Image.String),
+		"hostname": h.Name,
+		"image":    h.Image.String,
 		"ip":       h.IP.Addr,
 		"modified": h.Modified.Format(time.RFC3339),
-		"package":  strings.ToLower(h.Package.String),
-		"type":     strings.ToLower(h.Type.String),
+		"package":  h.Package.String,
+		"type":     h.Type.String,
 	} {
+		if key != "ip" && key != "modified" {
+			_, value = normalizeKeyValue(policy, key, value)
+		}
 		varsMap[key] = value
 	}
 	for key, value := range h.Tags.Map {
-		varsMap[strings.ToLower(key)] = strings.ToLower(value.String)
+		varsMap[key] = value.String
 	}
 	for key, value := range h.Vars.Map {
-		varsMap[strings.ToLower(key)] = strings.ToLower(value.String)
+		varsMap[key] = value.String
+	}
+
+	if h.Facts != nil {
+		for key, value := range h.Facts.Map {
+			varsMap[factHostvarKey(key)] = value.String
+		}
 	}
 
 	return varsMap
@@ -19,17 +19,20 @@ type hostFilter struct {
 	Team   string
 	Since  time.Time
 	Before time.Time
+	Facts  map[string]string
+
+	LastRunStatus string
+	NotRunSince   time.Time
+	Address       string
+
+	States        []string
+	ExcludeStates []string
 }
 
 func (hf *hostFilter) BuildWhereClause() (string, []interface{}) {
-	whereParts := []string{}
+	whereParts := []string{"deleted_at IS NULL"}
 	binds := []interface{}{}
 
-	// And now, for some dyslexic lisp
-	if ((*hf) == hostFilter{}) {
-		return "", binds
-	}
-
 	if hf.Name != "" {
 		binds = append(binds, fmt.Sprintf("%s%%", hf.Name))
 		whereParts = append(whereParts, fmt.Sprintf("name like $%d", len(binds)))
@@ -61,6 +64,19 @@ func (hf *hostFilter) BuildWhereClause() (string, []interface{}) {
 			fmt.Sprintf("lower(tags::text)::hstore @> $%d", len(binds)))
 	}
 
+	if len(hf.Facts) > 0 {
+		factsMap := map[string]sql.NullString{}
+		for key, value := range hf.Facts {
+			factsMap[strings.ToLower(key)] = sql.NullString{
+				String: strings.ToLower(value),
+				Valid:  true,
+			}
+		}
+		binds = append(binds, hstore.Hstore{Map: factsMap})
+		whereParts = append(whereParts,
+			fmt.Sprintf("lower(facts::text)::hstore @> $%d", len(binds)))
+	}
+
 	if hf.Since != zeroTime {
 		binds = append(binds, hf.Since)
 		whereParts = append(whereParts,
@@ -73,9 +89,59 @@ func (hf *hostFilter) BuildWhereClause() (string, []interface{}) {
 			fmt.Sprintf("modified < $%d", len(binds)))
 	}
 
-	if len(whereParts) > 0 {
-		return " WHERE " + strings.Join(whereParts, " AND "), binds
+	if len(hf.States) > 0 {
+		whereParts = append(whereParts,
+			fmt.Sprintf("state IN (%s)", bindStrings(&binds, hf.States)))
+	}
+
+	if len(hf.ExcludeStates) > 0 {
+		whereParts = append(whereParts,
+			fmt.Sprintf("state NOT IN (%s)", bindStrings(&binds, hf.ExcludeStates)))
+	}
+
+	if hf.Address != "" {
+		if cidr := normalizeCIDR(hf.Address); cidr != "" {
+			binds = append(binds, cidr)
+			whereParts = append(whereParts,
+				fmt.Sprintf(`(ip <<= $%d::inet OR id IN (
+					SELECT host_id FROM host_addresses
+					WHERE address <<= $%d::inet))`, len(binds), len(binds)))
+		} else {
+			binds = append(binds, normalizeIP(hf.Address))
+			whereParts = append(whereParts,
+				fmt.Sprintf(`(host(ip) = $%d OR id IN (
+					SELECT host_id FROM host_addresses
+					WHERE host(address) = $%d))`, len(binds), len(binds)))
+		}
+	}
+
+	if hf.LastRunStatus != "" {
+		binds = append(binds, strings.ToLower(hf.LastRunStatus))
+		whereParts = append(whereParts,
+			fmt.Sprintf(`(SELECT status FROM host_runs
+				WHERE host_runs.host_id = hosts.id
+				ORDER BY finished DESC LIMIT 1) = $%d`, len(binds)))
+	}
+
+	if hf.NotRunSince != zeroTime {
+		binds = append(binds, hf.NotRunSince)
+		whereParts = append(whereParts,
+			fmt.Sprintf(`NOT EXISTS (SELECT 1 FROM host_runs
+				WHERE host_runs.host_id = hosts.id
+				AND finished > $%d)`, len(binds)))
+	}
+
+	return " WHERE " + strings.Join(whereParts, " AND "), binds
+}
+
+// bindStrings appends each lowercased value to binds, returning the
+// comma-separated placeholders
+func bindStrings(binds *[]interface{}, values []string) string {
+	placeholders := []string{}
+	for _, value := range values {
+		*binds = append(*binds, strings.ToLower(value))
+		placeholders = append(placeholders, fmt.Sprintf("$%d", len(*binds)))
 	}
 
-	return "", binds
+	return strings.Join(placeholders, ", ")
 }
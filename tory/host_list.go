@@ -0,0 +1,70 @@
+package tory
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/modcloth/tory/tory/api"
+)
+
+const (
+	defaultHostsPageLimit = 100
+	maxHostsPageLimit     = 1000
+
+	// hostsBatchSize is how many hosts are read, and streamed, at a time
+	hostsBatchSize = 500
+
+	ndjsonContentType = "application/x-ndjson"
+)
+
+var (
+	invalidCursorError = fmt.Errorf("after must be a cursor from a previous page")
+	invalidLimitError  = fmt.Errorf("limit must be a positive integer")
+)
+
+// hostsPage is one page of GET {prefix}/_hosts, where Next is the cursor
+// of the following page, if any
+type hostsPage struct {
+	Hosts []*api.HostJSON `json:"hosts"`
+	Next  string          `json:"next,omitempty"`
+}
+
+func encodeHostsCursor(name string) string {
+	return base64.URLEncoding.EncodeToString([]byte(name))
+}
+
+func decodeHostsCursor(cursor string) (string, error) {
+	if cursor == "" {
+		return "", nil
+	}
+
+	b, err := base64.URLEncoding.DecodeString(cursor)
+	if err != nil || len(b) == 0 {
+		return "", invalidCursorError
+	}
+
+	return string(b), nil
+}
+
+// parseHostsLimit returns the limit query string variable, or zero when
+// not given
+func parseHostsLimit(limit string) (int, error) {
+	if limit == "" {
+		return 0, nil
+	}
+
+	n, err := strconv.Atoi(limit)
+	if err != nil || n < 1 {
+		return 0, invalidLimitError
+	}
+
+	return n, nil
+}
+
+func wantsNDJSON(r *http.Request) bool {
+	return r.FormValue("format") == "ndjson" ||
+		strings.Contains(r.Header.Get("Accept"), ndjsonContentType)
+}
@@ -0,0 +1,61 @@
+package tory
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestHostsCursor(t *testing.T) {
+	cursor := encodeHostsCursor("web1.example.com")
+	name, err := decodeHostsCursor(cursor)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if name != "web1.example.com" {
+		t.Fatalf("expected %q, got %q", "web1.example.com", name)
+	}
+
+	_, err = decodeHostsCursor("%%")
+	if err != invalidCursorError {
+		t.Fatalf("expected %v, got %v", invalidCursorError, err)
+	}
+}
+
+func TestParseHostsLimit(t *testing.T) {
+	for limit, expected := range map[string]int{"": 0, "1": 1, "250": 250} {
+		n, err := parseHostsLimit(limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if n != expected {
+			t.Fatalf("%q: expected %d, got %d", limit, expected, n)
+		}
+	}
+
+	for _, limit := range []string{"0", "-1", "ten"} {
+		_, err := parseHostsLimit(limit)
+		if err != invalidLimitError {
+			t.Fatalf("%q: expected %v, got %v", limit, invalidLimitError, err)
+		}
+	}
+}
+
+func TestWantsNDJSON(t *testing.T) {
+	r, _ := http.NewRequest("GET", "/_hosts?format=ndjson", nil)
+	if !wantsNDJSON(r) {
+		t.Fatalf("expected format=ndjson to stream")
+	}
+
+	r, _ = http.NewRequest("GET", "/_hosts", nil)
+	r.Header.Set("Accept", ndjsonContentType)
+	if !wantsNDJSON(r) {
+		t.Fatalf("expected Accept: %s to stream", ndjsonContentType)
+	}
+
+	r, _ = http.NewRequest("GET", "/_hosts", nil)
+	if wantsNDJSON(r) {
+		t.Fatalf("expected plain JSON by default")
+	}
+}
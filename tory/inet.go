@@ -2,6 +2,7 @@ package tory
 
 import (
 	"database/sql/driver"
+	"net"
 	"strings"
 )
 
@@ -49,3 +50,31 @@ func (i *inet) String() string {
 
 	return strValue
 }
+
+// normalizeIP returns the canonical form of an IPv4 or IPv6 address, so that
+// e.g. "::ffff:10.10.1.47" becomes "10.10.1.47" and "2001:db8:0:0::1"
+// becomes "2001:db8::1".  Anything else, such as a hostname, is returned
+// unchanged.
+func normalizeIP(addr string) string {
+	ip := net.ParseIP(strings.TrimSpace(addr))
+	if ip == nil {
+		return addr
+	}
+
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.String()
+	}
+
+	return ip.String()
+}
+
+// normalizeCIDR returns the canonical form of an IPv4 or IPv6 network, or ""
+// if cidr is not one
+func normalizeCIDR(cidr string) string {
+	_, network, err := net.ParseCIDR(strings.TrimSpace(cidr))
+	if err != nil {
+		return ""
+	}
+
+	return network.String()
+}
@@ -0,0 +1,73 @@
+package tory
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNormalizeIP(t *testing.T) {
+	for addr, expected := range map[string]string{
+		"10.10.1.47":                      "10.10.1.47",
+		" 10.10.1.47 ":                    "10.10.1.47",
+		"::ffff:10.10.1.47":               "10.10.1.47",
+		"2001:DB8:0:0:0:0:0:1":            "2001:db8::1",
+		"2001:0db8:0000:0000::0001":       "2001:db8::1",
+		"fe80::1":                         "fe80::1",
+		"web1.example.com":                "web1.example.com",
+		"2001:db8:85a3::8a2e:370:7334/64": "2001:db8:85a3::8a2e:370:7334/64",
+	} {
+		if actual := normalizeIP(addr); actual != expected {
+			t.Fatalf("%q: expected %q, got %q", addr, expected, actual)
+		}
+	}
+}
+
+func TestNormalizeCIDR(t *testing.T) {
+	for cidr, expected := range map[string]string{
+		"10.10.1.47/24":     "10.10.1.0/24",
+		"2001:DB8::1/32":    "2001:db8::/32",
+		"2001:db8:0:0::/48": "2001:db8::/48",
+		"10.10.1.47":        "",
+		"2001:db8::1":       "",
+		"not-a-network/24":  "",
+	} {
+		if actual := normalizeCIDR(cidr); actual != expected {
+			t.Fatalf("%q: expected %q, got %q", cidr, expected, actual)
+		}
+	}
+}
+
+func TestAddHostnameToIPGroup(t *testing.T) {
+	inv := newInventory()
+	inv.AddHostnameToIPGroup("10.10.1.47", "web1.example.com")
+	inv.AddHostnameToIPGroup("2001:db8::1", "web2.example.com")
+
+	if g := inv.GetGroup("10.10.1.47"); len(g) != 1 || g[0] != "web1.example.com" {
+		t.Fatalf("IPv4 group was not named by ip: %v", g)
+	}
+
+	if g := inv.GetGroup("ip_2001_db8__1"); len(g) != 1 || g[0] != "web2.example.com" {
+		t.Fatalf("IPv6 group was not sanitized: %v", g)
+	}
+}
+
+func TestHostFilterAddress(t *testing.T) {
+	for addr, expected := range map[string]struct {
+		bind string
+		op   string
+	}{
+		"::ffff:10.10.1.47":  {"10.10.1.47", "host(ip) ="},
+		"2001:DB8::0:1":      {"2001:db8::1", "host(ip) ="},
+		"10.10.1.0/24":       {"10.10.1.0/24", "ip <<="},
+		"2001:db8:0:0::1/64": {"2001:db8::/64", "ip <<="},
+	} {
+		where, binds := (&hostFilter{Address: addr}).BuildWhereClause()
+		if len(binds) != 1 || binds[0] != expected.bind {
+			t.Fatalf("%q: unexpected binds %v", addr, binds)
+		}
+
+		if !strings.Contains(where, expected.op) {
+			t.Fatalf("%q: expected %q in %q", addr, expected.op, where)
+		}
+	}
+}
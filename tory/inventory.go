@@ -3,6 +3,7 @@ package tory
 import (
 	"encoding/json"
 	"regexp"
+	"sort"
 	"strings"
 	"sync"
 )
@@ -14,17 +15,36 @@ var (
 type inventory struct {
 	Meta       *meta `json:"_meta"`
 	groups     map[string][]string
+	members    map[string]map[string]bool
+	children   map[string][]string
+	hosts      []string
+	knownHosts map[string]bool
 	groupMutex *sync.Mutex
 }
 
+// inventoryGroup is the ansible JSON form of a group that has children
+type inventoryGroup struct {
+	Hosts    []string `json:"hosts,omitempty"`
+	Children []string `json:"children,omitempty"`
+}
+
 func newInventory() *inventory {
 	return &inventory{
 		Meta:       newMeta(),
 		groups:     map[string][]string{},
+		members:    map[string]map[string]bool{},
+		children:   map[string][]string{},
+		hosts:      []string{},
+		knownHosts: map[string]bool{},
 		groupMutex: &sync.Mutex{},
 	}
 }
 
+func sanitizeGroupName(group string) string {
+	sanitizedGroup := groupNameUnsafe.ReplaceAllString(strings.ToLower(group), "_")
+	return strings.Replace(sanitizedGroup, ".", "_", -1)
+}
+
 func (inv *inventory) GetGroup(group string) []string {
 	inv.groupMutex.Lock()
 	defer inv.groupMutex.Unlock()
@@ -36,29 +56,147 @@ func (inv *inventory) GetGroup(group string) []string {
 	return nil
 }
 
+// GetChildren returns the names of the group's child groups, if any
+func (inv *inventory) GetChildren(group string) []string {
+	inv.groupMutex.Lock()
+	defer inv.groupMutex.Unlock()
+
+	return inv.children[group]
+}
+
+// AddHost records the host as part of the inventory whether or not it ends
+// up in any group, so that it may be listed as "ungrouped"
+func (inv *inventory) AddHost(hostname string) {
+	inv.groupMutex.Lock()
+	defer inv.groupMutex.Unlock()
+
+	inv.addHost(hostname)
+}
+
+func (inv *inventory) addHost(hostname string) {
+	if !inv.knownHosts[hostname] {
+		inv.knownHosts[hostname] = true
+		inv.hosts = append(inv.hosts, hostname)
+	}
+}
+
 func (inv *inventory) AddHostnameToGroup(group, hostname string) {
-	sanitizedGroup := groupNameUnsafe.ReplaceAllString(strings.ToLower(group), "_")
-	sanitizedGroup = strings.Replace(sanitizedGroup, ".", "_", -1)
-	inv.AddHostnameToGroupUnsanitized(sanitizedGroup, hostname)
+	inv.AddHostnameToGroupUnsanitized(sanitizeGroupName(group), hostname)
+}
+
+// AddHostnameToIPGroup adds the host to a group named after its ip.  IPv4
+// addresses are used as-is for backwards compatibility, while IPv6 ones are
+// sanitized into an "ip_*" group, e.g. "ip_2001_db8__1".
+func (inv *inventory) AddHostnameToIPGroup(addr, hostname string) {
+	if addressFamily(addr) == 6 {
+		inv.AddHostnameToGroup("ip_"+normalizeIP(addr), hostname)
+		return
+	}
+
+	inv.AddHostnameToGroupUnsanitized(addr, hostname)
 }
 
 func (inv *inventory) AddHostnameToGroupUnsanitized(group, hostname string) {
 	inv.groupMutex.Lock()
 	defer inv.groupMutex.Unlock()
 
+	inv.addHost(hostname)
+
 	if _, ok := inv.groups[group]; !ok {
 		inv.groups[group] = []string{}
+		inv.members[group] = map[string]bool{}
 	}
+
+	if inv.members[group][hostname] {
+		return
+	}
+
+	inv.members[group][hostname] = true
 	inv.groups[group] = append(inv.groups[group], hostname)
 }
 
+// AddChildToGroup makes child a child group of parent, sanitizing both
+func (inv *inventory) AddChildToGroup(parent, child string) {
+	inv.AddChildToGroupUnsanitized(sanitizeGroupName(parent), sanitizeGroupName(child))
+}
+
+func (inv *inventory) AddChildToGroupUnsanitized(parent, child string) {
+	inv.groupMutex.Lock()
+	defer inv.groupMutex.Unlock()
+
+	for _, existing := range inv.children[parent] {
+		if existing == child {
+			return
+		}
+	}
+
+	inv.children[parent] = append(inv.children[parent], child)
+}
+
+// MarshalJSON writes groups without children as plain lists of hosts, as
+// tory always has, and groups with children in the ansible object form.
+// An "all" group has every top-level group as a child, along with an
+// "ungrouped" group of the hosts that are in no other group.
 func (inv *inventory) MarshalJSON() ([]byte, error) {
+	inv.groupMutex.Lock()
+	defer inv.groupMutex.Unlock()
+
 	serialized := map[string]interface{}{}
 	serialized["_meta"] = inv.Meta
+
+	isChild := map[string]bool{}
+	for _, children := range inv.children {
+		for _, child := range children {
+			isChild[child] = true
+		}
+	}
+
+	grouped := map[string]bool{}
+	topLevel := map[string]bool{}
 	for key, value := range inv.groups {
-		serialized[key] = value
+		for _, hostname := range value {
+			grouped[hostname] = true
+		}
+
+		if !isChild[key] {
+			topLevel[key] = true
+		}
+
+		if _, ok := inv.children[key]; !ok {
+			serialized[key] = value
+		}
+	}
+
+	for key, children := range inv.children {
+		if !isChild[key] {
+			topLevel[key] = true
+		}
+
+		serialized[key] = &inventoryGroup{
+			Hosts:    inv.groups[key],
+			Children: children,
+		}
+	}
+
+	ungrouped := []string{}
+	for _, hostname := range inv.hosts {
+		if !grouped[hostname] {
+			ungrouped = append(ungrouped, hostname)
+		}
 	}
 
+	allChildren := []string{}
+	for key := range topLevel {
+		if key != "all" && key != "ungrouped" {
+			allChildren = append(allChildren, key)
+		}
+	}
+
+	sort.Strings(allChildren)
+
+	serialized["ungrouped"] = ungrouped
+	serialized["all"] = &inventoryGroup{Children: append(allChildren, "ungrouped")}
+
 	return json.Marshal(serialized)
 }
 
@@ -77,14 +215,41 @@ func (inv *inventory) UnmarshalJSON(b []byte) error {
 				return err
 			}
 			inv.Meta = m
-		} else {
-			group := []string{}
-			err := json.Unmarshal(value, &group)
-			if err == nil {
-				for _, hostname := range group {
-					inv.AddHostnameToGroupUnsanitized(key, hostname)
-				}
+			continue
+		}
+
+		if key == "all" {
+			continue
+		}
+
+		group := []string{}
+		err := json.Unmarshal(value, &group)
+		if err == nil && key == "ungrouped" {
+			for _, hostname := range group {
+				inv.AddHost(hostname)
 			}
+			continue
+		}
+
+		if err == nil {
+			for _, hostname := range group {
+				inv.AddHostnameToGroupUnsanitized(key, hostname)
+			}
+			continue
+		}
+
+		ig := &inventoryGroup{}
+		err = json.Unmarshal(value, ig)
+		if err != nil {
+			continue
+		}
+
+		for _, hostname := range ig.Hosts {
+			inv.AddHostnameToGroupUnsanitized(key, hostname)
+		}
+
+		for _, child := range ig.Children {
+			inv.AddChildToGroupUnsanitized(key, child)
 		}
 	}
 
@@ -0,0 +1,233 @@
+package tory
+
+import (
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+var (
+	defaultInventoryURL      = "http://localhost:9462/ansible/hosts"
+	defaultInventoryCacheTTL = 60 * time.Second
+	defaultInventoryTimeout  = 30 * time.Second
+
+	noInventoryActionError = fmt.Errorf("one of --list or --host is required")
+)
+
+// InventoryScriptOptions contains everything needed to act as an ansible
+// dynamic inventory script
+type InventoryScriptOptions struct {
+	List bool
+	Host string
+
+	URL        string
+	AuthToken  string
+	ConfigFile string
+	CacheDir   string
+
+	// CacheTTL is nil to use the config file or default ttl, and zero or
+	// negative to disable caching
+	CacheTTL *time.Duration
+
+	Filter map[string]string
+}
+
+type inventoryScriptConfig struct {
+	URL       string            `json:"url"`
+	AuthToken string            `json:"auth_token"`
+	CacheDir  string            `json:"cache_dir"`
+	CacheTTL  *int              `json:"cache_ttl"`
+	Filter    map[string]string `json:"filter"`
+}
+
+// InventoryScriptMain implements the ansible dynamic inventory script
+// contract, writing either the full inventory (--list) or a single host's
+// vars (--host) to stdout
+func InventoryScriptMain(opts *InventoryScriptOptions) {
+	err := runInventoryScript(opts, os.Stdout)
+	if err != nil {
+		toryLog.Fatal(err.Error())
+	}
+}
+
+func runInventoryScript(opts *InventoryScriptOptions, out io.Writer) error {
+	if !opts.List && opts.Host == "" {
+		return noInventoryActionError
+	}
+
+	err := opts.applyConfig()
+	if err != nil {
+		return err
+	}
+
+	invBytes, err := opts.fetchInventory()
+	if err != nil {
+		return err
+	}
+
+	if opts.List {
+		_, err = out.Write(invBytes)
+		return err
+	}
+
+	inv := newInventory()
+	err = json.Unmarshal(invBytes, inv)
+	if err != nil {
+		return err
+	}
+
+	hostvars, ok := inv.Meta.Hostvars[opts.Host]
+	if !ok {
+		hostvars = map[string]interface{}{}
+	}
+
+	return json.NewEncoder(out).Encode(hostvars)
+}
+
+func (opts *InventoryScriptOptions) applyConfig() error {
+	cfg := &inventoryScriptConfig{}
+
+	if opts.ConfigFile != "" {
+		f, err := os.Open(opts.ConfigFile)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+
+		if err == nil {
+			defer f.Close()
+			err = json.NewDecoder(f).Decode(cfg)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if opts.URL == "" {
+		opts.URL = cfg.URL
+	}
+
+	if opts.URL == "" {
+		opts.URL = defaultInventoryURL
+	}
+
+	if opts.AuthToken == "" {
+		opts.AuthToken = cfg.AuthToken
+	}
+
+	if opts.CacheDir == "" {
+		opts.CacheDir = cfg.CacheDir
+	}
+
+	if opts.CacheDir == "" {
+		opts.CacheDir = filepath.Join(os.TempDir(), "tory-inventory")
+	}
+
+	if opts.CacheTTL == nil && cfg.CacheTTL != nil {
+		ttl := time.Duration(*cfg.CacheTTL) * time.Second
+		opts.CacheTTL = &ttl
+	}
+
+	if opts.CacheTTL == nil {
+		ttl := defaultInventoryCacheTTL
+		opts.CacheTTL = &ttl
+	}
+
+	if opts.Filter == nil {
+		opts.Filter = map[string]string{}
+	}
+
+	for key, value := range cfg.Filter {
+		if opts.Filter[key] == "" {
+			opts.Filter[key] = value
+		}
+	}
+
+	return nil
+}
+
+func (opts *InventoryScriptOptions) inventoryURL() (string, error) {
+	u, err := url.Parse(opts.URL)
+	if err != nil {
+		return "", err
+	}
+
+	q := u.Query()
+	for key, value := range opts.Filter {
+		if value != "" {
+			q.Set(key, value)
+		}
+	}
+
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
+
+// cachePath is keyed by the token as well as the url, since the inventory
+// includes secret vars only for a token allowed to read them
+func (opts *InventoryScriptOptions) cachePath(invURL string) string {
+	return filepath.Join(opts.CacheDir,
+		fmt.Sprintf("inventory-%x.json", sha1.Sum([]byte(invURL+"\n"+opts.AuthToken))))
+}
+
+func (opts *InventoryScriptOptions) fetchInventory() ([]byte, error) {
+	invURL, err := opts.inventoryURL()
+	if err != nil {
+		return nil, err
+	}
+
+	cachePath := opts.cachePath(invURL)
+	if *opts.CacheTTL > 0 {
+		fi, err := os.Stat(cachePath)
+		if err == nil && time.Now().Sub(fi.ModTime()) < *opts.CacheTTL {
+			b, err := ioutil.ReadFile(cachePath)
+			if err == nil {
+				return b, nil
+			}
+		}
+	}
+
+	req, err := http.NewRequest("GET", invURL, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.AuthToken != "" {
+		req.Header.Set("Authorization", fmt.Sprintf("token %s", opts.AuthToken))
+	}
+
+	httpClient := &http.Client{Timeout: defaultInventoryTimeout}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s returned %v: %s", invURL, resp.StatusCode, b)
+	}
+
+	if *opts.CacheTTL > 0 {
+		err = os.MkdirAll(opts.CacheDir, 0700)
+		if err == nil {
+			err = ioutil.WriteFile(cachePath, b, 0600)
+		}
+		if err != nil {
+			toryLog.WithField("err", err).Warn("failed to write inventory cache")
+		}
+	}
+
+	return b, nil
+}
@@ -0,0 +1,54 @@
+package tory
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestInventoryScriptCacheTTL(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tory-inventory-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	configFile := filepath.Join(dir, "config.json")
+	err = ioutil.WriteFile(configFile, []byte(`{"cache_ttl": 0}`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opts := &InventoryScriptOptions{}
+	err = opts.applyConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if *opts.CacheTTL != defaultInventoryCacheTTL {
+		t.Fatalf("expected the default ttl, got %v", *opts.CacheTTL)
+	}
+
+	opts = &InventoryScriptOptions{ConfigFile: configFile}
+	err = opts.applyConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if *opts.CacheTTL != 0 {
+		t.Fatalf("expected a ttl of 0 from the config file, got %v", *opts.CacheTTL)
+	}
+
+	ttl := 5 * time.Second
+	opts = &InventoryScriptOptions{ConfigFile: configFile, CacheTTL: &ttl}
+	err = opts.applyConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if *opts.CacheTTL != ttl {
+		t.Fatalf("expected the given ttl, got %v", *opts.CacheTTL)
+	}
+}
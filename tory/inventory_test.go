@@ -0,0 +1,58 @@
+package tory
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestInventoryMarshalJSON(t *testing.T) {
+	inv := newInventory()
+	inv.AddHostnameToGroup("tag_env_prod", "web1.example.com")
+	inv.AddChildToGroup("tag_env_prod", "prod_fribbles")
+	inv.AddHostnameToGroup("prod_fribbles", "web2.example.com")
+	inv.AddHost("lonely.example.com")
+
+	b, err := json.Marshal(inv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	raw := map[string]interface{}{}
+	err = json.Unmarshal(b, &raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	all, ok := raw["all"].(map[string]interface{})
+	if !ok {
+		t.Fatalf("expected an \"all\" group in %s", b)
+	}
+
+	children, _ := all["children"].([]interface{})
+	if len(children) != 2 || children[0] != "tag_env_prod" || children[1] != "ungrouped" {
+		t.Fatalf("expected all children [tag_env_prod ungrouped], got %v", children)
+	}
+
+	ungrouped, _ := raw["ungrouped"].([]interface{})
+	if len(ungrouped) != 1 || ungrouped[0] != "lonely.example.com" {
+		t.Fatalf("expected ungrouped [lonely.example.com], got %v", ungrouped)
+	}
+
+	if _, ok := raw["prod_fribbles"].([]interface{}); !ok {
+		t.Fatalf("expected childless group as a list of hosts in %s", b)
+	}
+
+	roundTripped := newInventory()
+	err = json.Unmarshal(b, roundTripped)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if children := roundTripped.GetChildren("tag_env_prod"); len(children) != 1 {
+		t.Fatalf("expected children to survive a round trip, got %v", children)
+	}
+
+	if hosts := roundTripped.GetGroup("tag_env_prod"); len(hosts) != 1 {
+		t.Fatalf("expected hosts to survive a round trip, got %v", hosts)
+	}
+}
@@ -23,20 +23,143 @@ var (
 			`CREATE INDEX hosts_tags_idx ON hosts USING GIN (tags)`,
 			`CREATE INDEX hosts_vars_idx ON hosts USING GIN (vars)`,
 		},
+		"2026-10-19T09:00:00": []string{
+			`ALTER TABLE hosts ADD COLUMN facts hstore`,
+			`CREATE INDEX hosts_facts_idx ON hosts USING GIN (facts)`,
+		},
+		"2026-10-19T10:00:00": []string{
+			`CREATE SEQUENCE host_runs_serial`,
+			`CREATE TABLE IF NOT EXISTS host_runs (
+				id integer PRIMARY KEY DEFAULT nextval('host_runs_serial'),
+				host_id integer NOT NULL REFERENCES hosts (id) ON DELETE CASCADE,
+				playbook varchar(255) NOT NULL,
+				started timestamp NOT NULL,
+				finished timestamp NOT NULL,
+				status varchar(32) NOT NULL,
+				ok integer NOT NULL DEFAULT 0,
+				changed integer NOT NULL DEFAULT 0,
+				failed integer NOT NULL DEFAULT 0,
+				unreachable integer NOT NULL DEFAULT 0
+			)`,
+			`CREATE INDEX host_runs_host_id_finished_idx ON host_runs (host_id, finished DESC)`,
+		},
+		"2026-10-19T11:00:00": []string{
+			`ALTER TABLE hosts ADD COLUMN state varchar(32) NOT NULL DEFAULT 'active'`,
+			`ALTER TABLE hosts ADD COLUMN state_modified timestamp NOT NULL DEFAULT current_timestamp`,
+			`CREATE INDEX hosts_state_idx ON hosts (state)`,
+			`CREATE SEQUENCE host_state_transitions_serial`,
+			`CREATE TABLE IF NOT EXISTS host_state_transitions (
+				id integer PRIMARY KEY DEFAULT nextval('host_state_transitions_serial'),
+				host_id integer NOT NULL REFERENCES hosts (id) ON DELETE CASCADE,
+				from_state varchar(32) NOT NULL,
+				to_state varchar(32) NOT NULL,
+				created timestamp NOT NULL DEFAULT current_timestamp
+			)`,
+			`CREATE INDEX host_state_transitions_host_id_idx ON host_state_transitions (host_id)`,
+		},
+		"2026-10-19T12:00:00": []string{
+			`ALTER TABLE hosts ADD COLUMN stale_at timestamp`,
+			`CREATE INDEX hosts_modified_idx ON hosts (modified)`,
+		},
+		"2026-10-19T13:00:00": []string{
+			`ALTER TABLE hosts ADD COLUMN deleted_at timestamp`,
+			`ALTER TABLE hosts DROP CONSTRAINT hosts_name_key`,
+			`CREATE UNIQUE INDEX hosts_name_live_idx ON hosts (name) WHERE deleted_at IS NULL`,
+			`CREATE INDEX hosts_deleted_at_idx ON hosts (deleted_at) WHERE deleted_at IS NOT NULL`,
+		},
+		"2026-10-19T14:00:00": []string{
+			`CREATE SEQUENCE host_addresses_serial`,
+			`CREATE TABLE IF NOT EXISTS host_addresses (
+				id integer PRIMARY KEY DEFAULT nextval('host_addresses_serial'),
+				host_id integer NOT NULL REFERENCES hosts (id) ON DELETE CASCADE,
+				label varchar(64) NOT NULL,
+				address inet NOT NULL,
+				family smallint NOT NULL,
+				is_primary boolean NOT NULL DEFAULT false,
+				UNIQUE (host_id, label)
+			)`,
+			`CREATE INDEX host_addresses_address_idx ON host_addresses (address)`,
+			`INSERT INTO host_addresses (host_id, label, address, family, is_primary)
+				SELECT id, 'ip', ip, family(ip), true FROM hosts`,
+		},
+		"2026-10-19T15:00:00": []string{
+			`CREATE SEQUENCE host_secrets_serial`,
+			`CREATE TABLE IF NOT EXISTS host_secrets (
+				id integer PRIMARY KEY DEFAULT nextval('host_secrets_serial'),
+				host_id integer NOT NULL REFERENCES hosts (id) ON DELETE CASCADE,
+				key varchar(128) NOT NULL,
+				key_id varchar(64) NOT NULL,
+				wrapped_key bytea NOT NULL,
+				ciphertext bytea NOT NULL,
+				modified timestamp NOT NULL DEFAULT current_timestamp
+			)`,
+			`CREATE UNIQUE INDEX host_secrets_host_key_idx ON host_secrets (host_id, lower(key))`,
+		},
+		"2026-10-19T16:00:00": []string{
+			`ALTER TABLE hosts ADD COLUMN vault_vars hstore`,
+		},
+		"2026-10-19T17:00:00": []string{
+			`CREATE SEQUENCE policy_rules_serial`,
+			`CREATE TABLE IF NOT EXISTS policy_rules (
+				id integer PRIMARY KEY DEFAULT nextval('policy_rules_serial'),
+				key varchar(128) NOT NULL,
+				required boolean NOT NULL DEFAULT false,
+				allowed text NOT NULL DEFAULT 'null',
+				exempt_types text NOT NULL DEFAULT 'null'
+			)`,
+			`CREATE UNIQUE INDEX policy_rules_key_idx ON policy_rules (lower(key))`,
+		},
+		"2026-10-19T18:00:00": []string{
+			`CREATE SEQUENCE host_aliases_serial`,
+			`CREATE TABLE IF NOT EXISTS host_aliases (
+				id integer PRIMARY KEY DEFAULT nextval('host_aliases_serial'),
+				host_id integer NOT NULL REFERENCES hosts (id) ON DELETE CASCADE,
+				alias varchar(255) UNIQUE NOT NULL,
+				kind varchar(16) NOT NULL,
+				created timestamp NOT NULL DEFAULT current_timestamp
+			)`,
+			`CREATE INDEX host_aliases_host_id_idx ON host_aliases (host_id)`,
+		},
 	}
 )
 
-func MigrateMain(dbConnStr string) {
-	db, err := newDatabase(dbConnStr)
+// MigrateOptions contains everything needed to migrate the database
+type MigrateOptions struct {
+	DatabaseURL string
+
+	// Renormalize rewrites the tags and vars of existing hosts according to
+	// Normalization, otherwise existing rows are kept as they are
+	Renormalize   bool
+	Normalization NormalizationOptions
+}
+
+func MigrateMain(opts *MigrateOptions) {
+	err := opts.Normalization.Validate()
 	if err != nil {
 		toryLog.Fatal(err.Error())
 	}
 
+	db, err := newDatabase(opts.DatabaseURL)
+	if err != nil {
+		toryLog.Fatal(err.Error())
+	}
+
+	db.Normalization = opts.Normalization
+
 	err = db.Setup(databaseMigrations)
 	if err != nil {
 		toryLog.Fatal(err.Error())
 
 	}
 
+	if opts.Renormalize {
+		err = db.Renormalize()
+		if err != nil {
+			toryLog.Fatal(err.Error())
+		}
+
+		toryLog.Info("renormalized tags and vars")
+	}
+
 	toryLog.Info("ding")
 }
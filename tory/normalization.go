@@ -0,0 +1,111 @@
+package tory
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/lib/pq/hstore"
+)
+
+const (
+	preserveCase  = "preserve"
+	lowercaseKeys = "lowercase-keys"
+	lowercaseAll  = "lowercase-all"
+)
+
+var (
+	invalidNormalizationError = fmt.Errorf("normalization must be one of " +
+		"\"preserve\", \"lowercase-keys\", or \"lowercase-all\"")
+)
+
+// NormalizationOptions sets how the case of tag and var keys and values is
+// normalized when stored, each being one of "preserve", "lowercase-keys",
+// or "lowercase-all".  Empty policies default to "lowercase-all".
+// Filtering and grouping match case-insensitively regardless.
+type NormalizationOptions struct {
+	Tags string
+	Vars string
+}
+
+func (n NormalizationOptions) Validate() error {
+	for _, policy := range []string{n.Tags, n.Vars} {
+		switch policy {
+		case "", preserveCase, lowercaseKeys, lowercaseAll:
+		default:
+			return invalidNormalizationError
+		}
+	}
+
+	return nil
+}
+
+// Policy returns the policy for "tags" or "vars"
+func (n NormalizationOptions) Policy(which string) string {
+	policy := n.Vars
+	if which == "tags" {
+		policy = n.Tags
+	}
+
+	if policy == "" {
+		return lowercaseAll
+	}
+
+	return policy
+}
+
+// Apply normalizes the host's tags and vars in place
+func (n NormalizationOptions) Apply(h *host) {
+	normalizeHstore(n.Policy("tags"), h.Tags)
+	normalizeHstore(n.Policy("vars"), h.Vars)
+}
+
+func normalizeKeyValue(policy, key, value string) (string, string) {
+	switch policy {
+	case lowercaseKeys:
+		return strings.ToLower(key), value
+	case lowercaseAll:
+		return strings.ToLower(key), strings.ToLower(value)
+	}
+
+	return key, value
+}
+
+func normalizeHstore(policy string, hs *hstore.Hstore) {
+	if hs == nil || hs.Map == nil || policy == preserveCase {
+		return
+	}
+
+	normalized := map[string]sql.NullString{}
+	for key, value := range hs.Map {
+		nKey, nValue := normalizeKeyValue(policy, key, value.String)
+		normalized[nKey] = sql.NullString{String: nValue, Valid: value.Valid}
+	}
+
+	hs.Map = normalized
+}
+
+// renormalizeSQL returns an expression rewriting the column's existing keys
+// and values according to the policy, or "" when nothing needs rewriting
+func renormalizeSQL(policy, column string) string {
+	switch policy {
+	case lowercaseKeys:
+		return fmt.Sprintf(`COALESCE((
+			SELECT hstore(array_agg(lower(key)), array_agg(value))
+			FROM each(%s)), ''::hstore)`, column)
+	case lowercaseAll:
+		return fmt.Sprintf(`lower(%s::text)::hstore`, column)
+	}
+
+	return ""
+}
+
+// mergeHstoreSQL returns an expression merging the param into the column,
+// replacing any existing key that differs from a new one only in case
+func mergeHstoreSQL(column, param string) string {
+	return fmt.Sprintf(`delete(%s, ARRAY(
+				SELECT key FROM each(%s)
+				WHERE lower(key) IN (
+					SELECT lower(new_key) FROM unnest(akeys(%s)) AS new_key))) || %s`,
+		column, column, param, param)
+}
@@ -0,0 +1,111 @@
+package tory
+
+import (
+	"database/sql"
+	"strings"
+	"testing"
+
+	"github.com/lib/pq/hstore"
+)
+
+func testNormalizationHost() *host {
+	return &host{
+		Tags: &hstore.Hstore{Map: map[string]sql.NullString{
+			"Team": sql.NullString{String: "Fizz", Valid: true},
+		}},
+		Vars: &hstore.Hstore{Map: map[string]sql.NullString{
+			"Java_Home": sql.NullString{String: "/opt/JDK", Valid: true},
+		}},
+	}
+}
+
+func TestNormalizationApply(t *testing.T) {
+	for _, tc := range []struct {
+		opts   NormalizationOptions
+		tagKey string
+		tagVal string
+		varKey string
+		varVal string
+	}{
+		{NormalizationOptions{}, "team", "fizz", "java_home", "/opt/jdk"},
+		{NormalizationOptions{Tags: preserveCase, Vars: preserveCase}, "Team", "Fizz", "Java_Home", "/opt/JDK"},
+		{NormalizationOptions{Tags: lowercaseAll, Vars: lowercaseKeys}, "team", "fizz", "java_home", "/opt/JDK"},
+	} {
+		h := testNormalizationHost()
+		tc.opts.Apply(h)
+
+		if h.Tags.Map[tc.tagKey].String != tc.tagVal {
+			t.Fatalf("%+v: expected tag %s=%s, got %v", tc.opts, tc.tagKey, tc.tagVal, h.Tags.Map)
+		}
+
+		if h.Vars.Map[tc.varKey].String != tc.varVal {
+			t.Fatalf("%+v: expected var %s=%s, got %v", tc.opts, tc.varKey, tc.varVal, h.Vars.Map)
+		}
+	}
+}
+
+func TestCollapsedVarsNormalization(t *testing.T) {
+	h := testNormalizationHost()
+	h.Name = "Web1.Example.com"
+	h.IP = &inet{Addr: "10.10.1.7"}
+	h.Image = sql.NullString{String: "ami-0AbC123", Valid: true}
+	h.Package = sql.NullString{String: "Fancy-Town-80", Valid: true}
+	h.Type = sql.NullString{String: "VirtualMachine", Valid: true}
+
+	for policy, image := range map[string]string{
+		lowercaseAll:  "ami-0abc123",
+		lowercaseKeys: "ami-0AbC123",
+		preserveCase:  "ami-0AbC123",
+	} {
+		vars := h.CollapsedVars(policy)
+		if vars["image"] != image {
+			t.Fatalf("%s: expected image %q, got %q", policy, image, vars["image"])
+		}
+
+		if (vars["hostname"] == h.Name) != (policy != lowercaseAll) {
+			t.Fatalf("%s: unexpected hostname %q", policy, vars["hostname"])
+		}
+	}
+}
+
+func TestNormalizationValidate(t *testing.T) {
+	for _, policy := range []string{"", preserveCase, lowercaseKeys, lowercaseAll} {
+		err := NormalizationOptions{Tags: policy, Vars: policy}.Validate()
+		if err != nil {
+			t.Fatalf("%q: %v", policy, err)
+		}
+	}
+
+	err := NormalizationOptions{Vars: "uppercase"}.Validate()
+	if err != invalidNormalizationError {
+		t.Fatalf("expected %v, got %v", invalidNormalizationError, err)
+	}
+}
+
+func TestRenormalizeSQL(t *testing.T) {
+	if renormalizeSQL(preserveCase, "tags") != "" {
+		t.Fatalf("expected no rewrite when preserving case")
+	}
+
+	if renormalizeSQL(lowercaseAll, "vars") != "lower(vars::text)::hstore" {
+		t.Fatalf("unexpected lowercase-all rewrite")
+	}
+}
+
+func TestMergeHstoreSQL(t *testing.T) {
+	expr := mergeHstoreSQL("tags", ":tags")
+	if !strings.HasPrefix(expr, "delete(tags, ARRAY(") || !strings.HasSuffix(expr, ")) || :tags") {
+		t.Fatalf("unexpected merge expression %q", expr)
+	}
+
+	if !strings.Contains(expr, "akeys(:tags)") {
+		t.Fatalf("merge expression does not match new keys: %q", expr)
+	}
+}
+
+func TestReapRuleMatchesTagsCaseInsensitively(t *testing.T) {
+	rule := &ReapRule{Tags: map[string]string{"team": "fizz"}}
+	if !rule.Matches(testNormalizationHost()) {
+		t.Fatalf("expected rule to match mixed-case tag")
+	}
+}
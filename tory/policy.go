@@ -0,0 +1,267 @@
+package tory
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/lib/pq/hstore"
+)
+
+const (
+	// policyModeAudit only reports violations through /policy/violations
+	policyModeAudit = "audit"
+
+	// policyModeEnforce also rejects host and tag writes that violate the
+	// policy
+	policyModeEnforce = "enforce"
+)
+
+var (
+	invalidPolicyModeError = fmt.Errorf("policy mode must be %q or %q",
+		policyModeAudit, policyModeEnforce)
+	policyFromFileError = fmt.Errorf("policy rules are read from a file " +
+		"and may not be changed through the API")
+)
+
+// TagPolicy is the set of rules every host's tags are checked against
+type TagPolicy struct {
+	Rules []*PolicyRule `json:"rules"`
+}
+
+// PolicyRule applies to the tag Key, matched ignoring case, on every host
+// whose type is not in ExemptTypes.  A Required tag must have a non-empty
+// value, and when Allowed is not empty any value must be one of them,
+// also ignoring case.
+type PolicyRule struct {
+	Key         string   `json:"key"`
+	Required    bool     `json:"required"`
+	Allowed     []string `json:"allowed,omitempty"`
+	ExemptTypes []string `json:"exempt_types,omitempty"`
+}
+
+// policyRuleRow is how a rule is stored, with the lists as JSON arrays
+type policyRuleRow struct {
+	Key         string `db:"key"`
+	Required    bool   `db:"required"`
+	Allowed     string `db:"allowed"`
+	ExemptTypes string `db:"exempt_types"`
+}
+
+type policyViolation struct {
+	Name   string           `json:"name"`
+	Type   string           `json:"type,omitempty"`
+	Errors validationErrors `json:"errors"`
+}
+
+// readTagPolicy reads the policy file, returning nil when there is none so
+// that rules are read from the database instead
+func readTagPolicy(filename string) (*TagPolicy, error) {
+	if filename == "" {
+		return nil, nil
+	}
+
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	p := &TagPolicy{}
+	err = json.NewDecoder(f).Decode(p)
+	if err != nil {
+		return nil, err
+	}
+
+	if errs := p.Validate(); errs != nil {
+		return nil, errs
+	}
+
+	return p, nil
+}
+
+func isValidPolicyMode(mode string) bool {
+	return mode == policyModeAudit || mode == policyModeEnforce
+}
+
+// Validate checks that every rule names a usable tag key once and does
+// something
+func (p *TagPolicy) Validate() validationErrors {
+	errs := validationErrors{}
+	seen := map[string]bool{}
+
+	for i, rule := range p.Rules {
+		field := fmt.Sprintf("rules[%d]", i)
+		if msg := keyProblem(rule.Key); msg != "" {
+			errs.Add(field, msg)
+		}
+
+		lowerKey := strings.ToLower(rule.Key)
+		if seen[lowerKey] {
+			errs.Add(field, "key %q has more than one rule", rule.Key)
+		}
+		seen[lowerKey] = true
+
+		if !rule.Required && len(rule.Allowed) == 0 {
+			errs.Add(field, "must be required or allow some values")
+		}
+	}
+
+	if len(errs) == 0 {
+		return nil
+	}
+
+	return errs
+}
+
+// Check returns nil or an error per tag of the host violating the policy
+func (p *TagPolicy) Check(h *host) validationErrors {
+	tags := map[string]string{}
+	if h.Tags != nil {
+		for key, value := range h.Tags.Map {
+			tags[strings.ToLower(key)] = value.String
+		}
+	}
+
+	errs := validationErrors{}
+	for _, rule := range p.Rules {
+		if rule.Exempts(h.Type.String) {
+			continue
+		}
+
+		if msg := rule.Problem(tags[strings.ToLower(rule.Key)]); msg != "" {
+			errs.Add("tags."+rule.Key, msg)
+		}
+	}
+
+	if len(errs) == 0 {
+		return nil
+	}
+
+	return errs
+}
+
+// CheckTag returns nil or the errors of setting a single tag on a host of
+// the given type, where an empty value is a deleted tag.  Only the rules
+// for the tag itself apply, so that a host violating the policy may be
+// fixed a tag at a time.
+func (p *TagPolicy) CheckTag(hostType, key, value string) validationErrors {
+	errs := validationErrors{}
+	for _, rule := range p.Rules {
+		if !strings.EqualFold(rule.Key, key) || rule.Exempts(hostType) {
+			continue
+		}
+
+		if msg := rule.Problem(value); msg != "" {
+			errs.Add("tags."+key, msg)
+		}
+	}
+
+	if len(errs) == 0 {
+		return nil
+	}
+
+	return errs
+}
+
+// mergedForPolicy returns the host as an update of cur would store it,
+// with its tags overlaid on the current ones, replacing any that differ
+// only in case, and with the current type when it has none
+func mergedForPolicy(cur, h *host) *host {
+	merged := newHost()
+	merged.Name = cur.Name
+	merged.Type = h.Type
+	if merged.Type.String == "" {
+		merged.Type = cur.Type
+	}
+
+	merged.Tags = &hstore.Hstore{Map: map[string]sql.NullString{}}
+	if cur.Tags != nil {
+		for key, value := range cur.Tags.Map {
+			merged.Tags.Map[key] = value
+		}
+	}
+
+	if h.Tags != nil {
+		for key, value := range h.Tags.Map {
+			for curKey := range merged.Tags.Map {
+				if strings.EqualFold(curKey, key) {
+					delete(merged.Tags.Map, curKey)
+				}
+			}
+			merged.Tags.Map[key] = value
+		}
+	}
+
+	return merged
+}
+
+func (rule *PolicyRule) Exempts(hostType string) bool {
+	for _, exempt := range rule.ExemptTypes {
+		if strings.EqualFold(exempt, hostType) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Problem describes why the tag value violates the rule, or returns ""
+func (rule *PolicyRule) Problem(value string) string {
+	if value == "" {
+		if rule.Required {
+			return "is required by policy"
+		}
+		return ""
+	}
+
+	if len(rule.Allowed) == 0 {
+		return ""
+	}
+
+	for _, allowed := range rule.Allowed {
+		if strings.EqualFold(allowed, value) {
+			return ""
+		}
+	}
+
+	return fmt.Sprintf("must be one of %s by policy", strings.Join(rule.Allowed, ", "))
+}
+
+func policyRuleToRow(rule *PolicyRule) (*policyRuleRow, error) {
+	allowed, err := json.Marshal(rule.Allowed)
+	if err != nil {
+		return nil, err
+	}
+
+	exemptTypes, err := json.Marshal(rule.ExemptTypes)
+	if err != nil {
+		return nil, err
+	}
+
+	return &policyRuleRow{
+		Key:         rule.Key,
+		Required:    rule.Required,
+		Allowed:     string(allowed),
+		ExemptTypes: string(exemptTypes),
+	}, nil
+}
+
+func policyRuleFromRow(row *policyRuleRow) (*PolicyRule, error) {
+	rule := &PolicyRule{Key: row.Key, Required: row.Required}
+
+	err := json.Unmarshal([]byte(row.Allowed), &rule.Allowed)
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal([]byte(row.ExemptTypes), &rule.ExemptTypes)
+	if err != nil {
+		return nil, err
+	}
+
+	return rule, nil
+}
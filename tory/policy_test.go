@@ -0,0 +1,177 @@
+package tory
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+var testTagPolicy = &TagPolicy{
+	Rules: []*PolicyRule{
+		&PolicyRule{Key: "team", Required: true},
+		&PolicyRule{Key: "env", Required: true, Allowed: []string{"prod", "staging", "dev"}},
+		&PolicyRule{Key: "role", Required: true, ExemptTypes: []string{"appliance"}},
+		&PolicyRule{Key: "tier", Allowed: []string{"web", "db"}},
+	},
+}
+
+func TestTagPolicyValidate(t *testing.T) {
+	if errs := testTagPolicy.Validate(); errs != nil {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+
+	p := &TagPolicy{
+		Rules: []*PolicyRule{
+			&PolicyRule{Key: "env", Required: true},
+			&PolicyRule{Key: "ENV", Required: true},
+			&PolicyRule{Key: "owner"},
+			&PolicyRule{Key: "not-a-key", Required: true},
+		},
+	}
+
+	errs := p.Validate()
+	if len(errs) != 3 {
+		t.Fatalf("expected 3 errors, got %v", errs)
+	}
+
+	for i, field := range []string{"rules[1]", "rules[2]", "rules[3]"} {
+		if errs[i].Field != field {
+			t.Fatalf("expected error %d on %s, got %v", i, field, errs[i])
+		}
+	}
+}
+
+func TestTagPolicyCheck(t *testing.T) {
+	h := newTestReapHost("web1.example.com", "virtualmachine", map[string]string{
+		"Team": "fribbles",
+		"env":  "PROD",
+		"role": "job",
+	}, 0)
+	if errs := testTagPolicy.Check(h); errs != nil {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+
+	h = newTestReapHost("web1.example.com", "virtualmachine", map[string]string{
+		"env":  "qa",
+		"role": "",
+		"tier": "cache",
+	}, 0)
+	errs := testTagPolicy.Check(h)
+	fields := map[string]bool{}
+	for _, err := range errs {
+		fields[err.Field] = true
+	}
+
+	for _, field := range []string{"tags.team", "tags.env", "tags.role", "tags.tier"} {
+		if !fields[field] {
+			t.Fatalf("expected an error for %s, got %v", field, errs)
+		}
+	}
+
+	h = newTestReapHost("web1.example.com", "Appliance", map[string]string{"team": "fribbles", "env": "dev"}, 0)
+	if errs := testTagPolicy.Check(h); errs != nil {
+		t.Fatalf("expected role to be exempt, got %v", errs)
+	}
+}
+
+func TestTagPolicyCheckMerged(t *testing.T) {
+	cur := newTestReapHost("web1.example.com", "virtualmachine", map[string]string{
+		"Team": "fribbles",
+		"env":  "prod",
+		"role": "job",
+	}, 0)
+
+	h := newTestReapHost("web1.example.com", "", map[string]string{"ENV": "staging"}, 0)
+	if errs := testTagPolicy.Check(h); errs == nil {
+		t.Fatalf("expected the partial host alone to violate the policy")
+	}
+
+	merged := mergedForPolicy(cur, h)
+	if errs := testTagPolicy.Check(merged); errs != nil {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+
+	if merged.Type.String != "virtualmachine" {
+		t.Fatalf("expected the current type, got %q", merged.Type.String)
+	}
+
+	if _, ok := merged.Tags.Map["env"]; ok {
+		t.Fatalf("expected env to be replaced by ENV: %v", merged.Tags.Map)
+	}
+
+	h = newTestReapHost("web1.example.com", "", map[string]string{"env": "qa"}, 0)
+	if errs := testTagPolicy.Check(mergedForPolicy(cur, h)); len(errs) != 1 {
+		t.Fatalf("expected an error for env=qa, got %v", errs)
+	}
+}
+
+func TestTagPolicyCheckTag(t *testing.T) {
+	if errs := testTagPolicy.CheckTag("virtualmachine", "ENV", "staging"); errs != nil {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+
+	if errs := testTagPolicy.CheckTag("virtualmachine", "env", "qa"); len(errs) != 1 {
+		t.Fatalf("expected an error for env=qa, got %v", errs)
+	}
+
+	if errs := testTagPolicy.CheckTag("virtualmachine", "team", ""); len(errs) != 1 {
+		t.Fatalf("expected an error for deleting team, got %v", errs)
+	}
+
+	if errs := testTagPolicy.CheckTag("appliance", "role", ""); errs != nil {
+		t.Fatalf("expected role to be exempt, got %v", errs)
+	}
+
+	if errs := testTagPolicy.CheckTag("virtualmachine", "owner", ""); errs != nil {
+		t.Fatalf("expected no rule for owner, got %v", errs)
+	}
+}
+
+func TestPolicyRuleRow(t *testing.T) {
+	for _, rule := range testTagPolicy.Rules {
+		row, err := policyRuleToRow(rule)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		out, err := policyRuleFromRow(row)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if out.Key != rule.Key || out.Required != rule.Required ||
+			len(out.Allowed) != len(rule.Allowed) ||
+			len(out.ExemptTypes) != len(rule.ExemptTypes) {
+			t.Fatalf("expected %#v, got %#v", rule, out)
+		}
+	}
+}
+
+func TestReadTagPolicy(t *testing.T) {
+	p, err := readTagPolicy("")
+	if err != nil || p != nil {
+		t.Fatalf("expected no policy without a file, got %v, %v", p, err)
+	}
+
+	f, err := ioutil.TempFile("", "tory-policy")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.Remove(f.Name())
+
+	_, err = f.WriteString(`{"rules": [{"key": "env", "allowed": ["prod", "dev"]}]}`)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p, err = readTagPolicy(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(p.Rules) != 1 || p.Rules[0].Key != "env" || len(p.Rules[0].Allowed) != 2 {
+		t.Fatalf("unexpected policy: %#v", p)
+	}
+}
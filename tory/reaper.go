@@ -0,0 +1,217 @@
+package tory
+
+import (
+	"database/sql"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+var (
+	// reaperLockID is the postgres advisory lock key held while reaping so
+	// that only one tory replica reaps at a time
+	reaperLockID int64 = 0x746f7279
+
+	// DefaultReapPolicy marks every host unmodified for 30 days as stale,
+	// never deletes, and purges hosts deleted more than 30 days ago
+	DefaultReapPolicy = &ReapPolicy{
+		Rules:              []*ReapRule{&ReapRule{StaleDays: 30}},
+		TrashRetentionDays: 30,
+	}
+
+	reaperStats = expvar.NewMap("reaper")
+
+	reaperLockedError = fmt.Errorf("another reaper holds the lock")
+)
+
+// PruneOptions contains everything needed to reap stale hosts once
+type PruneOptions struct {
+	DatabaseURL string
+	PolicyFile  string
+	DryRun      bool
+}
+
+// ReapPolicy is an ordered list of rules, where the first rule matching a
+// host decides when it is marked stale and deleted.  Deleted hosts are
+// purged for good after TrashRetentionDays, or kept forever when zero.
+type ReapPolicy struct {
+	Rules              []*ReapRule `json:"rules"`
+	TrashRetentionDays int         `json:"trash_retention_days"`
+}
+
+// ReapRule applies to hosts of the given type with all of the given tags,
+// or to every host when both are empty.  A host unmodified for StaleDays is
+// marked stale, and one unmodified for DeleteDays is deleted.  Zero days
+// disables either action.
+type ReapRule struct {
+	Type       string            `json:"type"`
+	Tags       map[string]string `json:"tags"`
+	StaleDays  int               `json:"stale_days"`
+	DeleteDays int               `json:"delete_days"`
+}
+
+type reapResult struct {
+	Stale   []string `json:"stale"`
+	Deleted []string `json:"deleted"`
+	Purged  []string `json:"purged"`
+}
+
+type reaper struct {
+	db     *database
+	policy *ReapPolicy
+	log    *logrus.Logger
+}
+
+// PruneMain reaps stale hosts once according to the policy file, or the
+// default policy when none is given
+func PruneMain(opts *PruneOptions) {
+	policy, err := readReapPolicy(opts.PolicyFile)
+	if err != nil {
+		toryLog.Fatal(err.Error())
+	}
+
+	db, err := newDatabase(opts.DatabaseURL)
+	if err != nil {
+		toryLog.Fatal(err.Error())
+	}
+
+	res, err := db.ReapHosts(policy, time.Now().UTC(), opts.DryRun)
+	if err != nil {
+		toryLog.Fatal(err.Error())
+	}
+
+	toryLog.WithFields(logrus.Fields{
+		"stale":   res.Stale,
+		"deleted": res.Deleted,
+		"purged":  res.Purged,
+		"dry_run": opts.DryRun,
+	}).Info("reaped hosts")
+}
+
+func readReapPolicy(filename string) (*ReapPolicy, error) {
+	if filename == "" {
+		return DefaultReapPolicy, nil
+	}
+
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	policy := &ReapPolicy{}
+	err = json.NewDecoder(f).Decode(policy)
+	if err != nil {
+		return nil, err
+	}
+
+	return policy, nil
+}
+
+// Match returns the first rule that applies to the host, if any
+func (p *ReapPolicy) Match(h *host) *ReapRule {
+	for _, rule := range p.Rules {
+		if rule.Matches(h) {
+			return rule
+		}
+	}
+
+	return nil
+}
+
+func (rule *ReapRule) Matches(h *host) bool {
+	if rule.Type != "" && !strings.EqualFold(rule.Type, h.Type.String) {
+		return false
+	}
+
+	for key, value := range rule.Tags {
+		if h.Tags == nil || !hasTagFold(h.Tags.Map, key, value) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// hasTagFold reports whether the tag is present, ignoring case
+func hasTagFold(tags map[string]sql.NullString, key, value string) bool {
+	for tagKey, tagValue := range tags {
+		if strings.EqualFold(tagKey, key) && strings.EqualFold(tagValue.String, value) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Plan returns the hosts to newly mark as stale and the hosts to delete
+func (p *ReapPolicy) Plan(hosts []*host, now time.Time) ([]*host, []*host) {
+	stale, del := []*host{}, []*host{}
+	for _, h := range hosts {
+		rule := p.Match(h)
+		if rule == nil {
+			continue
+		}
+
+		age := now.Sub(h.Modified)
+		if rule.DeleteDays > 0 && age > days(rule.DeleteDays) {
+			del = append(del, h)
+			continue
+		}
+
+		if rule.StaleDays > 0 && age > days(rule.StaleDays) && h.StaleAt == nil {
+			stale = append(stale, h)
+		}
+	}
+
+	return stale, del
+}
+
+func days(n int) time.Duration {
+	return time.Duration(n) * 24 * time.Hour
+}
+
+func newReaper(db *database, policy *ReapPolicy, log *logrus.Logger) *reaper {
+	return &reaper{db: db, policy: policy, log: log}
+}
+
+// Run reaps every interval, forever
+func (r *reaper) Run(interval time.Duration) {
+	for {
+		r.ReapOnce()
+		time.Sleep(interval)
+	}
+}
+
+func (r *reaper) ReapOnce() {
+	reaperStats.Add("runs", 1)
+
+	res, err := r.db.ReapHosts(r.policy, time.Now().UTC(), false)
+	if err == reaperLockedError {
+		reaperStats.Add("skipped", 1)
+		r.log.Debug("skipping reap while another reaper holds the lock")
+		return
+	}
+
+	if err != nil {
+		reaperStats.Add("errors", 1)
+		r.log.WithField("err", err).Error("failed to reap hosts")
+		return
+	}
+
+	reaperStats.Add("stale", int64(len(res.Stale)))
+	reaperStats.Add("deleted", int64(len(res.Deleted)))
+	reaperStats.Add("purged", int64(len(res.Purged)))
+
+	r.log.WithFields(logrus.Fields{
+		"stale":   res.Stale,
+		"deleted": res.Deleted,
+		"purged":  res.Purged,
+	}).Info("reaped hosts")
+}
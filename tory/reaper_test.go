@@ -0,0 +1,86 @@
+package tory
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/lib/pq/hstore"
+)
+
+func newTestReapHost(name, hostType string, tags map[string]string, age time.Duration) *host {
+	h := newHost()
+	h.Name = name
+	h.Type = sql.NullString{String: hostType, Valid: true}
+	h.Tags = &hstore.Hstore{Map: map[string]sql.NullString{}}
+	for key, value := range tags {
+		h.Tags.Map[key] = sql.NullString{String: value, Valid: true}
+	}
+	h.Modified = time.Now().UTC().Add(-age)
+	return h
+}
+
+func TestReapPolicyPlan(t *testing.T) {
+	policy := &ReapPolicy{
+		Rules: []*ReapRule{
+			&ReapRule{Type: "virtualmachine", StaleDays: 1, DeleteDays: 3},
+			&ReapRule{Tags: map[string]string{"env": "prod"}},
+			&ReapRule{StaleDays: 30, DeleteDays: 90},
+		},
+	}
+
+	alreadyStale := newTestReapHost("stale.example.com", "smartmachine", nil, 40*24*time.Hour)
+	alreadyStale.StaleAt = &alreadyStale.Modified
+
+	stale, del := policy.Plan([]*host{
+		newTestReapHost("vm-fresh.example.com", "virtualmachine", nil, time.Hour),
+		newTestReapHost("vm-stale.example.com", "VirtualMachine", nil, 2*24*time.Hour),
+		newTestReapHost("vm-gone.example.com", "virtualmachine", nil, 4*24*time.Hour),
+		newTestReapHost("prod.example.com", "smartmachine", map[string]string{"env": "prod"}, 400*24*time.Hour),
+		newTestReapHost("old.example.com", "smartmachine", nil, 100*24*time.Hour),
+		alreadyStale,
+	}, time.Now().UTC())
+
+	if len(stale) != 1 || stale[0].Name != "vm-stale.example.com" {
+		t.Fatalf("unexpected stale hosts: %v", reapHostNames(stale))
+	}
+
+	if len(del) != 2 || del[0].Name != "vm-gone.example.com" || del[1].Name != "old.example.com" {
+		t.Fatalf("unexpected deleted hosts: %v", reapHostNames(del))
+	}
+}
+
+func TestReapHostsDryRun(t *testing.T) {
+	h := mustCreateHost(t)
+
+	res, err := testServer.db.ReapHosts(&ReapPolicy{
+		Rules: []*ReapRule{&ReapRule{StaleDays: 1, DeleteDays: 2}},
+	}, time.Now().UTC().Add(72*time.Hour), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	found := false
+	for _, name := range res.Deleted {
+		if name == h.Name {
+			found = true
+		}
+	}
+
+	if !found {
+		t.Fatalf("host was not reaped: %#v", res)
+	}
+
+	_, err = testServer.db.ReadHost(h.Name)
+	if err != nil {
+		t.Fatalf("dry run deleted host: %v", err)
+	}
+}
+
+func reapHostNames(hosts []*host) []string {
+	names := []string{}
+	for _, h := range hosts {
+		names = append(names, h.Name)
+	}
+	return names
+}
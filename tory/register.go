@@ -0,0 +1,314 @@
+package tory
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/modcloth/tory/tory/api"
+)
+
+var (
+	noPrimaryIPError = fmt.Errorf("could not determine primary ip")
+)
+
+// HostPutter is anything that can create or update a host on a tory server,
+// such as *client.Client
+type HostPutter interface {
+	PutHost(*api.HostJSON) (*api.HostJSON, error)
+}
+
+// RegisterOptions contains everything needed to register the local host
+type RegisterOptions struct {
+	ConfigFile string
+	Interval   time.Duration
+	Jitter     time.Duration
+	Client     HostPutter
+}
+
+type registerConfig struct {
+	Name    string                 `json:"name"`
+	IP      string                 `json:"ip"`
+	Package string                 `json:"package"`
+	Image   string                 `json:"image"`
+	Type    string                 `json:"type"`
+	Tags    map[string]interface{} `json:"tags"`
+	Vars    map[string]interface{} `json:"vars"`
+}
+
+// localFacts gathers facts from files rooted at root, which is "/" outside
+// of tests
+type localFacts struct {
+	root string
+}
+
+// RegisterMain gathers local facts, merges them with the config file, and
+// PUTs the result to the tory server, either once or every opts.Interval
+func RegisterMain(opts *RegisterOptions) {
+	lf := &localFacts{root: "/"}
+
+	if opts.Interval <= 0 {
+		_, err := registerOnce(opts, lf)
+		if err != nil {
+			toryLog.Fatal(err.Error())
+		}
+		return
+	}
+
+	rand.Seed(time.Now().UTC().UnixNano())
+
+	for {
+		hj, err := registerOnce(opts, lf)
+		if err != nil {
+			toryLog.WithField("err", err).Error("failed to register host")
+		} else {
+			toryLog.WithField("host", hj.Name).Info("registered host")
+		}
+
+		sleep := opts.Interval
+		if opts.Jitter > 0 {
+			sleep += time.Duration(rand.Int63n(int64(opts.Jitter)))
+		}
+		time.Sleep(sleep)
+	}
+}
+
+func registerOnce(opts *RegisterOptions, lf *localFacts) (*api.HostJSON, error) {
+	hj, err := lf.HostJSON()
+	if err != nil {
+		return nil, err
+	}
+
+	cfg, err := readRegisterConfig(opts.ConfigFile)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg.mergeInto(hj)
+
+	if hj.IP == "" {
+		return nil, noPrimaryIPError
+	}
+
+	toryLog.WithFields(logrus.Fields{
+		"host": hj.Name,
+		"ip":   hj.IP,
+	}).Debug("registering host")
+
+	return opts.Client.PutHost(hj)
+}
+
+func readRegisterConfig(filename string) (*registerConfig, error) {
+	cfg := &registerConfig{}
+	if filename == "" {
+		return cfg, nil
+	}
+
+	f, err := os.Open(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return cfg, nil
+		}
+		return nil, err
+	}
+
+	defer f.Close()
+
+	err = json.NewDecoder(f).Decode(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+func (cfg *registerConfig) mergeInto(hj *api.HostJSON) {
+	if cfg.Name != "" {
+		hj.Name = cfg.Name
+	}
+
+	if cfg.IP != "" {
+		hj.IP = cfg.IP
+	}
+
+	if cfg.Package != "" {
+		hj.Package = cfg.Package
+	}
+
+	if cfg.Image != "" {
+		hj.Image = cfg.Image
+	}
+
+	if cfg.Type != "" {
+		hj.Type = cfg.Type
+	}
+
+	for key, value := range cfg.Tags {
+		hj.Tags[key] = value
+	}
+
+	for key, value := range cfg.Vars {
+		hj.Vars[key] = value
+	}
+}
+
+// HostJSON builds a host from the local facts, leaving out anything that
+// could not be determined
+func (lf *localFacts) HostJSON() (*api.HostJSON, error) {
+	hj := api.NewHostJSON()
+
+	name, err := os.Hostname()
+	if err != nil {
+		return nil, err
+	}
+	hj.Name = name
+
+	ip, err := lf.PrimaryIP()
+	if err == nil {
+		hj.IP = ip
+	}
+
+	hj.Image = lf.Image()
+
+	if memory := lf.MemoryMB(); memory > 0 {
+		hj.Vars["memory"] = strconv.Itoa(memory)
+	}
+
+	if cpus := lf.CPUCount(); cpus > 0 {
+		hj.Vars["cpus"] = strconv.Itoa(cpus)
+	}
+
+	if kernel := lf.Kernel(); kernel != "" {
+		hj.Vars["kernel"] = kernel
+	}
+
+	return hj, nil
+}
+
+// PrimaryIP is the first IPv4 address of the first interface that is up and
+// not a loopback
+func (lf *localFacts) PrimaryIP() (string, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return "", err
+	}
+
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+
+		for _, addr := range addrs {
+			ipNet, ok := addr.(*net.IPNet)
+			if !ok {
+				continue
+			}
+
+			if ip4 := ipNet.IP.To4(); ip4 != nil && !ip4.IsLoopback() {
+				return ip4.String(), nil
+			}
+		}
+	}
+
+	return "", noPrimaryIPError
+}
+
+// Image is "{ID}-{VERSION_ID}" from os-release, e.g. "ubuntu-14.04"
+func (lf *localFacts) Image() string {
+	f, err := os.Open(filepath.Join(lf.root, "etc", "os-release"))
+	if err != nil {
+		return ""
+	}
+
+	defer f.Close()
+
+	osRelease := map[string]string{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		parts := strings.SplitN(strings.TrimSpace(scanner.Text()), "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		osRelease[parts[0]] = strings.Trim(parts[1], `"'`)
+	}
+
+	if osRelease["ID"] == "" {
+		return ""
+	}
+
+	if osRelease["VERSION_ID"] == "" {
+		return osRelease["ID"]
+	}
+
+	return osRelease["ID"] + "-" + osRelease["VERSION_ID"]
+}
+
+// MemoryMB is MemTotal from /proc/meminfo in megabytes
+func (lf *localFacts) MemoryMB() int {
+	f, err := os.Open(filepath.Join(lf.root, "proc", "meminfo"))
+	if err != nil {
+		return 0
+	}
+
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || fields[0] != "MemTotal:" {
+			continue
+		}
+
+		kb, err := strconv.Atoi(fields[1])
+		if err != nil {
+			return 0
+		}
+		return kb / 1024
+	}
+
+	return 0
+}
+
+// CPUCount is the number of processors listed in /proc/cpuinfo
+func (lf *localFacts) CPUCount() int {
+	f, err := os.Open(filepath.Join(lf.root, "proc", "cpuinfo"))
+	if err != nil {
+		return 0
+	}
+
+	defer f.Close()
+
+	count := 0
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if strings.HasPrefix(scanner.Text(), "processor") {
+			count++
+		}
+	}
+
+	return count
+}
+
+// Kernel is the kernel release from /proc/sys/kernel/osrelease
+func (lf *localFacts) Kernel() string {
+	b, err := ioutil.ReadFile(filepath.Join(lf.root, "proc", "sys", "kernel", "osrelease"))
+	if err != nil {
+		return ""
+	}
+
+	return strings.TrimSpace(string(b))
+}
@@ -0,0 +1,94 @@
+package tory
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/modcloth/tory/tory/api"
+)
+
+type fakePutter struct {
+	put *api.HostJSON
+}
+
+func (fp *fakePutter) PutHost(hj *api.HostJSON) (*api.HostJSON, error) {
+	fp.put = hj
+	return hj, nil
+}
+
+func mustWriteFile(t *testing.T, filename, content string) {
+	err := os.MkdirAll(filepath.Dir(filename), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ioutil.WriteFile(filename, []byte(content), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRegisterOnce(t *testing.T) {
+	root, err := ioutil.TempDir("", "tory-register-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	mustWriteFile(t, filepath.Join(root, "etc", "os-release"),
+		"NAME=\"Ubuntu\"\nID=ubuntu\nVERSION_ID=\"14.04\"\n")
+	mustWriteFile(t, filepath.Join(root, "proc", "meminfo"),
+		"MemTotal:        2048000 kB\nMemFree:          100000 kB\n")
+	mustWriteFile(t, filepath.Join(root, "proc", "cpuinfo"),
+		"processor\t: 0\nmodel name\t: fancy\n\nprocessor\t: 1\nmodel name\t: fancy\n")
+	mustWriteFile(t, filepath.Join(root, "proc", "sys", "kernel", "osrelease"),
+		"3.13.0-32-generic\n")
+	mustWriteFile(t, filepath.Join(root, "register.json"),
+		`{"ip": "10.10.4.4", "type": "virtualmachine", "tags": {"team": "fribbles"}, "vars": {"cpus": "8"}}`)
+
+	fp := &fakePutter{}
+	_, err = registerOnce(&RegisterOptions{
+		ConfigFile: filepath.Join(root, "register.json"),
+		Client:     fp,
+	}, &localFacts{root: root})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hj := fp.put
+	if hj == nil {
+		t.Fatalf("host was not put")
+	}
+
+	if hj.Name == "" {
+		t.Fatalf("hostname was not gathered")
+	}
+
+	if hj.IP != "10.10.4.4" {
+		t.Fatalf("config ip was not merged: %q", hj.IP)
+	}
+
+	if hj.Image != "ubuntu-14.04" {
+		t.Fatalf("image does not match: %q != ubuntu-14.04", hj.Image)
+	}
+
+	if hj.Type != "virtualmachine" {
+		t.Fatalf("config type was not merged: %q", hj.Type)
+	}
+
+	for key, expected := range map[string]string{
+		"memory": "2000",
+		"cpus":   "8",
+		"kernel": "3.13.0-32-generic",
+	} {
+		if hj.Vars[key] != expected {
+			t.Fatalf("var %s does not match: %v != %q", key, hj.Vars[key], expected)
+		}
+	}
+
+	if hj.Tags["team"] != "fribbles" {
+		t.Fatalf("config tags were not merged: %#v", hj.Tags)
+	}
+}
@@ -0,0 +1,167 @@
+package tory
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	csvContentType = "text/csv"
+)
+
+var (
+	// summaryColumns are the host columns a summary may be grouped by,
+	// besides "tag.KEY", "var.KEY", and "fact.KEY"
+	summaryColumns = map[string]bool{
+		"image":   true,
+		"package": true,
+		"type":    true,
+		"state":   true,
+	}
+
+	// summaryAgeBuckets are the upper bounds of the age histogram buckets,
+	// the last of which has none
+	summaryAgeBuckets = []*ageBucket{
+		&ageBucket{Label: "<1d", Max: days(1)},
+		&ageBucket{Label: "1d-7d", Max: days(7)},
+		&ageBucket{Label: "7d-30d", Max: days(30)},
+		&ageBucket{Label: "30d-90d", Max: days(90)},
+		&ageBucket{Label: ">=90d"},
+	}
+
+	invalidDimensionError = fmt.Errorf("by must be comma-separated \"tag.KEY\", " +
+		"\"var.KEY\", \"fact.KEY\", \"image\", \"package\", \"type\", or \"state\"")
+)
+
+type ageBucket struct {
+	Label string        `json:"bucket"`
+	Max   time.Duration `json:"-"`
+	Count int           `json:"count"`
+}
+
+// summaryGroup is the count of hosts sharing the values of every dimension
+type summaryGroup struct {
+	Values map[string]string `json:"values"`
+	Count  int               `json:"count"`
+}
+
+// summaryReport is the body of GET /reports/summary
+type summaryReport struct {
+	Total        int                 `json:"total"`
+	By           []string            `json:"by"`
+	Groups       []*summaryGroup     `json:"groups"`
+	AgeHistogram []*ageBucket        `json:"age_histogram"`
+	MissingTags  map[string][]string `json:"missing_tags"`
+}
+
+// parseSummaryDimensions splits and checks the "by" query string variable
+func parseSummaryDimensions(by string) ([]string, error) {
+	dims := []string{}
+	for _, dim := range strings.Split(by, ",") {
+		dim = strings.ToLower(strings.TrimSpace(dim))
+		if dim == "" {
+			continue
+		}
+
+		if !summaryColumns[dim] && summaryHstore(dim) == "" {
+			return nil, invalidDimensionError
+		}
+
+		dims = append(dims, dim)
+	}
+
+	return dims, nil
+}
+
+// summaryHstore returns the hstore column of a "tag.KEY", "var.KEY", or
+// "fact.KEY" dimension, or ""
+func summaryHstore(dim string) string {
+	parts := strings.SplitN(dim, ".", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return ""
+	}
+
+	switch parts[0] {
+	case "tag":
+		return "tags"
+	case "var":
+		return "vars"
+	case "fact":
+		return "facts"
+	}
+
+	return ""
+}
+
+// summaryExpr returns the SQL grouping expression for the dimension,
+// appending any bind it needs
+func summaryExpr(dim string, binds *[]interface{}) string {
+	column := summaryHstore(dim)
+	if column == "" {
+		return fmt.Sprintf("lower(%s)", dim)
+	}
+
+	*binds = append(*binds, strings.SplitN(dim, ".", 2)[1])
+	return fmt.Sprintf(`lower((
+		SELECT value FROM each(%s)
+		WHERE lower(key) = lower($%d)
+		LIMIT 1))`, column, len(*binds))
+}
+
+// parseRequiredTags splits the "required" query string variable
+func parseRequiredTags(required string) []string {
+	keys := []string{}
+	for _, key := range strings.Split(required, ",") {
+		key = strings.TrimSpace(key)
+		if key != "" {
+			keys = append(keys, key)
+		}
+	}
+
+	return keys
+}
+
+func wantsCSV(r *http.Request) bool {
+	return r.FormValue("format") == "csv" ||
+		strings.Contains(r.Header.Get("Accept"), csvContentType)
+}
+
+// newAgeHistogram returns empty buckets
+func newAgeHistogram() []*ageBucket {
+	buckets := []*ageBucket{}
+	for _, b := range summaryAgeBuckets {
+		buckets = append(buckets, &ageBucket{Label: b.Label, Max: b.Max})
+	}
+
+	return buckets
+}
+
+// WriteCSV writes the groups as CSV, one column per dimension followed by
+// the count
+func (sr *summaryReport) WriteCSV(w io.Writer) error {
+	cw := csv.NewWriter(w)
+	err := cw.Write(append(append([]string{}, sr.By...), "count"))
+	if err != nil {
+		return err
+	}
+
+	for _, g := range sr.Groups {
+		record := []string{}
+		for _, dim := range sr.By {
+			record = append(record, g.Values[dim])
+		}
+
+		err = cw.Write(append(record, strconv.Itoa(g.Count)))
+		if err != nil {
+			return err
+		}
+	}
+
+	cw.Flush()
+	return cw.Error()
+}
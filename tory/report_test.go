@@ -0,0 +1,115 @@
+package tory
+
+import (
+	"bytes"
+	"net/http"
+	"testing"
+)
+
+func TestParseSummaryDimensions(t *testing.T) {
+	dims, err := parseSummaryDimensions("tag.team, Tag.Env,,image")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"tag.team", "tag.env", "image"}
+	if len(dims) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, dims)
+	}
+
+	for i, dim := range expected {
+		if dims[i] != dim {
+			t.Fatalf("expected %v, got %v", expected, dims)
+		}
+	}
+
+	for _, by := range []string{"name", "tag.", "secret.password", "image;drop"} {
+		_, err := parseSummaryDimensions(by)
+		if err != invalidDimensionError {
+			t.Fatalf("%q: expected %v, got %v", by, invalidDimensionError, err)
+		}
+	}
+}
+
+func TestSummaryExpr(t *testing.T) {
+	binds := []interface{}{"fribbles"}
+
+	if expr := summaryExpr("image", &binds); expr != "lower(image)" {
+		t.Fatalf("unexpected image expression %q", expr)
+	}
+
+	if len(binds) != 1 {
+		t.Fatalf("column dimensions should not bind: %v", binds)
+	}
+
+	expr := summaryExpr("fact.os.family", &binds)
+	if !bytes.Contains([]byte(expr), []byte("each(facts)")) ||
+		!bytes.Contains([]byte(expr), []byte("$2")) {
+		t.Fatalf("unexpected fact expression %q", expr)
+	}
+
+	if len(binds) != 2 || binds[1] != "os.family" {
+		t.Fatalf("expected fact key bind, got %v", binds)
+	}
+}
+
+func TestSummaryReportWriteCSV(t *testing.T) {
+	sr := &summaryReport{
+		By: []string{"tag.team", "image"},
+		Groups: []*summaryGroup{
+			&summaryGroup{
+				Values: map[string]string{"tag.team": "fribbles", "image": "ubuntu-14.04"},
+				Count:  3,
+			},
+			&summaryGroup{
+				Values: map[string]string{"tag.team": "", "image": "centos, 7"},
+				Count:  1,
+			},
+		},
+	}
+
+	buf := &bytes.Buffer{}
+	err := sr.WriteCSV(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "tag.team,image,count\nfribbles,ubuntu-14.04,3\n,\"centos, 7\",1\n"
+	if buf.String() != expected {
+		t.Fatalf("expected %q, got %q", expected, buf.String())
+	}
+}
+
+func TestNewAgeHistogram(t *testing.T) {
+	buckets := newAgeHistogram()
+	if len(buckets) != len(summaryAgeBuckets) {
+		t.Fatalf("expected %d buckets, got %d", len(summaryAgeBuckets), len(buckets))
+	}
+
+	buckets[0].Count = 5
+	if summaryAgeBuckets[0].Count != 0 {
+		t.Fatalf("histogram shares buckets with summaryAgeBuckets")
+	}
+
+	if buckets[len(buckets)-1].Max != 0 {
+		t.Fatalf("last bucket should be unbounded")
+	}
+}
+
+func TestWantsCSV(t *testing.T) {
+	r, _ := http.NewRequest("GET", "/reports/summary?format=csv", nil)
+	if !wantsCSV(r) {
+		t.Fatalf("expected format=csv to be csv")
+	}
+
+	r, _ = http.NewRequest("GET", "/reports/summary", nil)
+	r.Header.Set("Accept", csvContentType)
+	if !wantsCSV(r) {
+		t.Fatalf("expected Accept: %s to be csv", csvContentType)
+	}
+
+	r, _ = http.NewRequest("GET", "/reports/summary", nil)
+	if wantsCSV(r) {
+		t.Fatalf("expected JSON by default")
+	}
+}
@@ -0,0 +1,138 @@
+package tory
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/modcloth/tory/tory/api"
+)
+
+var (
+	noRunPlaybookError = fmt.Errorf("no \"playbook\" in run payload")
+	noRunHostsError    = fmt.Errorf("no \"hosts\" in run payload")
+	invalidAgeError    = fmt.Errorf("age must be a duration such as \"7d\" or \"36h\"")
+)
+
+// RunJSON is a playbook run summary as posted by an ansible callback plugin,
+// with per-host stats keyed by inventory hostname
+type RunJSON struct {
+	Playbook string                   `json:"playbook"`
+	Start    time.Time                `json:"start"`
+	End      time.Time                `json:"end"`
+	Hosts    map[string]*RunStatsJSON `json:"hosts"`
+}
+
+// RunStatsJSON is the per-host summary of a playbook run
+type RunStatsJSON struct {
+	OK          int `json:"ok"`
+	Changed     int `json:"changed"`
+	Failed      int `json:"failed"`
+	Unreachable int `json:"unreachable"`
+}
+
+type hostRun struct {
+	ID     int64 `db:"id"`
+	HostID int64 `db:"host_id"`
+
+	Playbook string    `db:"playbook"`
+	Started  time.Time `db:"started"`
+	Finished time.Time `db:"finished"`
+	Status   string    `db:"status"`
+
+	OK          int `db:"ok"`
+	Changed     int `db:"changed"`
+	Failed      int `db:"failed"`
+	Unreachable int `db:"unreachable"`
+}
+
+func runJSONFromHTTPBody(in io.Reader) (*RunJSON, error) {
+	run := &RunJSON{}
+	err := json.NewDecoder(in).Decode(run)
+	if err != nil {
+		return nil, err
+	}
+
+	if run.Playbook == "" {
+		return nil, noRunPlaybookError
+	}
+
+	if len(run.Hosts) == 0 {
+		return nil, noRunHostsError
+	}
+
+	if run.End.IsZero() {
+		run.End = time.Now().UTC()
+	}
+
+	if run.Start.IsZero() {
+		run.Start = run.End
+	}
+
+	return run, nil
+}
+
+// Status is "unreachable" or "failed" when any task was, otherwise "ok"
+func (s *RunStatsJSON) Status() string {
+	if s.Unreachable > 0 {
+		return "unreachable"
+	}
+
+	if s.Failed > 0 {
+		return "failed"
+	}
+
+	return "ok"
+}
+
+func setLastRun(hj *api.HostJSON, run *hostRun) {
+	if run == nil {
+		return
+	}
+
+	hj.LastRunPlaybook = run.Playbook
+	hj.LastRunStatus = run.Status
+	hj.LastRunStarted = &run.Started
+	hj.LastRunFinished = &run.Finished
+}
+
+func setLastSuccess(hj *api.HostJSON, run *hostRun) {
+	if run == nil {
+		return
+	}
+
+	hj.LastSuccessPlaybook = run.Playbook
+	hj.LastSuccessStarted = &run.Started
+	hj.LastSuccessFinished = &run.Finished
+}
+
+// parseAge parses durations such as "7d", "36h", or "2w", since
+// time.ParseDuration stops at hours
+func parseAge(s string) (time.Duration, error) {
+	s = strings.TrimSpace(s)
+	for suffix, unit := range map[string]time.Duration{
+		"d": 24 * time.Hour,
+		"w": 7 * 24 * time.Hour,
+	} {
+		if !strings.HasSuffix(s, suffix) {
+			continue
+		}
+
+		n, err := strconv.Atoi(strings.TrimSuffix(s, suffix))
+		if err != nil || n < 0 {
+			return 0, invalidAgeError
+		}
+
+		return time.Duration(n) * unit, nil
+	}
+
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		return 0, invalidAgeError
+	}
+
+	return d, nil
+}
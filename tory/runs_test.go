@@ -0,0 +1,66 @@
+package tory
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseAge(t *testing.T) {
+	for s, expected := range map[string]time.Duration{
+		"7d":  7 * 24 * time.Hour,
+		"2w":  14 * 24 * time.Hour,
+		"36h": 36 * time.Hour,
+		"90m": 90 * time.Minute,
+	} {
+		actual, err := parseAge(s)
+		if err != nil {
+			t.Fatalf("%q: %v", s, err)
+		}
+
+		if actual != expected {
+			t.Fatalf("%q: expected %v, got %v", s, expected, actual)
+		}
+	}
+
+	for _, s := range []string{"", "d", "-1d", "seven days"} {
+		_, err := parseAge(s)
+		if err != invalidAgeError {
+			t.Fatalf("%q: expected %v, got %v", s, invalidAgeError, err)
+		}
+	}
+}
+
+func TestRunJSONFromHTTPBody(t *testing.T) {
+	run, err := runJSONFromHTTPBody(strings.NewReader(`{
+		"playbook": "site.yml",
+		"end": "2014-08-20T10:00:00Z",
+		"hosts": {
+			"web1.example.com": {"ok": 10, "changed": 2},
+			"web2.example.com": {"ok": 3, "failed": 1},
+			"web3.example.com": {"unreachable": 1}
+		}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !run.Start.Equal(run.End) {
+		t.Fatalf("start did not default to end: %v", run.Start)
+	}
+
+	for hostname, expected := range map[string]string{
+		"web1.example.com": "ok",
+		"web2.example.com": "failed",
+		"web3.example.com": "unreachable",
+	} {
+		if status := run.Hosts[hostname].Status(); status != expected {
+			t.Fatalf("%s: expected status %q, got %q", hostname, expected, status)
+		}
+	}
+
+	_, err = runJSONFromHTTPBody(strings.NewReader(`{"playbook": "site.yml"}`))
+	if err != noRunHostsError {
+		t.Fatalf("expected %v, got %v", noRunHostsError, err)
+	}
+}
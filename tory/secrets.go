@@ -0,0 +1,369 @@
+package tory
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+const (
+	// redactedSecret replaces secret values for callers without the
+	// "secrets:read" scope
+	redactedSecret = "<redacted>"
+
+	secretKeySize = 32
+)
+
+var (
+	noSecretKeysError       = fmt.Errorf("no secret keys configured")
+	unknownSecretKeyError   = fmt.Errorf("secret is encrypted with an unknown key")
+	malformedSecretError    = fmt.Errorf("secret is malformed")
+	invalidSecretKeyError   = fmt.Errorf("secret keys must be 32 bytes")
+	secretsDisabledError    = fmt.Errorf("secrets require a secret key file")
+	secretNotSupportedError = fmt.Errorf("only vars may be secret")
+)
+
+// SecretsRotateOptions contains everything needed to rotate the secret key
+type SecretsRotateOptions struct {
+	DatabaseURL string
+	KeyFile     string
+}
+
+// secretKey is a key encryption key, which wraps the per-secret data keys
+type secretKey struct {
+	ID  string `json:"id"`
+	Key []byte `json:"key"`
+}
+
+// secretKeyring is the set of key encryption keys read from a key file,
+// the first of which encrypts new secrets while the rest are only kept
+// around to decrypt secrets not yet rewrapped.  The file is reread whenever
+// it changes, so that servers pick up rotated keys without restarting.
+type secretKeyring struct {
+	Keys []*secretKey `json:"keys"`
+
+	filename string
+	modTime  time.Time
+	mutex    *sync.Mutex
+}
+
+// sealedSecret is a secret value encrypted with a random data key, which is
+// in turn encrypted ("wrapped") with the keyring key named by KeyID.  Both
+// are AES-256-GCM nonces followed by ciphertext.
+type sealedSecret struct {
+	KeyID      string `db:"key_id"`
+	WrappedKey []byte `db:"wrapped_key"`
+	Ciphertext []byte `db:"ciphertext"`
+}
+
+type hostSecret struct {
+	ID       int64     `db:"id"`
+	HostID   int64     `db:"host_id"`
+	Key      string    `db:"key"`
+	Modified time.Time `db:"modified"`
+
+	sealedSecret
+}
+
+// SecretsRotateMain adds a new key to the key file, creating the file if
+// needed, rewraps every secret's data key with it, and then drops the old
+// keys from the file
+func SecretsRotateMain(opts *SecretsRotateOptions) {
+	kr, err := openSecretKeyring(opts.KeyFile, true)
+	if err != nil {
+		toryLog.Fatal(err.Error())
+	}
+
+	db, err := newDatabase(opts.DatabaseURL)
+	if err != nil {
+		toryLog.Fatal(err.Error())
+	}
+
+	err = kr.Rotate()
+	if err != nil {
+		toryLog.Fatal(err.Error())
+	}
+
+	err = kr.Save()
+	if err != nil {
+		toryLog.Fatal(err.Error())
+	}
+
+	count, err := db.RewrapSecrets(kr)
+	if err != nil {
+		toryLog.Fatal(err.Error())
+	}
+
+	kr.Keys = kr.Keys[:1]
+	err = kr.Save()
+	if err != nil {
+		toryLog.Fatal(err.Error())
+	}
+
+	toryLog.WithFields(logrus.Fields{
+		"key_id": kr.Keys[0].ID,
+		"count":  count,
+	}).Info("rotated secret key")
+}
+
+// openSecretKeyring reads the key file, which may only be missing when
+// allowMissing is true
+func openSecretKeyring(filename string, allowMissing bool) (*secretKeyring, error) {
+	kr := &secretKeyring{
+		Keys:     []*secretKey{},
+		filename: filename,
+		mutex:    &sync.Mutex{},
+	}
+
+	err := kr.reload()
+	if err != nil && !(allowMissing && os.IsNotExist(err)) {
+		return nil, err
+	}
+
+	return kr, nil
+}
+
+func newSecretKey() (*secretKey, error) {
+	id := make([]byte, 8)
+	key := make([]byte, secretKeySize)
+	for _, b := range [][]byte{id, key} {
+		if _, err := io.ReadFull(rand.Reader, b); err != nil {
+			return nil, err
+		}
+	}
+
+	return &secretKey{ID: hex.EncodeToString(id), Key: key}, nil
+}
+
+// reload rereads the key file if it has changed since it was last read
+func (kr *secretKeyring) reload() error {
+	if kr.filename == "" {
+		return nil
+	}
+
+	fi, err := os.Stat(kr.filename)
+	if err != nil {
+		return err
+	}
+
+	if fi.ModTime().Equal(kr.modTime) {
+		return nil
+	}
+
+	b, err := ioutil.ReadFile(kr.filename)
+	if err != nil {
+		return err
+	}
+
+	keys := &secretKeyring{}
+	err = json.Unmarshal(b, keys)
+	if err != nil {
+		return err
+	}
+
+	for _, k := range keys.Keys {
+		if len(k.Key) != secretKeySize {
+			return invalidSecretKeyError
+		}
+	}
+
+	kr.Keys = keys.Keys
+	kr.modTime = fi.ModTime()
+	return nil
+}
+
+// Save writes the keyring to its file, readable by the owner only
+func (kr *secretKeyring) Save() error {
+	b, err := json.MarshalIndent(kr, "", "    ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(kr.filename), ".tory-keys")
+	if err != nil {
+		return err
+	}
+
+	defer os.Remove(tmp.Name())
+
+	err = tmp.Chmod(0600)
+	if err == nil {
+		_, err = tmp.Write(append(b, '\n'))
+	}
+
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), kr.filename)
+}
+
+// Rotate makes a new key the one used to encrypt
+func (kr *secretKeyring) Rotate() error {
+	k, err := newSecretKey()
+	if err != nil {
+		return err
+	}
+
+	kr.Keys = append([]*secretKey{k}, kr.Keys...)
+	return nil
+}
+
+func (kr *secretKeyring) refresh() {
+	err := kr.reload()
+	if err != nil {
+		toryLog.WithField("err", err).Warn("failed to reload secret key file")
+	}
+}
+
+func (kr *secretKeyring) key(id string) *secretKey {
+	for _, k := range kr.Keys {
+		if k.ID == id {
+			return k
+		}
+	}
+
+	return nil
+}
+
+// Encrypt seals the value with a new data key wrapped by the current key
+func (kr *secretKeyring) Encrypt(value string) (*sealedSecret, error) {
+	kr.mutex.Lock()
+	defer kr.mutex.Unlock()
+
+	kr.refresh()
+	if len(kr.Keys) == 0 {
+		return nil, noSecretKeysError
+	}
+
+	dataKey := make([]byte, secretKeySize)
+	if _, err := io.ReadFull(rand.Reader, dataKey); err != nil {
+		return nil, err
+	}
+
+	wrappedKey, err := sealAESGCM(kr.Keys[0].Key, dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	ciphertext, err := sealAESGCM(dataKey, []byte(value))
+	if err != nil {
+		return nil, err
+	}
+
+	return &sealedSecret{
+		KeyID:      kr.Keys[0].ID,
+		WrappedKey: wrappedKey,
+		Ciphertext: ciphertext,
+	}, nil
+}
+
+// Decrypt unwraps the secret's data key and opens the value
+func (kr *secretKeyring) Decrypt(s *sealedSecret) (string, error) {
+	dataKey, err := kr.unwrap(s)
+	if err != nil {
+		return "", err
+	}
+
+	value, err := openAESGCM(dataKey, s.Ciphertext)
+	if err != nil {
+		return "", err
+	}
+
+	return string(value), nil
+}
+
+// Rewrap wraps the secret's data key with the current key, leaving the
+// encrypted value alone
+func (kr *secretKeyring) Rewrap(s *sealedSecret) error {
+	dataKey, err := kr.unwrap(s)
+	if err != nil {
+		return err
+	}
+
+	kr.mutex.Lock()
+	defer kr.mutex.Unlock()
+
+	if len(kr.Keys) == 0 {
+		return noSecretKeysError
+	}
+
+	wrappedKey, err := sealAESGCM(kr.Keys[0].Key, dataKey)
+	if err != nil {
+		return err
+	}
+
+	s.KeyID = kr.Keys[0].ID
+	s.WrappedKey = wrappedKey
+	return nil
+}
+
+func (kr *secretKeyring) unwrap(s *sealedSecret) ([]byte, error) {
+	kr.mutex.Lock()
+	defer kr.mutex.Unlock()
+
+	k := kr.key(s.KeyID)
+	if k == nil {
+		kr.refresh()
+		k = kr.key(s.KeyID)
+	}
+
+	if k == nil {
+		return nil, unknownSecretKeyError
+	}
+
+	return openAESGCM(k.Key, s.WrappedKey)
+}
+
+// sealAESGCM encrypts with AES-256-GCM, returning the nonce followed by the
+// ciphertext
+func sealAESGCM(key, plaintext []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	return gcm.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+func openAESGCM(key, sealed []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(sealed) < gcm.NonceSize() {
+		return nil, malformedSecretError
+	}
+
+	return gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], nil)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
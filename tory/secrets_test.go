@@ -0,0 +1,166 @@
+package tory
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/lib/pq/hstore"
+)
+
+func testSecretKeyring(t *testing.T) (*secretKeyring, func()) {
+	dir, err := ioutil.TempDir("", "tory-secrets")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	kr, err := openSecretKeyring(filepath.Join(dir, "keys.json"), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = kr.Rotate()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = kr.Save()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return kr, func() { os.RemoveAll(dir) }
+}
+
+func TestSecretKeyringEncryptDecrypt(t *testing.T) {
+	kr, cleanup := testSecretKeyring(t)
+	defer cleanup()
+
+	sealed, err := kr.Encrypt("hunter2")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(sealed.Ciphertext) == "hunter2" {
+		t.Fatalf("expected ciphertext, got plaintext")
+	}
+
+	value, err := kr.Decrypt(sealed)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if value != "hunter2" {
+		t.Fatalf("expected %q, got %q", "hunter2", value)
+	}
+
+	sealed.Ciphertext[len(sealed.Ciphertext)-1] ^= 0xff
+	_, err = kr.Decrypt(sealed)
+	if err == nil {
+		t.Fatalf("expected tampered ciphertext to fail to decrypt")
+	}
+}
+
+func TestSecretKeyringRotate(t *testing.T) {
+	kr, cleanup := testSecretKeyring(t)
+	defer cleanup()
+
+	sealed, err := kr.Encrypt("hunter2")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	oldKeyID := sealed.KeyID
+	err = kr.Rotate()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = kr.Rewrap(sealed)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if sealed.KeyID == oldKeyID || sealed.KeyID != kr.Keys[0].ID {
+		t.Fatalf("expected secret rewrapped with %q, got %q", kr.Keys[0].ID, sealed.KeyID)
+	}
+
+	kr.Keys = kr.Keys[:1]
+	err = kr.Save()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := openSecretKeyring(kr.filename, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	value, err := reopened.Decrypt(sealed)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if value != "hunter2" {
+		t.Fatalf("expected %q, got %q", "hunter2", value)
+	}
+
+	sealed.KeyID = oldKeyID
+	_, err = reopened.Decrypt(sealed)
+	if err != unknownSecretKeyError {
+		t.Fatalf("expected %v, got %v", unknownSecretKeyError, err)
+	}
+}
+
+func TestOpenSecretKeyringMissing(t *testing.T) {
+	_, err := openSecretKeyring("/nonexistent/tory-keys.json", false)
+	if !os.IsNotExist(err) {
+		t.Fatalf("expected a not-exist error, got %v", err)
+	}
+}
+
+func TestHostvarsSecrets(t *testing.T) {
+	kr, cleanup := testSecretKeyring(t)
+	defer cleanup()
+
+	sealed, err := kr.Encrypt("hunter2")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := newHost()
+	h.IP = &inet{Addr: "10.10.1.7"}
+	h.Vars = &hstore.Hstore{Map: map[string]sql.NullString{}}
+	h.Secrets = []*hostSecret{&hostSecret{Key: "db_password", sealedSecret: *sealed}}
+
+	srv := &server{keyring: kr, db: &database{}, log: logrus.New()}
+	r, _ := http.NewRequest("GET", "/", nil)
+	vars, err := srv.hostvars(h, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := vars["db_password"]; ok {
+		t.Fatalf("expected an unreadable secret to be left out, got %#v", vars["db_password"])
+	}
+
+	r.Header.Set("Tory-Scopes", secretsReadScope)
+	vars, err = srv.hostvars(h, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if vars["db_password"] != "hunter2" {
+		t.Fatalf("expected %q, got %#v", "hunter2", vars["db_password"])
+	}
+
+	h.Secrets[0].Ciphertext[0] ^= 0xff
+	_, err = srv.hostvars(h, r)
+	if err == nil {
+		t.Fatalf("expected an undecryptable secret to be an error")
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"net/http"
 	"os"
 	"path"
+	"strconv"
 	"strings"
 	"time"
 
@@ -16,6 +17,7 @@ import (
 	"github.com/meatballhat/maybestatic"
 	"github.com/meatballhat/negroni-logrus"
 	"github.com/modcloth/expvarplus"
+	"github.com/modcloth/tory/tory/api"
 	"github.com/phyber/negroni-gzip/gzip"
 )
 
@@ -28,6 +30,15 @@ var (
 	noValueKeyError       = fmt.Errorf("no value key in payload")
 )
 
+// keyValueInput is the payload for setting a single tag or var, which may
+// be stored as an encrypted secret or as ansible vault text when it is a
+// var
+type keyValueInput struct {
+	Value  *string `json:"value"`
+	Secret bool    `json:"secret"`
+	Vault  bool    `json:"vault"`
+}
+
 func init() {
 	port := os.Getenv("PORT")
 	if port != "" && os.Getenv("TORY_ADDR") == "" {
@@ -51,7 +62,22 @@ func init() {
 
 // ServerMain is the whole shebang
 func ServerMain(opts *ServerOptions) {
-	buildServer(opts).Run(opts.Addr)
+	if err := opts.Normalization.Validate(); err != nil {
+		toryLog.WithFields(logrus.Fields{"err": err}).Fatal("invalid normalization")
+	}
+
+	srv := buildServer(opts)
+
+	if opts.ReapInterval > 0 {
+		policy, err := readReapPolicy(opts.ReapPolicyFile)
+		if err != nil {
+			toryLog.WithFields(logrus.Fields{"err": err}).Fatal("failed to read reap policy")
+		}
+
+		go newReaper(srv.db, policy, srv.log).Run(opts.ReapInterval)
+	}
+
+	srv.Run(opts.Addr)
 }
 
 func buildServer(opts *ServerOptions) *server {
@@ -65,12 +91,54 @@ func buildServer(opts *ServerOptions) *server {
 		toryLog.WithFields(logrus.Fields{"err": err}).Fatal("failed to build server")
 	}
 
+	if opts.Groups == nil {
+		opts.Groups, err = readGroupConfig(opts.GroupsFile)
+		if err != nil {
+			toryLog.WithFields(logrus.Fields{"err": err}).Fatal("failed to read group config")
+		}
+	}
+
+	if opts.Tokens == nil {
+		opts.Tokens, err = readTokensFile(opts.TokensFile)
+		if err != nil {
+			toryLog.WithFields(logrus.Fields{"err": err}).Fatal("failed to read tokens file")
+		}
+	}
+
+	if opts.Policy == nil {
+		opts.Policy, err = readTagPolicy(opts.PolicyFile)
+		if err != nil {
+			toryLog.WithFields(logrus.Fields{"err": err}).Fatal("failed to read policy file")
+		}
+	}
+
+	if opts.PolicyMode == "" {
+		opts.PolicyMode = policyModeAudit
+	}
+
+	if !isValidPolicyMode(opts.PolicyMode) {
+		toryLog.WithFields(logrus.Fields{"err": invalidPolicyModeError}).Fatal("invalid policy mode")
+	}
+
+	if opts.SecretKeyFile != "" {
+		srv.keyring, err = openSecretKeyring(opts.SecretKeyFile, false)
+		if err != nil {
+			toryLog.WithFields(logrus.Fields{"err": err}).Fatal("failed to read secret key file")
+		}
+	}
+
 	srv.Setup(opts)
 	return srv
 }
 
 type server struct {
-	prefix string
+	prefix            string
+	factsAllowlist    map[string]bool
+	ansibleHostLabels []string
+	groups            *GroupConfig
+	keyring           *secretKeyring
+	policy            *TagPolicy
+	policyMode        string
 
 	log *logrus.Logger
 	db  *database
@@ -85,11 +153,13 @@ func newServer(dbConnStr string) (*server, error) {
 	}
 
 	srv := &server{
-		prefix: `/ansible/hosts`,
-		log:    logrus.New(),
-		db:     db,
-		n:      negroni.New(),
-		r:      mux.NewRouter(),
+		prefix:         `/ansible/hosts`,
+		factsAllowlist: newFactsAllowlist(nil),
+		groups:         DefaultGroupConfig,
+		log:            logrus.New(),
+		db:             db,
+		n:              negroni.New(),
+		r:              mux.NewRouter(),
 	}
 
 	return srv, nil
@@ -97,6 +167,21 @@ func newServer(dbConnStr string) (*server, error) {
 
 func (srv *server) Setup(opts *ServerOptions) {
 	srv.prefix = opts.Prefix
+	srv.factsAllowlist = newFactsAllowlist(opts.FactsAllowlist)
+	if opts.Groups != nil {
+		srv.groups = opts.Groups
+	}
+	srv.policy = opts.Policy
+	srv.policyMode = opts.PolicyMode
+	if srv.policyMode == "" {
+		srv.policyMode = policyModeAudit
+	}
+	srv.ansibleHostLabels = []string{}
+	for _, label := range opts.AnsibleHostLabels {
+		if label = strings.ToLower(strings.TrimSpace(label)); label != "" {
+			srv.ansibleHostLabels = append(srv.ansibleHostLabels, label)
+		}
+	}
 
 	if opts.Verbose {
 		srv.log.Level = logrus.DebugLevel
@@ -107,8 +192,17 @@ func (srv *server) Setup(opts *ServerOptions) {
 	}
 
 	srv.db.Log = srv.log
+	srv.db.Normalization = opts.Normalization
 
 	srv.r.HandleFunc(srv.prefix, srv.getHostInventory).Methods("GET")
+	srv.r.HandleFunc(srv.prefix+`/_hosts`, srv.getHosts).Methods("GET")
+	srv.r.HandleFunc(srv.prefix+`/_tags`, srv.getTagKeys).Methods("GET")
+	srv.r.HandleFunc(srv.prefix+`/_tags/{key}`, srv.getTagValues).Methods("GET")
+	srv.r.HandleFunc(srv.prefix+`/_vars`, srv.getVarKeys).Methods("GET")
+	srv.r.HandleFunc(srv.prefix+`/_vars/{key}`, srv.getVarValues).Methods("GET")
+	srv.r.HandleFunc(srv.prefix+`/_runs`, srv.createRun).Methods("POST")
+	srv.r.HandleFunc(srv.prefix+`/_trash`, srv.getTrash).Methods("GET")
+	srv.r.HandleFunc(srv.prefix+`/_trash/{hostname}/restore`, srv.restoreHost).Methods("POST")
 
 	srv.r.HandleFunc(srv.prefix+`/{hostname}`, srv.getHost).Methods("GET")
 	srv.r.HandleFunc(srv.prefix+`/{hostname}`, srv.updateHost).Methods("PUT")
@@ -120,8 +214,19 @@ func (srv *server) Setup(opts *ServerOptions) {
 	srv.r.HandleFunc(srv.prefix+`/{hostname}/vars/{key}`, srv.getHostVar).Methods("GET")
 	srv.r.HandleFunc(srv.prefix+`/{hostname}/vars/{key}`, srv.updateHostVar).Methods("PUT")
 	srv.r.HandleFunc(srv.prefix+`/{hostname}/vars/{key}`, srv.deleteHostVar).Methods("DELETE")
+	srv.r.HandleFunc(srv.prefix+`/{hostname}/facts`, srv.updateHostFacts).Methods("POST")
+	srv.r.HandleFunc(srv.prefix+`/{hostname}/state`, srv.getHostState).Methods("GET")
+	srv.r.HandleFunc(srv.prefix+`/{hostname}/state`, srv.updateHostState).Methods("PUT")
+	srv.r.HandleFunc(srv.prefix+`/{hostname}/rename`, srv.renameHost).Methods("POST")
+	srv.r.HandleFunc(srv.prefix+`/{hostname}/aliases`, srv.getHostAliases).Methods("GET")
+	srv.r.HandleFunc(srv.prefix+`/{hostname}/aliases/{alias}`, srv.updateHostAlias).Methods("PUT")
+	srv.r.HandleFunc(srv.prefix+`/{hostname}/aliases/{alias}`, srv.deleteHostAlias).Methods("DELETE")
 
 	srv.r.HandleFunc(`/ping`, srv.handlePing).Methods("GET", "HEAD")
+	srv.r.HandleFunc(`/reports/summary`, srv.getSummaryReport).Methods("GET")
+	srv.r.HandleFunc(`/policy/rules`, srv.getPolicyRules).Methods("GET")
+	srv.r.HandleFunc(`/policy/rules`, srv.updatePolicyRules).Methods("PUT")
+	srv.r.HandleFunc(`/policy/violations`, srv.getPolicyViolations).Methods("GET")
 	srv.r.HandleFunc(`/debug/vars`, expvarplus.HandleExpvars).Methods("GET")
 	srv.r.Handle(`/`, http.RedirectHandler(`/index.html`, http.StatusFound))
 
@@ -137,7 +242,7 @@ func (srv *server) Setup(opts *ServerOptions) {
 	srv.n.Use(gzip.Gzip(gzip.DefaultCompression))
 	srv.n.Use(negroni.NewStatic(maybestatic.New(opts.StaticDir, Asset)))
 	srv.n.Use(negronilogrus.NewMiddleware())
-	srv.n.Use(newAuthMiddleware(opts.AuthToken))
+	srv.n.Use(newAuthMiddleware(opts.AuthToken, opts.Tokens))
 	srv.n.UseHandler(srv.r)
 }
 
@@ -156,6 +261,11 @@ func (srv *server) sendError(w http.ResponseWriter, err error, status int) {
 	fmt.Fprintf(w, `{"error":%q}`, err.Error())
 }
 
+func (srv *server) sendValidationErrors(w http.ResponseWriter, errs validationErrors) {
+	srv.log.WithFields(logrus.Fields{"errors": errs.Error()}).Warn("returning validation errors")
+	srv.sendJSON(w, map[string]validationErrors{"errors": errs}, statusUnprocessableEntity)
+}
+
 func (srv *server) sendUnauthorized(w http.ResponseWriter) {
 	w.Header().Set("WWW-Authenticate", "token")
 	srv.sendJSON(w, map[string]string{"error": "unauthorized"}, http.StatusUnauthorized)
@@ -165,26 +275,37 @@ func (srv *server) sendJSON(w http.ResponseWriter, j interface{}, status int) {
 	jsonBytes, err := json.MarshalIndent(j, "", "    ")
 	if err != nil {
 		srv.sendError(w, err, http.StatusInternalServerError)
+		return
 	}
 
-	jsonString := string(jsonBytes) + "\n"
-
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
 	w.WriteHeader(status)
-	fmt.Fprintf(w, jsonString)
+	w.Write(append(jsonBytes, '\n'))
 }
 
 func (srv *server) isAuthed(r *http.Request) bool {
 	return r.Header.Get("Tory-Authorized") == "yep"
 }
 
+func (srv *server) hasScope(r *http.Request, scope string) bool {
+	for _, s := range strings.Fields(r.Header.Get("Tory-Scopes")) {
+		if s == scope {
+			return true
+		}
+	}
+
+	return false
+}
+
 func (srv *server) handlePing(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
 	w.WriteHeader(http.StatusOK)
 	fmt.Fprintf(w, "PONG\n")
 }
 
-func (srv *server) getHostInventory(w http.ResponseWriter, r *http.Request) {
+// hostFilterFromRequest builds a filter from the inventory query string
+// variables
+func (srv *server) hostFilterFromRequest(r *http.Request) (*hostFilter, error) {
 	var err error
 	sinceTime := zeroTime
 	since := r.FormValue("since")
@@ -210,6 +331,43 @@ func (srv *server) getHostInventory(w http.ResponseWriter, r *http.Request) {
 		Team:   r.FormValue("team"),
 		Since:  sinceTime,
 		Before: beforeTime,
+		Facts:  map[string]string{},
+
+		LastRunStatus: r.FormValue("last_run_status"),
+		Address:       r.FormValue("address"),
+	}
+
+	switch state := r.FormValue("state"); state {
+	case "":
+		hf.ExcludeStates = []string{"decommissioned"}
+	case "all":
+	default:
+		hf.States = strings.Split(state, ",")
+	}
+
+	notRunSince := r.FormValue("not_run_since")
+	if notRunSince != "" {
+		age, err := parseAge(notRunSince)
+		if err != nil {
+			return nil, err
+		}
+		hf.NotRunSince = time.Now().UTC().Add(-age)
+	}
+
+	for key, values := range r.Form {
+		if strings.HasPrefix(key, "fact.") && len(values) > 0 {
+			hf.Facts[strings.TrimPrefix(key, "fact.")] = values[0]
+		}
+	}
+
+	return hf, nil
+}
+
+func (srv *server) getHostInventory(w http.ResponseWriter, r *http.Request) {
+	hf, err := srv.hostFilterFromRequest(r)
+	if err != nil {
+		srv.sendError(w, err, http.StatusBadRequest)
+		return
 	}
 
 	srv.log.WithFields(logrus.Fields{
@@ -224,29 +382,19 @@ func (srv *server) getHostInventory(w http.ResponseWriter, r *http.Request) {
 
 	inv := newInventory()
 	for _, host := range hosts {
-		inv.AddHostnameToGroupUnsanitized(host.IP.Addr, host.Name)
-
-		if host.Type.String != "" {
-			inv.AddHostnameToGroup(fmt.Sprintf("type_%s",
-				strings.ToLower(host.Type.String)), host.Name)
-		}
-
-		if host.Tags != nil && host.Tags.Map != nil {
-			for key, value := range host.Tags.Map {
-				if value.String == "" {
-					continue
-				}
-				invKey := fmt.Sprintf("tag_%s_%s",
-					strings.ToLower(key), strings.ToLower(value.String))
-				inv.AddHostnameToGroup(invKey, host.Name)
-			}
-		}
+		srv.groups.AddHost(inv, host)
 
 		if r.FormValue("exclude-vars") != "" {
 			continue
 		}
 
-		for key, value := range host.CollapsedVars() {
+		hostvars, err := srv.hostvars(host, r)
+		if err != nil {
+			srv.sendError(w, err, http.StatusInternalServerError)
+			return
+		}
+
+		for key, value := range hostvars {
 			inv.Meta.AddHostvar(host.Name, key, value)
 		}
 	}
@@ -254,6 +402,101 @@ func (srv *server) getHostInventory(w http.ResponseWriter, r *http.Request) {
 	srv.sendJSON(w, inv, http.StatusOK)
 }
 
+// hostvars returns the host's collapsed vars, secrets, and vault vars
+// along with an "ansible_host" from its preferred address, unless already
+// set as a var.  Vault vars are objects that ansible decrypts itself, e.g.
+// {"__ansible_vault": "$ANSIBLE_VAULT;1.1;AES256\n..."}.  Secrets are left
+// out unless the request may read them, so that ansible never sees a
+// redacted placeholder as a value.
+func (srv *server) hostvars(h *host, r *http.Request) (map[string]interface{}, error) {
+	vars := map[string]interface{}{}
+	for key, value := range h.CollapsedVars(srv.db.Normalization.Policy("vars")) {
+		vars[key] = value
+	}
+
+	if srv.canReadSecrets(r) {
+		secrets, err := srv.secretVars(h, r)
+		if err != nil {
+			return nil, err
+		}
+
+		for key, value := range secrets {
+			vars[key] = value
+		}
+	}
+
+	if h.VaultVars != nil {
+		for key, value := range h.VaultVars.Map {
+			vars[key] = map[string]string{vaultHostvarKey: value.String}
+		}
+	}
+
+	if _, ok := vars["ansible_host"]; ok {
+		return vars, nil
+	}
+
+	if addr := h.AnsibleHost(srv.ansibleHostLabels); addr != "" {
+		vars["ansible_host"] = addr
+	}
+
+	return vars, nil
+}
+
+// canReadSecrets is whether the request's token may read secret vars in
+// the clear
+func (srv *server) canReadSecrets(r *http.Request) bool {
+	return srv.keyring != nil && srv.hasScope(r, secretsReadScope)
+}
+
+// secretVars returns the host's secrets, redacted unless the request has
+// the "secrets:read" scope
+func (srv *server) secretVars(h *host, r *http.Request) (map[string]string, error) {
+	secrets := map[string]string{}
+	for _, s := range h.Secrets {
+		value, err := srv.secretValue(s, r)
+		if err != nil {
+			return nil, err
+		}
+		secrets[s.Key] = value
+	}
+
+	return secrets, nil
+}
+
+// secretValue decrypts the secret, or redacts it unless the request has
+// the "secrets:read" scope
+func (srv *server) secretValue(s *hostSecret, r *http.Request) (string, error) {
+	if !srv.canReadSecrets(r) {
+		return redactedSecret, nil
+	}
+
+	value, err := srv.keyring.Decrypt(&s.sealedSecret)
+	if err != nil {
+		srv.log.WithFields(logrus.Fields{
+			"err":     err,
+			"host_id": s.HostID,
+			"key":     s.Key,
+		}).Error("failed to decrypt secret")
+		return "", fmt.Errorf("failed to decrypt secret %q: %v", s.Key, err)
+	}
+
+	return value, nil
+}
+
+// hostJSON converts the host for responses, including its secrets
+func (srv *server) hostJSON(h *host, r *http.Request) (*api.HostJSON, error) {
+	hj := hostToHostJSON(h)
+	if len(h.Secrets) > 0 {
+		secrets, err := srv.secretVars(h, r)
+		if err != nil {
+			return nil, err
+		}
+		hj.Secrets = secrets
+	}
+
+	return hj, nil
+}
+
 func (srv *server) getHost(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	hostname, ok := vars["hostname"]
@@ -269,14 +512,52 @@ func (srv *server) getHost(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if h.ResolvedAlias != "" {
+		location := path.Join(srv.prefix, h.Name)
+		if r.URL.RawQuery != "" {
+			location += "?" + r.URL.RawQuery
+		}
+
+		w.Header().Set("Location", location)
+		srv.sendJSON(w, map[string]string{"name": h.Name}, http.StatusMovedPermanently)
+		return
+	}
+
 	w.Header().Set("Location", path.Join(srv.prefix, h.Name))
 	srv.log.Info("sending back some json now")
 
 	if r.FormValue("vars-only") != "" {
-		srv.sendJSON(w, h.CollapsedVars(), http.StatusOK)
-	} else {
-		srv.sendJSON(w, map[string]*HostJSON{"host": hostToHostJSON(h)}, http.StatusOK)
+		hostvars, err := srv.hostvars(h, r)
+		if err != nil {
+			srv.sendError(w, err, http.StatusInternalServerError)
+			return
+		}
+
+		srv.sendJSON(w, hostvars, http.StatusOK)
+		return
+	}
+
+	run, err := srv.db.ReadLastRun(h.ID)
+	if err != nil {
+		srv.sendError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	success, err := srv.db.ReadLastSuccessfulRun(h.ID)
+	if err != nil {
+		srv.sendError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	hj, err := srv.hostJSON(h, r)
+	if err != nil {
+		srv.sendError(w, err, http.StatusInternalServerError)
+		return
 	}
+
+	setLastRun(hj, run)
+	setLastSuccess(hj, success)
+	srv.sendJSON(w, map[string]*api.HostJSON{"host": hj}, http.StatusOK)
 }
 
 func (srv *server) updateHost(w http.ResponseWriter, r *http.Request) {
@@ -305,36 +586,56 @@ func (srv *server) updateHost(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if errs := validateHostJSON(hj); errs != nil {
+		srv.sendValidationErrors(w, errs)
+		return
+	}
+
+	err = normalizeAddresses(hj)
+	if err != nil {
+		srv.sendError(w, err, http.StatusBadRequest)
+		return
+	}
+
 	h := hostJSONToHost(hj)
 
+	if srv.policyMode == policyModeEnforce {
+		errs, err := srv.checkHostPolicy(h)
+		if err != nil {
+			srv.sendError(w, err, http.StatusInternalServerError)
+			return
+		}
+
+		if errs != nil {
+			srv.sendValidationErrors(w, errs)
+			return
+		}
+	}
+
 	srv.log.WithFields(logrus.Fields{
 		"host":     fmt.Sprintf("%#v", h),
 		"hostJSON": fmt.Sprintf("%#v", hj),
 		"ip":       h.IP,
 	}).Debug("attempting to update host")
 
-	st := http.StatusOK
-	hu, err := srv.db.UpdateHost(h)
+	hu, created, err := srv.db.UpsertHost(h)
 	if err != nil {
-		if err == noHostInDatabaseError {
-			srv.log.WithFields(logrus.Fields{
-				"host": h.Name,
-			}).Info("failed to update, so trying to create instead")
-			hu, err = srv.db.CreateHost(h)
-			st = http.StatusCreated
-		} else {
-			err = nil
+		if _, ok := err.(*invalidStateTransitionError); ok {
+			srv.sendError(w, err, http.StatusConflict)
+			return
 		}
-	}
-
-	if err != nil {
 		srv.sendError(w, err, http.StatusInternalServerError)
 		return
 	}
 
+	st := http.StatusOK
+	if created {
+		st = http.StatusCreated
+	}
+
 	huj := hostToHostJSON(hu)
 	w.Header().Set("Location", path.Join(srv.prefix, hu.Name))
-	srv.sendJSON(w, &HostPayload{Host: huj}, st)
+	srv.sendJSON(w, &api.HostPayload{Host: huj}, st)
 }
 
 func (srv *server) deleteHost(w http.ResponseWriter, r *http.Request) {
@@ -357,6 +658,9 @@ func (srv *server) deleteHost(w http.ResponseWriter, r *http.Request) {
 		if err == noHostInDatabaseError {
 			srv.sendNotFound(w, "no such host")
 			return
+		} else if err == ambiguousHostError {
+			srv.sendError(w, err, http.StatusConflict)
+			return
 		} else {
 			srv.sendError(w, err, http.StatusInternalServerError)
 			return
@@ -367,7 +671,12 @@ func (srv *server) deleteHost(w http.ResponseWriter, r *http.Request) {
 	srv.sendJSON(w, "", http.StatusNoContent)
 }
 
-func (srv *server) getHostKey(keyType string, w http.ResponseWriter, r *http.Request) {
+func (srv *server) updateHostFacts(w http.ResponseWriter, r *http.Request) {
+	if !srv.isAuthed(r) {
+		srv.sendUnauthorized(w)
+		return
+	}
+
 	vars := mux.Vars(r)
 	hostname, ok := vars["hostname"]
 	if !ok {
@@ -375,123 +684,854 @@ func (srv *server) getHostKey(keyType string, w http.ResponseWriter, r *http.Req
 		return
 	}
 
-	key, ok := vars["key"]
-	if !ok {
-		srv.sendError(w, noKeyInPathError, http.StatusBadRequest)
+	facts, err := parseFacts(r.Body, srv.factsAllowlist)
+	if err != nil {
+		srv.sendError(w, err, http.StatusBadRequest)
 		return
 	}
 
-	var (
-		err   error
-		value string
-	)
-	switch keyType {
-	case "vars":
-		value, err = srv.db.ReadVar(hostname, key)
-	case "tags":
-		value, err = srv.db.ReadTag(hostname, key)
-	}
+	err = srv.db.UpdateFacts(hostname, facts)
 	if err != nil {
-		if err == noTagError || err == noVarError {
-			srv.sendNotFound(w, fmt.Sprintf("could not find %q", key))
+		if err == noHostInDatabaseError {
+			srv.sendNotFound(w, "no such host")
 			return
 		}
 		srv.sendError(w, err, http.StatusInternalServerError)
 		return
 	}
 
-	w.Header().Set("Location", path.Join(srv.prefix, hostname, keyType, key))
-	srv.sendJSON(w, map[string]string{"value": value}, http.StatusOK)
+	w.Header().Set("Location", path.Join(srv.prefix, hostname, "facts"))
+	srv.sendJSON(w, map[string]map[string]string{"facts": facts}, http.StatusOK)
 }
 
-func (srv *server) updateHostKey(keyType string, w http.ResponseWriter, r *http.Request) {
+func (srv *server) createRun(w http.ResponseWriter, r *http.Request) {
 	if !srv.isAuthed(r) {
 		srv.sendUnauthorized(w)
 		return
 	}
 
-	vars := mux.Vars(r)
-
-	hostname, ok := vars["hostname"]
-	if !ok {
-		srv.sendError(w, noHostnameInPathError, http.StatusBadRequest)
-		return
-	}
-
-	key, ok := vars["key"]
-	if !ok {
-		srv.sendError(w, noKeyInPathError, http.StatusBadRequest)
+	run, err := runJSONFromHTTPBody(r.Body)
+	if err != nil {
+		srv.sendError(w, err, http.StatusBadRequest)
 		return
 	}
 
-	input := map[string]string{}
-	err := json.NewDecoder(r.Body).Decode(&input)
+	recorded, unknown, err := srv.db.CreateRun(run)
 	if err != nil {
 		srv.sendError(w, err, http.StatusInternalServerError)
 		return
 	}
 
-	value, ok := input["value"]
+	if len(unknown) > 0 {
+		srv.log.WithFields(logrus.Fields{
+			"playbook": run.Playbook,
+			"hosts":    unknown,
+		}).Warn("run included unknown hosts")
+	}
+
+	srv.sendJSON(w, map[string][]string{
+		"recorded": recorded,
+		"unknown":  unknown,
+	}, http.StatusCreated)
+}
+
+func (srv *server) getHostState(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	hostname, ok := vars["hostname"]
 	if !ok {
-		srv.sendError(w, noValueKeyError, http.StatusBadRequest)
+		srv.sendError(w, noHostnameInPathError, http.StatusBadRequest)
 		return
 	}
 
-	st := http.StatusOK
-	switch keyType {
-	case "vars":
-		err = srv.db.UpdateVar(hostname, key, value)
-	case "tags":
-		err = srv.db.UpdateTag(hostname, key, value)
+	h, err := srv.db.ReadHost(hostname)
+	if err != nil {
+		srv.sendNotFound(w, "no such host")
+		return
 	}
 
+	transitions, err := srv.db.ReadStateTransitions(h.ID)
 	if err != nil {
-		if err == noHostInDatabaseError {
-			srv.sendNotFound(w, "no such host")
-			return
-		}
 		srv.sendError(w, err, http.StatusInternalServerError)
 		return
 	}
 
-	w.Header().Set("Location", path.Join(srv.prefix, hostname, keyType, key))
-	srv.sendJSON(w, map[string]string{"value": value}, st)
+	w.Header().Set("Location", path.Join(srv.prefix, h.Name, "state"))
+	srv.sendJSON(w, map[string]interface{}{
+		"value":       h.State,
+		"modified":    h.StateModified,
+		"transitions": transitions,
+	}, http.StatusOK)
 }
 
-func (srv *server) deleteHostKey(keyType string, w http.ResponseWriter, r *http.Request) {
+func (srv *server) updateHostState(w http.ResponseWriter, r *http.Request) {
 	if !srv.isAuthed(r) {
 		srv.sendUnauthorized(w)
 		return
 	}
 
 	vars := mux.Vars(r)
-
 	hostname, ok := vars["hostname"]
 	if !ok {
 		srv.sendError(w, noHostnameInPathError, http.StatusBadRequest)
 		return
 	}
 
-	key, ok := vars["key"]
-	if !ok {
-		srv.sendError(w, noKeyInPathError, http.StatusBadRequest)
+	input := map[string]string{}
+	err := json.NewDecoder(r.Body).Decode(&input)
+	if err != nil {
+		srv.sendError(w, err, http.StatusBadRequest)
 		return
 	}
 
-	var err error
-	switch keyType {
-	case "vars":
-		err = srv.db.DeleteVar(hostname, key)
-	case "tags":
-		err = srv.db.DeleteTag(hostname, key)
-	}
-	if err != nil {
-		srv.sendError(w, err, http.StatusInternalServerError)
+	value, ok := input["value"]
+	if !ok {
+		srv.sendError(w, noValueKeyError, http.StatusBadRequest)
 		return
 	}
 
-	w.Header().Set("Location", path.Join(srv.prefix, hostname, keyType, key))
-	srv.sendJSON(w, "", http.StatusNoContent)
+	h, err := srv.db.UpdateState(hostname, strings.ToLower(value))
+	if err != nil {
+		switch err.(type) {
+		case *invalidStateTransitionError:
+			srv.sendError(w, err, http.StatusConflict)
+			return
+		}
+
+		switch err {
+		case noHostInDatabaseError:
+			srv.sendNotFound(w, "no such host")
+		case invalidStateError:
+			srv.sendError(w, err, http.StatusBadRequest)
+		default:
+			srv.sendError(w, err, http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("Location", path.Join(srv.prefix, h.Name, "state"))
+	srv.sendJSON(w, map[string]interface{}{
+		"value":    h.State,
+		"modified": h.StateModified,
+	}, http.StatusOK)
+}
+
+func (srv *server) getTrash(w http.ResponseWriter, r *http.Request) {
+	hosts, err := srv.db.ReadDeletedHosts()
+	if err != nil {
+		srv.sendError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	hjs := []*api.HostJSON{}
+	for _, h := range hosts {
+		hjs = append(hjs, hostToHostJSON(h))
+	}
+
+	srv.sendJSON(w, map[string][]*api.HostJSON{"hosts": hjs}, http.StatusOK)
+}
+
+func (srv *server) restoreHost(w http.ResponseWriter, r *http.Request) {
+	if !srv.isAuthed(r) {
+		srv.sendUnauthorized(w)
+		return
+	}
+
+	vars := mux.Vars(r)
+	hostname, ok := vars["hostname"]
+	if !ok {
+		srv.sendError(w, noHostnameInPathError, http.StatusBadRequest)
+		return
+	}
+
+	h, err := srv.db.RestoreHost(hostname)
+	if err != nil {
+		switch err {
+		case noHostInTrashError:
+			srv.sendNotFound(w, "no such deleted host")
+		case hostNameTakenError:
+			srv.sendError(w, err, http.StatusConflict)
+		default:
+			srv.sendError(w, err, http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("Location", path.Join(srv.prefix, h.Name))
+	srv.sendJSON(w, &api.HostPayload{Host: hostToHostJSON(h)}, http.StatusOK)
+}
+
+func (srv *server) renameHost(w http.ResponseWriter, r *http.Request) {
+	if !srv.isAuthed(r) {
+		srv.sendUnauthorized(w)
+		return
+	}
+
+	vars := mux.Vars(r)
+	hostname, ok := vars["hostname"]
+	if !ok {
+		srv.sendError(w, noHostnameInPathError, http.StatusBadRequest)
+		return
+	}
+
+	name, err := renameFromHTTPBody(r.Body)
+	if err != nil {
+		srv.sendError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	if msg := hostnameProblem(name); msg != "" {
+		errs := validationErrors{}
+		errs.Add("name", msg)
+		srv.sendValidationErrors(w, errs)
+		return
+	}
+
+	h, err := srv.db.RenameHost(hostname, name)
+	if err != nil {
+		switch err {
+		case noHostInDatabaseError:
+			srv.sendNotFound(w, "no such host")
+		case hostNameTakenError, hostAliasTakenError:
+			srv.sendError(w, err, http.StatusConflict)
+		default:
+			srv.sendError(w, err, http.StatusInternalServerError)
+		}
+		return
+	}
+
+	hj, err := srv.hostJSON(h, r)
+	if err != nil {
+		srv.sendError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Location", path.Join(srv.prefix, h.Name))
+	srv.sendJSON(w, &api.HostPayload{Host: hj}, http.StatusOK)
+}
+
+func (srv *server) getHostAliases(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	hostname, ok := vars["hostname"]
+	if !ok {
+		srv.sendError(w, noHostnameInPathError, http.StatusBadRequest)
+		return
+	}
+
+	aliases, err := srv.db.ReadHostAliases(hostname)
+	if err != nil {
+		if err == noHostInDatabaseError {
+			srv.sendNotFound(w, "no such host")
+			return
+		}
+		srv.sendError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	srv.sendJSON(w, map[string][]*hostAlias{"aliases": aliases}, http.StatusOK)
+}
+
+func (srv *server) updateHostAlias(w http.ResponseWriter, r *http.Request) {
+	if !srv.isAuthed(r) {
+		srv.sendUnauthorized(w)
+		return
+	}
+
+	vars := mux.Vars(r)
+	hostname, ok := vars["hostname"]
+	if !ok {
+		srv.sendError(w, noHostnameInPathError, http.StatusBadRequest)
+		return
+	}
+
+	alias := vars["alias"]
+	if msg := hostnameProblem(alias); msg != "" {
+		errs := validationErrors{}
+		errs.Add("alias", msg)
+		srv.sendValidationErrors(w, errs)
+		return
+	}
+
+	err := srv.db.CreateHostAlias(hostname, alias)
+	if err != nil {
+		switch err {
+		case noHostInDatabaseError:
+			srv.sendNotFound(w, "no such host")
+		case hostNameTakenError, hostAliasTakenError:
+			srv.sendError(w, err, http.StatusConflict)
+		default:
+			srv.sendError(w, err, http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("Location", path.Join(srv.prefix, hostname, "aliases", alias))
+	srv.sendJSON(w, map[string]string{"alias": alias}, http.StatusOK)
+}
+
+func (srv *server) deleteHostAlias(w http.ResponseWriter, r *http.Request) {
+	if !srv.isAuthed(r) {
+		srv.sendUnauthorized(w)
+		return
+	}
+
+	vars := mux.Vars(r)
+	hostname, ok := vars["hostname"]
+	if !ok {
+		srv.sendError(w, noHostnameInPathError, http.StatusBadRequest)
+		return
+	}
+
+	err := srv.db.DeleteHostAlias(hostname, vars["alias"])
+	if err != nil {
+		switch err {
+		case noHostInDatabaseError:
+			srv.sendNotFound(w, "no such host")
+		case noHostAliasError:
+			srv.sendNotFound(w, "no such alias")
+		default:
+			srv.sendError(w, err, http.StatusInternalServerError)
+		}
+		return
+	}
+
+	srv.sendJSON(w, "", http.StatusNoContent)
+}
+
+// getHosts lists hosts matching the inventory filters ordered by name,
+// either a page at a time with "limit" and "after" or, with
+// "format=ndjson", streamed one host per line
+func (srv *server) getHosts(w http.ResponseWriter, r *http.Request) {
+	hf, err := srv.hostFilterFromRequest(r)
+	if err != nil {
+		srv.sendError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	after, err := decodeHostsCursor(r.FormValue("after"))
+	if err != nil {
+		srv.sendError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	limit, err := parseHostsLimit(r.FormValue("limit"))
+	if err != nil {
+		srv.sendError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	if wantsNDJSON(r) {
+		srv.streamHosts(w, r, hf, after, limit)
+		return
+	}
+
+	if limit == 0 {
+		limit = defaultHostsPageLimit
+	}
+
+	if limit > maxHostsPageLimit {
+		limit = maxHostsPageLimit
+	}
+
+	page := &hostsPage{Hosts: []*api.HostJSON{}}
+	err = srv.db.EachHostBatch(hf, after, limit+1, hostsBatchSize, func(hosts []*host) error {
+		for _, h := range hosts {
+			hj, err := srv.hostJSON(h, r)
+			if err != nil {
+				return err
+			}
+			page.Hosts = append(page.Hosts, hj)
+		}
+		return nil
+	})
+	if err != nil {
+		srv.sendError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	if len(page.Hosts) > limit {
+		page.Hosts = page.Hosts[:limit]
+		page.Next = encodeHostsCursor(page.Hosts[limit-1].Name)
+
+		next := *r.URL
+		q := next.Query()
+		q.Set("after", page.Next)
+		q.Set("limit", strconv.Itoa(limit))
+		next.RawQuery = q.Encode()
+		w.Header().Set("Link", fmt.Sprintf(`<%s>; rel="next"`, next.RequestURI()))
+	}
+
+	srv.sendJSON(w, page, http.StatusOK)
+}
+
+// streamHosts writes each host as a line of JSON as it is read, flushing
+// after every batch
+func (srv *server) streamHosts(w http.ResponseWriter, r *http.Request, hf *hostFilter, after string, limit int) {
+	w.Header().Set("Content-Type", ndjsonContentType)
+	w.WriteHeader(http.StatusOK)
+
+	flusher, _ := w.(http.Flusher)
+	enc := json.NewEncoder(w)
+	count := 0
+	err := srv.db.EachHostBatch(hf, after, limit, hostsBatchSize, func(hosts []*host) error {
+		for _, h := range hosts {
+			hj, err := srv.hostJSON(h, r)
+			if err != nil {
+				return err
+			}
+
+			err = enc.Encode(hj)
+			if err != nil {
+				return err
+			}
+			count++
+		}
+
+		if flusher != nil {
+			flusher.Flush()
+		}
+		return nil
+	})
+
+	if err != nil {
+		srv.log.WithField("err", err).WithField("count", count).Error("failed to stream hosts")
+	}
+}
+
+func (srv *server) getCatalogKeys(keyType string, w http.ResponseWriter, r *http.Request) {
+	hf, err := srv.hostFilterFromRequest(r)
+	if err != nil {
+		srv.sendError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	keys, err := srv.db.ReadCatalogKeys(keyType, hf)
+	if err != nil {
+		srv.sendError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	srv.sendJSON(w, map[string][]*catalogKey{"keys": keys}, http.StatusOK)
+}
+
+func (srv *server) getCatalogValues(keyType string, w http.ResponseWriter, r *http.Request) {
+	key, ok := mux.Vars(r)["key"]
+	if !ok {
+		srv.sendError(w, noKeyInPathError, http.StatusBadRequest)
+		return
+	}
+
+	hf, err := srv.hostFilterFromRequest(r)
+	if err != nil {
+		srv.sendError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	values, err := srv.db.ReadCatalogValues(keyType, key, hf)
+	if err != nil {
+		srv.sendError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	srv.sendJSON(w, map[string]interface{}{"key": key, "values": values}, http.StatusOK)
+}
+
+func (srv *server) getTagKeys(w http.ResponseWriter, r *http.Request) {
+	srv.getCatalogKeys("tags", w, r)
+}
+
+func (srv *server) getTagValues(w http.ResponseWriter, r *http.Request) {
+	srv.getCatalogValues("tags", w, r)
+}
+
+func (srv *server) getVarKeys(w http.ResponseWriter, r *http.Request) {
+	srv.getCatalogKeys("vars", w, r)
+}
+
+func (srv *server) getVarValues(w http.ResponseWriter, r *http.Request) {
+	srv.getCatalogValues("vars", w, r)
+}
+
+func (srv *server) getPolicyRules(w http.ResponseWriter, r *http.Request) {
+	policy, err := srv.tagPolicy()
+	if err != nil {
+		srv.sendError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	srv.sendJSON(w, map[string]interface{}{
+		"mode":  srv.policyMode,
+		"rules": policy.Rules,
+	}, http.StatusOK)
+}
+
+func (srv *server) updatePolicyRules(w http.ResponseWriter, r *http.Request) {
+	if !srv.isAuthed(r) {
+		srv.sendUnauthorized(w)
+		return
+	}
+
+	if srv.policy != nil {
+		srv.sendError(w, policyFromFileError, http.StatusConflict)
+		return
+	}
+
+	policy := &TagPolicy{}
+	err := json.NewDecoder(r.Body).Decode(policy)
+	if err != nil {
+		srv.sendError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	if errs := policy.Validate(); errs != nil {
+		srv.sendValidationErrors(w, errs)
+		return
+	}
+
+	err = srv.db.ReplaceTagPolicy(policy)
+	if err != nil {
+		srv.sendError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	srv.getPolicyRules(w, r)
+}
+
+func (srv *server) getPolicyViolations(w http.ResponseWriter, r *http.Request) {
+	hf, err := srv.hostFilterFromRequest(r)
+	if err != nil {
+		srv.sendError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	policy, err := srv.tagPolicy()
+	if err != nil {
+		srv.sendError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	checked := 0
+	violations := []*policyViolation{}
+	err = srv.db.EachHostBatch(hf, "", 0, hostsBatchSize, func(hosts []*host) error {
+		for _, h := range hosts {
+			checked++
+			if errs := policy.Check(h); errs != nil {
+				violations = append(violations, &policyViolation{
+					Name:   h.Name,
+					Type:   h.Type.String,
+					Errors: errs,
+				})
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		srv.sendError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	srv.sendJSON(w, map[string]interface{}{
+		"mode":       srv.policyMode,
+		"checked":    checked,
+		"violations": violations,
+	}, http.StatusOK)
+}
+
+func (srv *server) getSummaryReport(w http.ResponseWriter, r *http.Request) {
+	hf, err := srv.hostFilterFromRequest(r)
+	if err != nil {
+		srv.sendError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	dims, err := parseSummaryDimensions(r.FormValue("by"))
+	if err != nil {
+		srv.sendError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	report, err := srv.db.ReadSummary(hf, dims,
+		parseRequiredTags(r.FormValue("required")), time.Now().UTC())
+	if err != nil {
+		srv.sendError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	if !wantsCSV(r) {
+		srv.sendJSON(w, report, http.StatusOK)
+		return
+	}
+
+	w.Header().Set("Content-Type", csvContentType+"; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+
+	err = report.WriteCSV(w)
+	if err != nil {
+		srv.log.WithFields(logrus.Fields{"err": err}).Error("failed to write summary csv")
+	}
+}
+
+func (srv *server) getHostKey(keyType string, w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	hostname, ok := vars["hostname"]
+	if !ok {
+		srv.sendError(w, noHostnameInPathError, http.StatusBadRequest)
+		return
+	}
+
+	key, ok := vars["key"]
+	if !ok {
+		srv.sendError(w, noKeyInPathError, http.StatusBadRequest)
+		return
+	}
+
+	var (
+		err   error
+		value string
+		vault bool
+	)
+	switch keyType {
+	case "vars":
+		value, err = srv.db.ReadVar(hostname, key)
+		if err == noVarError {
+			var s *hostSecret
+			s, err = srv.db.ReadSecret(hostname, key)
+			if err == nil {
+				value, err = srv.secretValue(s, r)
+			}
+		}
+		if err == noVarError {
+			value, err = srv.db.ReadVaultVar(hostname, key)
+			vault = err == nil
+		}
+	case "tags":
+		value, err = srv.db.ReadTag(hostname, key)
+	}
+	if err != nil {
+		if err == noTagError || err == noVarError {
+			srv.sendNotFound(w, fmt.Sprintf("could not find %q", key))
+			return
+		}
+		srv.sendError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Location", path.Join(srv.prefix, hostname, keyType, key))
+	if vault {
+		srv.sendJSON(w, map[string]interface{}{"value": value, "vault": true}, http.StatusOK)
+		return
+	}
+
+	srv.sendJSON(w, map[string]string{"value": value}, http.StatusOK)
+}
+
+func (srv *server) updateHostKey(keyType string, w http.ResponseWriter, r *http.Request) {
+	if !srv.isAuthed(r) {
+		srv.sendUnauthorized(w)
+		return
+	}
+
+	vars := mux.Vars(r)
+
+	hostname, ok := vars["hostname"]
+	if !ok {
+		srv.sendError(w, noHostnameInPathError, http.StatusBadRequest)
+		return
+	}
+
+	key, ok := vars["key"]
+	if !ok {
+		srv.sendError(w, noKeyInPathError, http.StatusBadRequest)
+		return
+	}
+
+	input := &keyValueInput{}
+	err := json.NewDecoder(r.Body).Decode(input)
+	if err != nil {
+		srv.sendError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	if input.Value == nil {
+		srv.sendError(w, noValueKeyError, http.StatusBadRequest)
+		return
+	}
+
+	value := *input.Value
+	if errs := validateKeyValue(keyType, key, value); errs != nil {
+		srv.sendValidationErrors(w, errs)
+		return
+	}
+
+	if input.Secret && keyType != "vars" {
+		srv.sendError(w, secretNotSupportedError, http.StatusBadRequest)
+		return
+	}
+
+	if input.Vault && (keyType != "vars" || input.Secret) {
+		srv.sendError(w, vaultNotSupportedError, http.StatusBadRequest)
+		return
+	}
+
+	if input.Vault && !isVaultText(value) {
+		errs := validationErrors{}
+		errs.Add(keyType+"."+key, "value must be ansible vault 1.1 AES256 text")
+		srv.sendValidationErrors(w, errs)
+		return
+	}
+
+	if input.Secret && srv.keyring == nil {
+		srv.sendError(w, secretsDisabledError, http.StatusBadRequest)
+		return
+	}
+
+	if keyType == "tags" && srv.policyMode == policyModeEnforce {
+		errs, err := srv.checkTagPolicy(hostname, key, value)
+		if err != nil {
+			if err == noHostInDatabaseError {
+				srv.sendNotFound(w, "no such host")
+				return
+			}
+			srv.sendError(w, err, http.StatusInternalServerError)
+			return
+		}
+
+		if errs != nil {
+			srv.sendValidationErrors(w, errs)
+			return
+		}
+	}
+
+	st := http.StatusOK
+	switch {
+	case input.Secret:
+		var sealed *sealedSecret
+		sealed, err = srv.keyring.Encrypt(value)
+		if err == nil {
+			err = srv.db.UpdateSecret(hostname, key, sealed)
+		}
+		value = redactedSecret
+	case input.Vault:
+		err = srv.db.UpdateVaultVar(hostname, key, value)
+	case keyType == "vars":
+		err = srv.db.UpdatePlainVar(hostname, key, value)
+	case keyType == "tags":
+		err = srv.db.UpdateTag(hostname, key, value)
+	}
+
+	if err != nil {
+		if err == noHostInDatabaseError {
+			srv.sendNotFound(w, "no such host")
+			return
+		}
+		srv.sendError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Location", path.Join(srv.prefix, hostname, keyType, key))
+	srv.sendJSON(w, map[string]string{"value": value}, st)
+}
+
+func (srv *server) deleteHostKey(keyType string, w http.ResponseWriter, r *http.Request) {
+	if !srv.isAuthed(r) {
+		srv.sendUnauthorized(w)
+		return
+	}
+
+	vars := mux.Vars(r)
+
+	hostname, ok := vars["hostname"]
+	if !ok {
+		srv.sendError(w, noHostnameInPathError, http.StatusBadRequest)
+		return
+	}
+
+	key, ok := vars["key"]
+	if !ok {
+		srv.sendError(w, noKeyInPathError, http.StatusBadRequest)
+		return
+	}
+
+	if keyType == "tags" && srv.policyMode == policyModeEnforce {
+		errs, err := srv.checkTagPolicy(hostname, key, "")
+		if err != nil {
+			if err == noHostInDatabaseError {
+				srv.sendNotFound(w, "no such host")
+				return
+			}
+			srv.sendError(w, err, http.StatusInternalServerError)
+			return
+		}
+
+		if errs != nil {
+			srv.sendValidationErrors(w, errs)
+			return
+		}
+	}
+
+	var err error
+	switch keyType {
+	case "vars":
+		err = srv.db.PurgeVar(hostname, key)
+	case "tags":
+		err = srv.db.DeleteTag(hostname, key)
+	}
+	if err != nil {
+		srv.sendError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Location", path.Join(srv.prefix, hostname, keyType, key))
+	srv.sendJSON(w, "", http.StatusNoContent)
+}
+
+// tagPolicy returns the policy from the policy file, or else the rules
+// stored in the database
+func (srv *server) tagPolicy() (*TagPolicy, error) {
+	if srv.policy != nil {
+		return srv.policy, nil
+	}
+
+	return srv.db.ReadTagPolicy()
+}
+
+// checkHostPolicy returns nil or the policy errors of the host as an
+// update would store it, merged into any existing host it updates
+func (srv *server) checkHostPolicy(h *host) (validationErrors, error) {
+	policy, err := srv.tagPolicy()
+	if err != nil {
+		return nil, err
+	}
+
+	cur, err := srv.db.ReadHost(h.Name)
+	if err == noHostInDatabaseError {
+		return policy.Check(h), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// as in updateHost, a host found by one of its addresses is another host
+	if cur.Name != h.Name && cur.ResolvedAlias == "" {
+		return policy.Check(h), nil
+	}
+
+	return policy.Check(mergedForPolicy(cur, h)), nil
+}
+
+// checkTagPolicy returns nil or the policy errors of setting a single tag
+// on the host, where an empty value is a deleted tag
+func (srv *server) checkTagPolicy(hostname, key, value string) (validationErrors, error) {
+	h, err := srv.db.ReadHost(hostname)
+	if err != nil {
+		return nil, err
+	}
+
+	policy, err := srv.tagPolicy()
+	if err != nil {
+		return nil, err
+	}
+
+	return policy.CheckTag(h.Type.String, key, value), nil
 }
 
 func (srv *server) getHostVar(w http.ResponseWriter, r *http.Request) {
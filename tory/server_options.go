@@ -1,5 +1,9 @@
 package tory
 
+import (
+	"time"
+)
+
 // ServerOptions contains everything needed to build a Server
 type ServerOptions struct {
 	Addr        string
@@ -10,6 +14,44 @@ type ServerOptions struct {
 	StaticDir   string
 	Verbose     bool
 
+	// FactsAllowlist names the facts kept from posted ansible facts,
+	// defaulting to DefaultFactsAllowlist when empty
+	FactsAllowlist []string
+
+	// AnsibleHostLabels are the address labels to render as "ansible_host",
+	// in order of preference
+	AnsibleHostLabels []string
+
+	// GroupsFile is a JSON GroupConfig read into Groups unless Groups is
+	// already set, with DefaultGroupConfig used when both are empty
+	GroupsFile string
+	Groups     *GroupConfig
+
+	// TokensFile is a JSON object of extra auth tokens to the scopes they
+	// grant, read into Tokens unless Tokens is already set
+	TokensFile string
+	Tokens     map[string][]string
+
+	// SecretKeyFile holds the keys secret vars are encrypted with, where
+	// secret vars may not be set when empty
+	SecretKeyFile string
+
+	// PolicyFile is a JSON TagPolicy read into Policy unless Policy is
+	// already set, with the rules kept in the database when both are empty.
+	// PolicyMode is "audit", the default, or "enforce" to reject writes
+	// violating the policy.
+	PolicyFile string
+	Policy     *TagPolicy
+	PolicyMode string
+
+	// Normalization sets how the case of stored tags and vars is normalized
+	Normalization NormalizationOptions
+
+	// ReapInterval is how often to reap stale hosts according to the
+	// policy in ReapPolicyFile, or never when zero
+	ReapInterval   time.Duration
+	ReapPolicyFile string
+
 	NewRelicOptions NewRelicOptions
 }
 
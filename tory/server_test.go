@@ -5,17 +5,22 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"math/rand"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"strings"
 	"testing"
 	"time"
+
+	"github.com/modcloth/tory/tory/api"
 )
 
 var (
-	testServer *server
-	testAuth   string
+	testServer   *server
+	testAuth     string
+	testReadAuth string
 )
 
 type debugVars struct {
@@ -38,17 +43,19 @@ func init() {
 	rand.Seed(time.Now().UTC().UnixNano())
 
 	testAuth = fmt.Sprintf("secrety-secret-%d", rand.Int())
+	testReadAuth = fmt.Sprintf("secrety-reader-%d", rand.Int())
 	testServer = buildServer(&ServerOptions{
 		Addr:        ":9999",
 		DatabaseURL: os.Getenv("DATABASE_URL"),
 		StaticDir:   "public",
 		AuthToken:   testAuth,
+		Tokens:      map[string][]string{testReadAuth: []string{secretsReadScope}},
 		Prefix:      `/ansible/hosts/test`,
 	})
 }
 
-func getTestHostJSONReader() (*HostJSON, io.Reader) {
-	testHost := &HostJSON{
+func getTestHostJSONReader() (*api.HostJSON, io.Reader) {
+	testHost := &api.HostJSON{
 		Name:    fmt.Sprintf("test%d-%d.example.com", rand.Intn(16384), time.Now().UTC().UnixNano()),
 		IP:      fmt.Sprintf("10.10.1.%d", rand.Intn(255)),
 		Package: "fancy-town-80",
@@ -69,8 +76,8 @@ func getTestHostJSONReader() (*HostJSON, io.Reader) {
 	return testHost, getReaderForHost(testHost)
 }
 
-func getReaderForHost(testHost *HostJSON) io.Reader {
-	testHostJSONBytes, err := json.Marshal(&HostPayload{testHost})
+func getReaderForHost(testHost *api.HostJSON) io.Reader {
+	testHostJSONBytes, err := json.Marshal(&api.HostPayload{Host: testHost})
 	if err != nil {
 		panic(err)
 	}
@@ -96,7 +103,7 @@ func makeRequestWithHeaders(method, urlStr string, body io.Reader, headers http.
 	return w
 }
 
-func mustCreateHost(t *testing.T) *HostJSON {
+func mustCreateHost(t *testing.T) *api.HostJSON {
 	h, reader := getTestHostJSONReader()
 
 	w := makeRequest("PUT", `/ansible/hosts/test/`+h.Name, reader, testAuth)
@@ -184,6 +191,392 @@ func TestHandleGetHostInventory(t *testing.T) {
 	}
 }
 
+func TestHandleGetHosts(t *testing.T) {
+	for i := 0; i < 3; i++ {
+		mustCreateHost(t)
+	}
+
+	w := makeRequest("GET", `/ansible/hosts/test/_hosts?name=test&limit=2`, nil, "")
+	if w.Code != 200 {
+		t.Fatalf("response code is not 200: %v", w.Code)
+	}
+
+	first := &hostsPage{}
+	err := json.NewDecoder(w.Body).Decode(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(first.Hosts) != 2 || first.Next == "" {
+		t.Fatalf("expected a page of 2 hosts with a next cursor: %#v", first)
+	}
+
+	link := w.Header().Get("Link")
+	if !strings.Contains(link, "after="+first.Next) || !strings.Contains(link, `rel="next"`) {
+		t.Fatalf("Link header does not point at the next page: %q", link)
+	}
+
+	w = makeRequest("GET", `/ansible/hosts/test/_hosts?name=test&limit=2&after=`+first.Next, nil, "")
+	if w.Code != 200 {
+		t.Fatalf("response code is not 200: %v", w.Code)
+	}
+
+	second := &hostsPage{}
+	err = json.NewDecoder(w.Body).Decode(second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(second.Hosts) == 0 || second.Hosts[0].Name <= first.Hosts[1].Name {
+		t.Fatalf("second page does not follow the first: %#v", second)
+	}
+
+	w = makeRequest("GET", `/ansible/hosts/test/_hosts?name=test&format=ndjson`, nil, "")
+	if w.Header().Get("Content-Type") != ndjsonContentType {
+		t.Fatalf("response is not NDJSON: %q", w.Header().Get("Content-Type"))
+	}
+
+	count := 0
+	dec := json.NewDecoder(w.Body)
+	for dec.More() {
+		hj := &api.HostJSON{}
+		err = dec.Decode(hj)
+		if err != nil {
+			t.Fatal(err)
+		}
+		count++
+	}
+
+	if count < 3 {
+		t.Fatalf("expected at least 3 streamed hosts, got %d", count)
+	}
+
+	w = makeRequest("GET", `/ansible/hosts/test/_hosts?after=%25%25`, nil, "")
+	if w.Code != 400 {
+		t.Fatalf("response code for a bad cursor is not 400: %v", w.Code)
+	}
+}
+
+func TestHandleCatalog(t *testing.T) {
+	h := mustCreateHost(t)
+
+	w := makeRequest("GET", `/ansible/hosts/test/_tags?name=`+h.Name, nil, "")
+	if w.Code != 200 {
+		t.Fatalf("response code is not 200: %v", w.Code)
+	}
+
+	keys := map[string][]*catalogKey{}
+	err := json.NewDecoder(w.Body).Decode(&keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	found := false
+	for _, k := range keys["keys"] {
+		if k.Key == "env" && k.Count == 1 {
+			found = true
+		}
+	}
+
+	if !found {
+		t.Fatalf("tag keys do not include env: %#v", keys)
+	}
+
+	w = makeRequest("GET", `/ansible/hosts/test/_tags/ENV?name=`+h.Name, nil, "")
+	if w.Code != 200 {
+		t.Fatalf("response code is not 200: %v", w.Code)
+	}
+
+	values := struct {
+		Key    string          `json:"key"`
+		Values []*catalogValue `json:"values"`
+	}{}
+	err = json.NewDecoder(w.Body).Decode(&values)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(values.Values) != 1 || values.Values[0].Value != "prod" || values.Values[0].Count != 1 {
+		t.Fatalf("env values do not match: %#v", values)
+	}
+
+	w = makeRequest("GET", `/ansible/hosts/test/_vars/memory?name=`+h.Name, nil, "")
+	if w.Code != 200 {
+		t.Fatalf("response code is not 200: %v", w.Code)
+	}
+
+	if !strings.Contains(w.Body.String(), `"512"`) {
+		t.Fatalf("memory values do not include 512: %s", w.Body.String())
+	}
+}
+
+func TestHandleSummaryReport(t *testing.T) {
+	h := mustCreateHost(t)
+
+	w := makeRequest("GET", `/reports/summary?by=tag.team,image&required=env,owner&name=`+h.Name, nil, "")
+	if w.Code != 200 {
+		t.Fatalf("response code is not 200: %v", w.Code)
+	}
+
+	report := &summaryReport{}
+	err := json.NewDecoder(w.Body).Decode(report)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if report.Total != 1 || len(report.Groups) != 1 || report.Groups[0].Count != 1 {
+		t.Fatalf("summary does not match: %#v", report)
+	}
+
+	if report.Groups[0].Values["tag.team"] != "fribbles" || report.Groups[0].Values["image"] != "ubuntu-14.04" {
+		t.Fatalf("group values do not match: %#v", report.Groups[0].Values)
+	}
+
+	if report.AgeHistogram[0].Count != 1 {
+		t.Fatalf("new host is not in the first age bucket: %#v", report.AgeHistogram)
+	}
+
+	if len(report.MissingTags["env"]) != 0 {
+		t.Fatalf("host is not missing env: %#v", report.MissingTags)
+	}
+
+	if len(report.MissingTags["owner"]) != 1 || report.MissingTags["owner"][0] != h.Name {
+		t.Fatalf("host is missing owner: %#v", report.MissingTags)
+	}
+
+	w = makeRequest("GET", `/reports/summary?by=tag.team&format=csv&name=`+h.Name, nil, "")
+	if w.Code != 200 {
+		t.Fatalf("response code is not 200: %v", w.Code)
+	}
+
+	if w.Body.String() != "tag.team,count\nfribbles,1\n" {
+		t.Fatalf("unexpected csv: %q", w.Body.String())
+	}
+
+	w = makeRequest("GET", `/reports/summary?by=name`, nil, "")
+	if w.Code != 400 {
+		t.Fatalf("response code is not 400: %v", w.Code)
+	}
+}
+
+func TestHandlePolicy(t *testing.T) {
+	h := mustCreateHost(t)
+
+	defer func() {
+		testServer.policyMode = policyModeAudit
+		makeRequest("PUT", `/policy/rules`, strings.NewReader(`{"rules": []}`), testAuth)
+	}()
+
+	w := makeRequest("PUT", `/policy/rules`,
+		strings.NewReader(`{"rules": [{"key": "env", "required": true, "allowed": ["staging"]}]}`), "")
+	if w.Code != 401 {
+		t.Fatalf("response code is not 401: %v", w.Code)
+	}
+
+	w = makeRequest("PUT", `/policy/rules`,
+		strings.NewReader(`{"rules": [{"key": "env", "required": true, "allowed": ["staging"]}]}`), testAuth)
+	if w.Code != 200 {
+		t.Fatalf("response code is not 200: %v", w.Code)
+	}
+
+	w = makeRequest("GET", `/policy/violations?name=`+h.Name, nil, "")
+	if w.Code != 200 {
+		t.Fatalf("response code is not 200: %v", w.Code)
+	}
+
+	violations := struct {
+		Mode       string             `json:"mode"`
+		Checked    int                `json:"checked"`
+		Violations []*policyViolation `json:"violations"`
+	}{}
+	err := json.NewDecoder(w.Body).Decode(&violations)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if violations.Mode != policyModeAudit || violations.Checked != 1 ||
+		len(violations.Violations) != 1 || violations.Violations[0].Name != h.Name {
+		t.Fatalf("violations do not match: %#v", violations)
+	}
+
+	testServer.policyMode = policyModeEnforce
+
+	w = makeRequest("PUT", `/ansible/hosts/test/`+h.Name+`/tags/env`,
+		strings.NewReader(`{"value": "prod"}`), testAuth)
+	if w.Code != 422 {
+		t.Fatalf("response code is not 422: %v", w.Code)
+	}
+
+	w = makeRequest("PUT", `/ansible/hosts/test/`+h.Name+`/tags/env`,
+		strings.NewReader(`{"value": "staging"}`), testAuth)
+	if w.Code != 200 {
+		t.Fatalf("response code is not 200: %v", w.Code)
+	}
+
+	w = makeRequest("DELETE", `/ansible/hosts/test/`+h.Name+`/tags/env`, nil, testAuth)
+	if w.Code != 422 {
+		t.Fatalf("response code is not 422: %v", w.Code)
+	}
+
+	partial := &api.HostJSON{Name: h.Name, IP: h.IP, Tags: map[string]interface{}{"role": "web"}}
+	w = makeRequest("PUT", `/ansible/hosts/test/`+h.Name, getReaderForHost(partial), testAuth)
+	if w.Code != 200 {
+		t.Fatalf("response code is not 200: %v", w.Code)
+	}
+
+	w = makeRequest("PUT", `/ansible/hosts/test/`+h.Name, getReaderForHost(h), testAuth)
+	if w.Code != 422 {
+		t.Fatalf("response code is not 422: %v", w.Code)
+	}
+}
+
+func TestHandleRenameHost(t *testing.T) {
+	h := mustCreateHost(t)
+	other := mustCreateHost(t)
+	newName := "renamed-" + h.Name
+
+	w := makeRequest("POST", `/ansible/hosts/test/`+h.Name+`/rename`,
+		strings.NewReader(`{"name": "`+newName+`"}`), "")
+	if w.Code != 401 {
+		t.Fatalf("response code is not 401: %v", w.Code)
+	}
+
+	w = makeRequest("POST", `/ansible/hosts/test/`+h.Name+`/rename`,
+		strings.NewReader(`{"name": "`+other.Name+`"}`), testAuth)
+	if w.Code != 409 {
+		t.Fatalf("response code is not 409: %v", w.Code)
+	}
+
+	w = makeRequest("POST", `/ansible/hosts/test/`+h.Name+`/rename`,
+		strings.NewReader(`{"name": "not a hostname"}`), testAuth)
+	if w.Code != 422 {
+		t.Fatalf("response code is not 422: %v", w.Code)
+	}
+
+	w = makeRequest("POST", `/ansible/hosts/test/`+h.Name+`/rename`,
+		strings.NewReader(`{"name": "`+newName+`"}`), testAuth)
+	if w.Code != 200 {
+		t.Fatalf("response code is not 200: %v", w.Code)
+	}
+
+	hj, err := hostJSONFromHTTPBody(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if hj.Name != newName || hj.Tags["team"] != "fribbles" {
+		t.Fatalf("renamed host does not match: %#v", hj)
+	}
+
+	w = makeRequest("GET", `/ansible/hosts/test/`+h.Name+`?vars-only=1`, nil, "")
+	if w.Code != 301 {
+		t.Fatalf("response code is not 301: %v", w.Code)
+	}
+
+	if w.Header().Get("Location") != `/ansible/hosts/test/`+newName+`?vars-only=1` {
+		t.Fatalf("unexpected location %q", w.Header().Get("Location"))
+	}
+
+	w = makeRequest("PUT", `/ansible/hosts/test/`+h.Name, getReaderForHost(h), testAuth)
+	if w.Code != 200 {
+		t.Fatalf("response code is not 200: %v", w.Code)
+	}
+
+	hj, err = hostJSONFromHTTPBody(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if hj.Name != newName {
+		t.Fatalf("put to the old name did not update the renamed host: %#v", hj)
+	}
+
+	w = makeRequest("GET", `/ansible/hosts/test/_hosts?name=`+h.Name, nil, "")
+	if w.Code != 200 {
+		t.Fatalf("response code is not 200: %v", w.Code)
+	}
+
+	page := &hostsPage{}
+	err = json.NewDecoder(w.Body).Decode(page)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(page.Hosts) != 0 {
+		t.Fatalf("put to the old name created a second host: %#v", page.Hosts)
+	}
+
+	w = makeRequest("PUT", `/ansible/hosts/test/`+h.Name+`/tags/role`,
+		strings.NewReader(`{"value": "db"}`), testAuth)
+	if w.Code != 200 {
+		t.Fatalf("response code is not 200: %v", w.Code)
+	}
+
+	w = makeRequest("GET", `/ansible/hosts/test/`+newName+`/tags/role`, nil, "")
+	if w.Code != 200 {
+		t.Fatalf("response code is not 200: %v", w.Code)
+	}
+
+	w = makeRequest("DELETE", `/ansible/hosts/test/`+h.Name+`/tags/role`, nil, testAuth)
+	if w.Code != 204 {
+		t.Fatalf("response code is not 204: %v", w.Code)
+	}
+
+	w = makeRequest("PUT", `/ansible/hosts/test/`+newName+`/aliases/`+other.Name, nil, testAuth)
+	if w.Code != 409 {
+		t.Fatalf("response code is not 409: %v", w.Code)
+	}
+
+	shortName := strings.Split(newName, ".")[0]
+	w = makeRequest("PUT", `/ansible/hosts/test/`+newName+`/aliases/`+shortName, nil, testAuth)
+	if w.Code != 200 {
+		t.Fatalf("response code is not 200: %v", w.Code)
+	}
+
+	w = makeRequest("PUT", `/ansible/hosts/test/`+other.Name+`/aliases/`+shortName, nil, testAuth)
+	if w.Code != 409 {
+		t.Fatalf("response code is not 409: %v", w.Code)
+	}
+
+	w = makeRequest("GET", `/ansible/hosts/test/`+newName+`/aliases`, nil, "")
+	if w.Code != 200 {
+		t.Fatalf("response code is not 200: %v", w.Code)
+	}
+
+	aliases := map[string][]*hostAlias{}
+	err = json.NewDecoder(w.Body).Decode(&aliases)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(aliases["aliases"]) != 2 ||
+		aliases["aliases"][0].Alias != h.Name || aliases["aliases"][0].Kind != aliasKindRename ||
+		aliases["aliases"][1].Alias != shortName || aliases["aliases"][1].Kind != aliasKindExplicit {
+		t.Fatalf("aliases do not match: %#v", aliases)
+	}
+
+	w = makeRequest("DELETE", `/ansible/hosts/test/`+newName+`/aliases/`+shortName, nil, testAuth)
+	if w.Code != 204 {
+		t.Fatalf("response code is not 204: %v", w.Code)
+	}
+
+	w = makeRequest("GET", `/ansible/hosts/test/`+shortName, nil, "")
+	if w.Code != 404 {
+		t.Fatalf("response code is not 404: %v", w.Code)
+	}
+
+	w = makeRequest("POST", `/ansible/hosts/test/`+newName+`/rename`,
+		strings.NewReader(`{"name": "`+h.Name+`"}`), testAuth)
+	if w.Code != 200 {
+		t.Fatalf("response code is not 200: %v", w.Code)
+	}
+
+	w = makeRequest("GET", `/ansible/hosts/test/`+h.Name, nil, "")
+	if w.Code != 200 {
+		t.Fatalf("response code is not 200: %v", w.Code)
+	}
+}
+
 func TestHandleGetHost(t *testing.T) {
 	h := mustCreateHost(t)
 
@@ -365,6 +758,33 @@ func TestHandleUpdateHost(t *testing.T) {
 	}
 }
 
+func TestHandleUpdateHostReplacesCaseVariants(t *testing.T) {
+	testServer.db.Normalization = NormalizationOptions{Tags: preserveCase, Vars: preserveCase}
+	defer func() { testServer.db.Normalization = NormalizationOptions{} }()
+
+	h, _ := getTestHostJSONReader()
+	h.Tags = map[string]interface{}{"Env": "prod"}
+	w := makeRequest("PUT", `/ansible/hosts/test/`+h.Name, getReaderForHost(h), testAuth)
+	if w.Code != 201 {
+		t.Fatalf("response code is not 201: %v", w.Code)
+	}
+
+	h.Tags = map[string]interface{}{"env": "dev"}
+	w = makeRequest("PUT", `/ansible/hosts/test/`+h.Name, getReaderForHost(h), testAuth)
+	if w.Code != 200 {
+		t.Fatalf("response code is not 200: %v", w.Code)
+	}
+
+	hj, err := hostJSONFromHTTPBody(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(hj.Tags) != 1 || hj.Tags["env"] != "dev" {
+		t.Fatalf("tags kept a case variant: %#v", hj.Tags)
+	}
+}
+
 func TestHandleUpdateHostUnauthorized(t *testing.T) {
 	h, reader := getTestHostJSONReader()
 
@@ -388,6 +808,39 @@ func TestHandleDeleteHost(t *testing.T) {
 	}
 }
 
+func TestHandleDeleteHostSharedAddress(t *testing.T) {
+	h := mustCreateHost(t)
+	other, _ := getTestHostJSONReader()
+	other.IP = h.IP
+
+	w := makeRequest("PUT", `/ansible/hosts/test/`+other.Name, getReaderForHost(other), testAuth)
+	if w.Code != 201 {
+		t.Fatalf("response code is not 201: %v", w.Code)
+	}
+
+	w = makeRequest("DELETE", `/ansible/hosts/test/`+h.IP, nil, testAuth)
+	if w.Code != 409 {
+		t.Fatalf("response code is not 409: %v", w.Code)
+	}
+
+	for _, name := range []string{h.Name, other.Name} {
+		w = makeRequest("GET", `/ansible/hosts/test/`+name, nil, "")
+		if w.Code != 200 {
+			t.Fatalf("host %s was deleted by a shared address: %v", name, w.Code)
+		}
+	}
+
+	w = makeRequest("DELETE", `/ansible/hosts/test/`+h.Name, nil, testAuth)
+	if w.Code != 204 {
+		t.Fatalf("response code is not 204: %v", w.Code)
+	}
+
+	w = makeRequest("GET", `/ansible/hosts/test/`+other.Name, nil, "")
+	if w.Code != 200 {
+		t.Fatalf("deleting by name deleted another host: %v", w.Code)
+	}
+}
+
 func TestHandleDeleteHostUnauthorized(t *testing.T) {
 	h := mustCreateHost(t)
 
@@ -551,3 +1004,593 @@ func TestHandleFilterHosts(t *testing.T) {
 		t.Fatalf("ip group is empty")
 	}
 }
+
+func TestInventoryScript(t *testing.T) {
+	h := mustCreateHost(t)
+
+	ts := httptest.NewServer(testServer.n)
+
+	cacheDir, err := ioutil.TempDir("", "tory-inventory-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cacheDir)
+
+	opts := &InventoryScriptOptions{
+		List:     true,
+		URL:      ts.URL + `/ansible/hosts/test`,
+		CacheDir: cacheDir,
+		Filter:   map[string]string{"name": h.Name},
+	}
+
+	out := &bytes.Buffer{}
+	err = runInventoryScript(opts, out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	inv := newInventory()
+	err = json.NewDecoder(out).Decode(inv)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if g := inv.GetGroup(h.IP); g == nil {
+		t.Fatalf("--list output does not contain IP as group")
+	}
+
+	ts.Close()
+
+	opts.List = false
+	opts.Host = h.Name
+	out = &bytes.Buffer{}
+	err = runInventoryScript(opts, out)
+	if err != nil {
+		t.Fatalf("--host did not read from cache: %v", err)
+	}
+
+	hv := &hostVars{}
+	err = json.NewDecoder(out).Decode(hv)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if hv.Team != h.Tags["team"] {
+		t.Fatalf("outgoing team does not match: %s != %s", hv.Team, h.Tags["team"])
+	}
+}
+
+func TestHandleUpdateHostFacts(t *testing.T) {
+	h := mustCreateHost(t)
+
+	w := makeRequest("POST", `/ansible/hosts/test/`+h.Name+`/facts`,
+		strings.NewReader(testSetupOutput), testAuth)
+	if w.Code != 200 {
+		t.Fatalf("response code is not 200: %v", w.Code)
+	}
+
+	w = makeRequest("GET", `/ansible/hosts/test?fact.distribution=ubuntu&name=`+h.Name, nil, "")
+	if w.Code != 200 {
+		t.Fatalf("response code is not 200: %v", w.Code)
+	}
+
+	inv := newInventory()
+	err := json.NewDecoder(w.Body).Decode(inv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hv, ok := inv.Meta.Hostvars[h.Name]
+	if !ok {
+		t.Fatalf("host not matched by fact filter")
+	}
+
+	if hv["tory_facts_default_ipv4_address"] != "10.10.1.47" {
+		t.Fatalf("facts not in hostvars: %#v", hv)
+	}
+
+	if hv["memory"] != "512" {
+		t.Fatalf("facts clobbered vars: %#v", hv)
+	}
+
+	w = makeRequest("GET", `/ansible/hosts/test?fact.distribution=centos&name=`+h.Name, nil, "")
+	if strings.Contains(w.Body.String(), h.Name) {
+		t.Fatalf("host matched by wrong fact filter")
+	}
+}
+
+func TestHandleUpdateHostFactsUnauthorized(t *testing.T) {
+	h := mustCreateHost(t)
+
+	w := makeRequest("POST", `/ansible/hosts/test/`+h.Name+`/facts`,
+		strings.NewReader(testFactCache), "bogus")
+	if w.Code != 401 {
+		t.Fatalf("response code is not 401: %v", w.Code)
+	}
+}
+
+func TestHandleCreateRun(t *testing.T) {
+	h := mustCreateHost(t)
+
+	body := fmt.Sprintf(`{
+		"playbook": "site.yml",
+		"start": %q,
+		"end": %q,
+		"hosts": {%q: {"ok": 4, "failed": 1}, "nonexistent.example.com": {"ok": 1}}
+	}`, time.Now().UTC().Add(-time.Minute).Format(time.RFC3339),
+		time.Now().UTC().Format(time.RFC3339), h.Name)
+
+	w := makeRequest("POST", `/ansible/hosts/test/_runs`, strings.NewReader(body), testAuth)
+	if w.Code != 201 {
+		t.Fatalf("response code is not 201: %v", w.Code)
+	}
+
+	res := map[string][]string{}
+	err := json.NewDecoder(w.Body).Decode(&res)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(res["recorded"]) != 1 || len(res["unknown"]) != 1 {
+		t.Fatalf("unexpected recorded and unknown hosts: %#v", res)
+	}
+
+	w = makeRequest("GET", `/ansible/hosts/test/`+h.Name, nil, "")
+	if w.Code != 200 {
+		t.Fatalf("response code is not 200: %v", w.Code)
+	}
+
+	hp := &api.HostPayload{}
+	err = json.NewDecoder(w.Body).Decode(hp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if hp.Host.LastRunPlaybook != "site.yml" || hp.Host.LastRunStatus != "failed" {
+		t.Fatalf("last run fields not set: %#v", hp.Host)
+	}
+
+	if hp.Host.LastSuccessPlaybook != "" || hp.Host.LastSuccessFinished != nil {
+		t.Fatalf("last success fields set without a successful run: %#v", hp.Host)
+	}
+
+	body = fmt.Sprintf(`{
+		"playbook": "deploy.yml",
+		"start": %q,
+		"end": %q,
+		"hosts": {%q: {"ok": 3, "changed": 1}}
+	}`, time.Now().UTC().Add(-3*time.Minute).Format(time.RFC3339),
+		time.Now().UTC().Add(-2*time.Minute).Format(time.RFC3339), h.Name)
+
+	w = makeRequest("POST", `/ansible/hosts/test/_runs`, strings.NewReader(body), testAuth)
+	if w.Code != 201 {
+		t.Fatalf("response code is not 201: %v", w.Code)
+	}
+
+	w = makeRequest("GET", `/ansible/hosts/test/`+h.Name, nil, "")
+	hp = &api.HostPayload{}
+	err = json.NewDecoder(w.Body).Decode(hp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if hp.Host.LastRunPlaybook != "site.yml" || hp.Host.LastSuccessPlaybook != "deploy.yml" ||
+		hp.Host.LastSuccessFinished == nil {
+		t.Fatalf("last success is not the older successful run: %#v", hp.Host)
+	}
+
+	for s, matched := range map[string]bool{
+		`/ansible/hosts/test?last_run_status=failed&name=` + h.Name: true,
+		`/ansible/hosts/test?last_run_status=ok&name=` + h.Name:     false,
+		`/ansible/hosts/test?not_run_since=7d&name=` + h.Name:       false,
+	} {
+		w = makeRequest("GET", s, nil, "")
+		if w.Code != 200 {
+			t.Fatalf("GET %s did not return 200: %v", s, w.Code)
+		}
+
+		if strings.Contains(w.Body.String(), h.Name) != matched {
+			t.Fatalf("GET %s: expected match %v", s, matched)
+		}
+	}
+}
+
+func TestHandleCreateRunUnauthorized(t *testing.T) {
+	w := makeRequest("POST", `/ansible/hosts/test/_runs`,
+		strings.NewReader(`{"playbook": "site.yml", "hosts": {"a": {}}}`), "bogus")
+	if w.Code != 401 {
+		t.Fatalf("response code is not 401: %v", w.Code)
+	}
+}
+
+func TestHandleUpdateHostState(t *testing.T) {
+	h := mustCreateHost(t)
+
+	for _, tc := range []struct {
+		value string
+		code  int
+	}{
+		{"draining", 200},
+		{"provisioning", 409},
+		{"retired", 400},
+		{"decommissioned", 200},
+	} {
+		w := makeRequest("PUT", `/ansible/hosts/test/`+h.Name+`/state`,
+			strings.NewReader(fmt.Sprintf(`{"value": %q}`, tc.value)), testAuth)
+		if w.Code != tc.code {
+			t.Fatalf("PUT state %q: response code is not %v: %v", tc.value, tc.code, w.Code)
+		}
+	}
+
+	w := makeRequest("GET", `/ansible/hosts/test/`+h.Name+`/state`, nil, "")
+	if w.Code != 200 {
+		t.Fatalf("response code is not 200: %v", w.Code)
+	}
+
+	res := struct {
+		Value       string                 `json:"value"`
+		Transitions []*hostStateTransition `json:"transitions"`
+	}{}
+	err := json.NewDecoder(w.Body).Decode(&res)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if res.Value != "decommissioned" || len(res.Transitions) != 2 {
+		t.Fatalf("unexpected state and transitions: %#v", res)
+	}
+
+	w = makeRequest("GET", `/ansible/hosts/test?name=`+h.Name, nil, "")
+	if strings.Contains(w.Body.String(), h.Name) {
+		t.Fatalf("decommissioned host included in inventory by default")
+	}
+
+	w = makeRequest("GET", `/ansible/hosts/test?state=decommissioned&name=`+h.Name, nil, "")
+	res2 := map[string]json.RawMessage{}
+	err = json.NewDecoder(w.Body).Decode(&res2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := res2["state_decommissioned"]; !ok {
+		t.Fatalf("state group not present")
+	}
+}
+
+func TestHandleUpdateHostWithState(t *testing.T) {
+	h := mustCreateHost(t)
+
+	h.State = "maintenance"
+	w := makeRequest("PUT", `/ansible/hosts/test/`+h.Name, getReaderForHost(h), testAuth)
+	if w.Code != 200 {
+		t.Fatalf("response code is not 200: %v", w.Code)
+	}
+
+	hj, err := hostJSONFromHTTPBody(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if hj.State != "maintenance" {
+		t.Fatalf("state was not applied: %q", hj.State)
+	}
+
+	h.State = "provisioning"
+	w = makeRequest("PUT", `/ansible/hosts/test/`+h.Name, getReaderForHost(h), testAuth)
+	if w.Code != 409 {
+		t.Fatalf("response code is not 409: %v", w.Code)
+	}
+
+	w = makeRequest("GET", `/ansible/hosts/test/`+h.Name+`/state`, nil, "")
+	res := struct {
+		Value       string                 `json:"value"`
+		Transitions []*hostStateTransition `json:"transitions"`
+	}{}
+	err = json.NewDecoder(w.Body).Decode(&res)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if res.Value != "maintenance" || len(res.Transitions) != 1 {
+		t.Fatalf("unexpected state and transitions: %#v", res)
+	}
+}
+
+func TestHandleUpdateHostStateUnauthorized(t *testing.T) {
+	h := mustCreateHost(t)
+
+	w := makeRequest("PUT", `/ansible/hosts/test/`+h.Name+`/state`,
+		strings.NewReader(`{"value": "draining"}`), "bogus")
+	if w.Code != 401 {
+		t.Fatalf("response code is not 401: %v", w.Code)
+	}
+}
+
+func TestHandleRestoreHost(t *testing.T) {
+	h := mustCreateHost(t)
+
+	w := makeRequest("DELETE", `/ansible/hosts/test/`+h.Name, nil, testAuth)
+	if w.Code != 204 {
+		t.Fatalf("response code is not 204: %v", w.Code)
+	}
+
+	w = makeRequest("GET", `/ansible/hosts/test/`+h.Name, nil, "")
+	if w.Code != 404 {
+		t.Fatalf("deleted host response code is not 404: %v", w.Code)
+	}
+
+	w = makeRequest("GET", `/ansible/hosts/test/_trash`, nil, "")
+	if w.Code != 200 {
+		t.Fatalf("response code is not 200: %v", w.Code)
+	}
+
+	trash := map[string][]*api.HostJSON{}
+	err := json.NewDecoder(w.Body).Decode(&trash)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	found := false
+	for _, hj := range trash["hosts"] {
+		if hj.Name == h.Name && hj.DeletedAt != nil && hj.Vars["memory"] == "512" {
+			found = true
+		}
+	}
+
+	if !found {
+		t.Fatalf("deleted host not in trash")
+	}
+
+	w = makeRequest("POST", `/ansible/hosts/test/_trash/`+h.Name+`/restore`, nil, "bogus")
+	if w.Code != 401 {
+		t.Fatalf("response code is not 401: %v", w.Code)
+	}
+
+	w = makeRequest("POST", `/ansible/hosts/test/_trash/`+h.Name+`/restore`, nil, testAuth)
+	if w.Code != 200 {
+		t.Fatalf("response code is not 200: %v", w.Code)
+	}
+
+	w = makeRequest("GET", `/ansible/hosts/test/`+h.Name+`/vars/memory`, nil, "")
+	if w.Code != 200 {
+		t.Fatalf("restored host var response code is not 200: %v", w.Code)
+	}
+
+	w = makeRequest("POST", `/ansible/hosts/test/_trash/`+h.Name+`/restore`, nil, testAuth)
+	if w.Code != 404 {
+		t.Fatalf("response code is not 404: %v", w.Code)
+	}
+}
+
+func TestHandleUpdateHostAddresses(t *testing.T) {
+	h, _ := getTestHostJSONReader()
+	mgmt := fmt.Sprintf("192.168.%d.%d", rand.Intn(255), rand.Intn(255))
+	h.Addresses = []*api.AddressJSON{
+		&api.AddressJSON{Label: "mgmt", Address: mgmt, Subnet: "24"},
+	}
+
+	w := makeRequest("PUT", `/ansible/hosts/test/`+h.Name, getReaderForHost(h), testAuth)
+	if w.Code != 201 {
+		t.Fatalf("response code is not 201: %v", w.Code)
+	}
+
+	w = makeRequest("GET", `/ansible/hosts/test/`+mgmt, nil, "")
+	if w.Code != 200 {
+		t.Fatalf("lookup by address response code is not 200: %v", w.Code)
+	}
+
+	hp := &api.HostPayload{}
+	err := json.NewDecoder(w.Body).Decode(hp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if hp.Host.Name != h.Name || len(hp.Host.Addresses) != 2 {
+		t.Fatalf("unexpected host for address: %#v", hp.Host)
+	}
+
+	w = makeRequest("GET", `/ansible/hosts/test?address=`+mgmt, nil, "")
+	if !strings.Contains(w.Body.String(), h.Name) {
+		t.Fatalf("host not matched by address filter")
+	}
+}
+
+func TestHandleIPv6Host(t *testing.T) {
+	h, _ := getTestHostJSONReader()
+	h.IP = fmt.Sprintf("2001:0db8:0000:%x::0001", rand.Intn(65535))
+	canonical := normalizeIP(h.IP)
+
+	w := makeRequest("PUT", `/ansible/hosts/test/`+h.Name, getReaderForHost(h), testAuth)
+	if w.Code != 201 {
+		t.Fatalf("response code is not 201: %v", w.Code)
+	}
+
+	w = makeRequest("GET", `/ansible/hosts/test/`+strings.ToUpper(h.IP), nil, "")
+	if w.Code != 200 {
+		t.Fatalf("lookup by non-canonical address response code is not 200: %v", w.Code)
+	}
+
+	hp := &api.HostPayload{}
+	err := json.NewDecoder(w.Body).Decode(hp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if hp.Host.IP != canonical {
+		t.Fatalf("ip was not normalized: %q", hp.Host.IP)
+	}
+
+	w = makeRequest("GET", `/ansible/hosts/test?address=`+canonical+`/64&name=`+h.Name, nil, "")
+	res := map[string]json.RawMessage{}
+	err = json.NewDecoder(w.Body).Decode(&res)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	group := "ip_" + strings.Replace(canonical, ":", "_", -1)
+	if _, ok := res[group]; !ok {
+		t.Fatalf("host not matched by IPv6 CIDR filter into %q group", group)
+	}
+}
+
+func TestHandleUpdateHostInvalid(t *testing.T) {
+	h, _ := getTestHostJSONReader()
+	h.IP = "banana"
+	h.Tags["ip"] = "10.10.1.47"
+
+	w := makeRequest("PUT", `/ansible/hosts/test/`+h.Name, getReaderForHost(h), testAuth)
+	if w.Code != 422 {
+		t.Fatalf("response code is not 422: %v", w.Code)
+	}
+
+	res := map[string][]*fieldError{}
+	err := json.NewDecoder(w.Body).Decode(&res)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fields := map[string]bool{}
+	for _, fe := range res["errors"] {
+		fields[fe.Field] = true
+	}
+
+	if len(fields) != 2 || !fields["ip"] || !fields["tags.ip"] {
+		t.Fatalf("unexpected field errors: %#v", res["errors"])
+	}
+}
+
+func TestHandleUpdateHostVarInvalid(t *testing.T) {
+	h := mustCreateHost(t)
+
+	w := makeRequest("PUT", `/ansible/hosts/test/`+h.Name+`/vars/memory`,
+		strings.NewReader(`{"value": `), testAuth)
+	if w.Code != 400 {
+		t.Fatalf("malformed JSON response code is not 400: %v", w.Code)
+	}
+
+	w = makeRequest("PUT", `/ansible/hosts/test/`+h.Name+`/vars/hostname`,
+		strings.NewReader(`{"value": "web2"}`), testAuth)
+	if w.Code != 422 {
+		t.Fatalf("reserved key response code is not 422: %v", w.Code)
+	}
+}
+
+func TestHandleSecretVarRedaction(t *testing.T) {
+	kr, cleanup := testSecretKeyring(t)
+	defer cleanup()
+
+	testServer.keyring = kr
+	defer func() { testServer.keyring = nil }()
+
+	h := mustCreateHost(t)
+
+	w := makeRequest("PUT", `/ansible/hosts/test/`+h.Name+`/vars/password`,
+		strings.NewReader(`{"value": "hunter2", "secret": true}`), testAuth)
+	if w.Code != 200 {
+		t.Fatalf("response code is not 200: %v", w.Code)
+	}
+
+	for auth, expected := range map[string]string{
+		"":           redactedSecret,
+		testAuth:     redactedSecret,
+		testReadAuth: "hunter2",
+	} {
+		w = makeRequest("GET", `/ansible/hosts/test/`+h.Name, nil, auth)
+		if w.Code != 200 {
+			t.Fatalf("response code is not 200: %v", w.Code)
+		}
+
+		payload := &api.HostPayload{}
+		err := json.NewDecoder(w.Body).Decode(payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if payload.Host.Secrets["password"] != expected {
+			t.Fatalf("host secret is not %q: %#v", expected, payload.Host.Secrets)
+		}
+
+		w = makeRequest("GET", `/ansible/hosts/test/`+h.Name+`/vars/password`, nil, auth)
+		if w.Code != 200 {
+			t.Fatalf("response code is not 200: %v", w.Code)
+		}
+
+		v := &varValue{}
+		err = json.NewDecoder(w.Body).Decode(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if v.Value != expected {
+			t.Fatalf("var value is not %q: %q", expected, v.Value)
+		}
+
+		w = makeRequest("GET", `/ansible/hosts/test?name=`+h.Name, nil, auth)
+		if w.Code != 200 {
+			t.Fatalf("response code is not 200: %v", w.Code)
+		}
+
+		inv := newInventory()
+		err = json.NewDecoder(w.Body).Decode(inv)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		value, ok := inv.Meta.Hostvars[h.Name]["password"]
+		if expected == redactedSecret && ok {
+			t.Fatalf("inventory includes an unreadable secret: %#v", value)
+		}
+
+		if expected != redactedSecret && value != expected {
+			t.Fatalf("inventory hostvar is not %q: %#v", expected, value)
+		}
+	}
+
+	ts := httptest.NewServer(testServer.n)
+	defer ts.Close()
+
+	noCache := time.Duration(0)
+	for auth, expected := range map[string]interface{}{
+		"":           nil,
+		testReadAuth: "hunter2",
+	} {
+		out := &bytes.Buffer{}
+		err := runInventoryScript(&InventoryScriptOptions{
+			Host:      h.Name,
+			URL:       ts.URL + `/ansible/hosts/test`,
+			AuthToken: auth,
+			CacheTTL:  &noCache,
+			Filter:    map[string]string{"name": h.Name},
+		}, out)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		hostvars := map[string]interface{}{}
+		err = json.NewDecoder(out).Decode(&hostvars)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if hostvars["password"] != expected {
+			t.Fatalf("inventory script hostvar is not %#v: %#v", expected, hostvars["password"])
+		}
+	}
+
+	w = makeRequest("PUT", `/ansible/hosts/test/`+h.Name+`/vars/password`,
+		strings.NewReader(`{"value": "plain"}`), testAuth)
+	if w.Code != 200 {
+		t.Fatalf("response code is not 200: %v", w.Code)
+	}
+
+	w = makeRequest("GET", `/ansible/hosts/test/`+h.Name, nil, testReadAuth)
+	payload := &api.HostPayload{}
+	err := json.NewDecoder(w.Body).Decode(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := payload.Host.Secrets["password"]; ok || payload.Host.Vars["password"] != "plain" {
+		t.Fatalf("plain var did not replace the secret: %#v %#v", payload.Host.Secrets, payload.Host.Vars)
+	}
+}
@@ -0,0 +1,306 @@
+package tory
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/lib/pq/hstore"
+	"github.com/modcloth/tory/tory/api"
+)
+
+var (
+	invalidSnapshotFormatError = fmt.Errorf("snapshot format must be one of \"ndjson\" or \"json\"")
+	invalidImportModeError     = fmt.Errorf("import mode must be one of \"merge\" or \"replace\"")
+	invalidImportSourceError   = fmt.Errorf("import source must be one of \"snapshot\", \"ansible-ini\", or \"ansible-yaml\"")
+)
+
+// ExportOptions contains everything needed to export a snapshot
+type ExportOptions struct {
+	DatabaseURL string
+	Format      string
+	Output      string
+}
+
+// ImportOptions contains everything needed to import a snapshot
+type ImportOptions struct {
+	DatabaseURL string
+	From        string
+	Input       string
+	Mode        string
+	DryRun      bool
+
+	Normalization NormalizationOptions
+}
+
+type snapshotHost struct {
+	*api.HostJSON
+	Modified time.Time `json:"modified"`
+
+	// SealedSecrets are the host's secret vars as stored, so that they are
+	// never written out in the clear and can only be read by a server with
+	// the same secret key file
+	SealedSecrets []*snapshotSecret `json:"sealed_secrets,omitempty"`
+}
+
+type snapshotSecret struct {
+	Key        string    `json:"key"`
+	KeyID      string    `json:"key_id"`
+	WrappedKey []byte    `json:"wrapped_key"`
+	Ciphertext []byte    `json:"ciphertext"`
+	Modified   time.Time `json:"modified"`
+}
+
+type snapshot struct {
+	Hosts []*snapshotHost `json:"hosts"`
+}
+
+type importResult struct {
+	Created int `json:"created"`
+	Updated int `json:"updated"`
+	Deleted int `json:"deleted"`
+}
+
+// ExportMain writes every host to a file or stdout as either NDJSON (one host
+// per line) or a single JSON document
+func ExportMain(opts *ExportOptions) {
+	db, err := newDatabase(opts.DatabaseURL)
+	if err != nil {
+		toryLog.Fatal(err.Error())
+	}
+
+	out := os.Stdout
+	if opts.Output != "" && opts.Output != "-" {
+		out, err = os.Create(opts.Output)
+		if err != nil {
+			toryLog.Fatal(err.Error())
+		}
+		defer out.Close()
+	}
+
+	count, err := exportSnapshot(db, opts.Format, out)
+	if err != nil {
+		toryLog.Fatal(err.Error())
+	}
+
+	toryLog.WithField("count", count).Info("exported hosts")
+}
+
+// ImportMain reads a snapshot as written by ExportMain or a static ansible
+// inventory and merges it into or replaces the current hosts
+func ImportMain(opts *ImportOptions) {
+	err := opts.Normalization.Validate()
+	if err != nil {
+		toryLog.Fatal(err.Error())
+	}
+
+	db, err := newDatabase(opts.DatabaseURL)
+	if err != nil {
+		toryLog.Fatal(err.Error())
+	}
+
+	db.Normalization = opts.Normalization
+
+	in := os.Stdin
+	if opts.Input != "" && opts.Input != "-" {
+		in, err = os.Open(opts.Input)
+		if err != nil {
+			toryLog.Fatal(err.Error())
+		}
+		defer in.Close()
+	}
+
+	hosts, err := readImportHosts(opts.From, in)
+	if err != nil {
+		toryLog.Fatal(err.Error())
+	}
+
+	res, err := db.ImportHosts(hosts, opts.Mode, opts.DryRun)
+	if err != nil {
+		toryLog.Fatal(err.Error())
+	}
+
+	toryLog.WithFields(logrus.Fields{
+		"created": res.Created,
+		"updated": res.Updated,
+		"deleted": res.Deleted,
+		"mode":    opts.Mode,
+		"dry_run": opts.DryRun,
+	}).Info("imported hosts")
+}
+
+func exportSnapshot(db *database, format string, out io.Writer) (int, error) {
+	if format != "ndjson" && format != "json" {
+		return 0, invalidSnapshotFormatError
+	}
+
+	hosts, err := db.ReadAllHosts(&hostFilter{})
+	if err != nil {
+		return 0, err
+	}
+
+	snap := &snapshot{Hosts: []*snapshotHost{}}
+	for _, h := range hosts {
+		sh := &snapshotHost{
+			HostJSON: hostToHostJSON(h),
+			Modified: h.Modified,
+		}
+
+		for _, hs := range h.Secrets {
+			sh.SealedSecrets = append(sh.SealedSecrets, &snapshotSecret{
+				Key:        hs.Key,
+				KeyID:      hs.KeyID,
+				WrappedKey: hs.WrappedKey,
+				Ciphertext: hs.Ciphertext,
+				Modified:   hs.Modified,
+			})
+		}
+
+		snap.Hosts = append(snap.Hosts, sh)
+	}
+
+	if format == "json" {
+		b, err := json.MarshalIndent(snap, "", "    ")
+		if err != nil {
+			return 0, err
+		}
+
+		_, err = out.Write(append(b, '\n'))
+		return len(snap.Hosts), err
+	}
+
+	enc := json.NewEncoder(out)
+	for _, sh := range snap.Hosts {
+		err = enc.Encode(sh)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return len(snap.Hosts), nil
+}
+
+func readImportHosts(from string, in io.Reader) ([]*host, error) {
+	var (
+		ai  *ansibleInventory
+		err error
+	)
+
+	switch from {
+	case "", "snapshot":
+		return readSnapshot(in)
+	case "ansible-ini":
+		ai, err = parseAnsibleINI(in)
+	case "ansible-yaml":
+		ai, err = parseAnsibleYAML(in)
+	default:
+		return nil, invalidImportSourceError
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	hjs, unresolved := ai.HostJSONs()
+	for _, hostname := range unresolved {
+		toryLog.WithField("host", hostname).Warn("could not resolve host to an ip, skipping")
+	}
+
+	now := time.Now().UTC()
+	hosts := []*host{}
+	for _, hj := range hjs {
+		if skipInvalidHost(hj) {
+			continue
+		}
+
+		h := hostJSONToHost(hj)
+		h.Modified = now
+		hosts = append(hosts, h)
+	}
+
+	return hosts, nil
+}
+
+// readSnapshot accepts either format written by exportSnapshot, telling them
+// apart by the presence of a top-level "hosts" key
+func readSnapshot(in io.Reader) ([]*host, error) {
+	shs := []*snapshotHost{}
+	dec := json.NewDecoder(in)
+	for {
+		raw := json.RawMessage{}
+		err := dec.Decode(&raw)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		snap := &snapshot{}
+		err = json.Unmarshal(raw, snap)
+		if err != nil {
+			return nil, err
+		}
+
+		if snap.Hosts != nil {
+			shs = append(shs, snap.Hosts...)
+			continue
+		}
+
+		sh := &snapshotHost{}
+		err = json.Unmarshal(raw, sh)
+		if err != nil {
+			return nil, err
+		}
+		shs = append(shs, sh)
+	}
+
+	hosts := []*host{}
+	for _, sh := range shs {
+		if sh.HostJSON == nil || sh.Name == "" || skipInvalidHost(sh.HostJSON) {
+			continue
+		}
+
+		err := normalizeAddresses(sh.HostJSON)
+		if err != nil {
+			return nil, err
+		}
+
+		h := hostJSONToHost(sh.HostJSON)
+		h.Modified = sh.Modified
+		if h.Modified.IsZero() {
+			h.Modified = time.Now().UTC()
+		}
+
+		facts := map[string]string{}
+		for key, value := range sh.Facts {
+			facts[key] = fmt.Sprintf("%v", value)
+		}
+		h.Facts = factsToHstore(facts)
+		h.VaultVars = &hstore.Hstore{Map: map[string]sql.NullString{}}
+		for key, value := range sh.VaultVars {
+			h.VaultVars.Map[key] = sql.NullString{String: value, Valid: true}
+		}
+
+		h.Secrets = []*hostSecret{}
+		for _, ss := range sh.SealedSecrets {
+			h.Secrets = append(h.Secrets, &hostSecret{
+				Key:      ss.Key,
+				Modified: ss.Modified,
+				sealedSecret: sealedSecret{
+					KeyID:      ss.KeyID,
+					WrappedKey: ss.WrappedKey,
+					Ciphertext: ss.Ciphertext,
+				},
+			})
+		}
+
+		hosts = append(hosts, h)
+	}
+
+	return hosts, nil
+}
@@ -0,0 +1,227 @@
+package tory
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExportImportSnapshot(t *testing.T) {
+	h := mustCreateHost(t)
+
+	for _, format := range []string{"ndjson", "json"} {
+		buf := &bytes.Buffer{}
+		count, err := exportSnapshot(testServer.db, format, buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if count == 0 {
+			t.Fatalf("%s export is empty", format)
+		}
+
+		if !strings.Contains(buf.String(), h.Name) {
+			t.Fatalf("%s export does not contain test host %q", format, h.Name)
+		}
+
+		hosts, err := readSnapshot(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(hosts) != count {
+			t.Fatalf("%s snapshot read back %v hosts, expected %v", format, len(hosts), count)
+		}
+	}
+}
+
+func TestImportSnapshotDryRun(t *testing.T) {
+	h := mustCreateHost(t)
+
+	modified := time.Date(2014, time.August, 1, 19, 18, 12, 0, time.UTC)
+	snap := `{"name": "` + h.Name + `", "ip": "10.10.9.9", "tags": {"env": "staging"}, "modified": "` +
+		modified.Format(time.RFC3339) + `"}
+{"name": "new-` + h.Name + `", "ip": "10.10.9.10"}
+`
+
+	hosts, err := readSnapshot(strings.NewReader(snap))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := testServer.db.ImportHosts(hosts, "merge", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if res.Created != 1 || res.Updated != 1 || res.Deleted != 0 {
+		t.Fatalf("unexpected dry run result: %#v", res)
+	}
+
+	cur, err := testServer.db.ReadHost(h.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cur.IP.Addr != h.IP {
+		t.Fatalf("dry run changed ip: %s != %s", cur.IP.Addr, h.IP)
+	}
+
+	res, err = testServer.db.ImportHosts(hosts, "merge", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cur, err = testServer.db.ReadHost(h.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cur.IP.Addr != "10.10.9.9" {
+		t.Fatalf("import did not update ip: %s != 10.10.9.9", cur.IP.Addr)
+	}
+
+	if !cur.Modified.Equal(modified) {
+		t.Fatalf("import did not keep modified: %s != %s", cur.Modified, modified)
+	}
+
+	if cur.Tags.Map["team"].String != "fribbles" || cur.Tags.Map["env"].String != "staging" {
+		t.Fatalf("merge import did not merge tags: %#v", cur.Tags.Map)
+	}
+
+	if len(cur.Addresses) != 1 || cur.Addresses[0].Address.Addr != "10.10.9.9" {
+		t.Fatalf("import did not update the primary address: %#v", cur.Addresses)
+	}
+
+	created, err := testServer.db.ReadHost("new-" + h.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(created.Addresses) != 1 || created.Addresses[0].Label != defaultAddressLabel ||
+		created.Addresses[0].Address.Addr != "10.10.9.10" {
+		t.Fatalf("import did not add the primary address: %#v", created.Addresses)
+	}
+
+	err = testServer.db.DeleteHost("new-" + h.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestExportImportSnapshotSealedData(t *testing.T) {
+	h := mustCreateHost(t)
+
+	err := testServer.db.UpdateFacts(h.Name, map[string]string{"distribution": "Ubuntu"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vaultText := "$ANSIBLE_VAULT;1.1;AES256\n6162636465"
+	err = testServer.db.UpdateVaultVar(h.Name, "db_password", vaultText)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sealed := &sealedSecret{KeyID: "k1", WrappedKey: []byte{1, 2, 3}, Ciphertext: []byte{4, 5, 6}}
+	err = testServer.db.UpdateSecret(h.Name, "api_key", sealed)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := &bytes.Buffer{}
+	_, err = exportSnapshot(testServer.db, "ndjson", buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Contains(buf.String(), redactedSecret) {
+		t.Fatalf("export contains redacted secrets")
+	}
+
+	all, err := readSnapshot(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hosts := []*host{}
+	for _, sh := range all {
+		if sh.Name == h.Name {
+			hosts = append(hosts, sh)
+		}
+	}
+
+	if len(hosts) != 1 {
+		t.Fatalf("snapshot does not contain test host %q", h.Name)
+	}
+
+	err = testServer.db.DeleteHost(h.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := testServer.db.ImportHosts(hosts, "merge", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if res.Created != 1 {
+		t.Fatalf("import did not recreate the host: %#v", res)
+	}
+
+	cur, err := testServer.db.ReadHost(h.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cur.Facts.Map["distribution"].String != "Ubuntu" {
+		t.Fatalf("import did not keep facts: %#v", cur.Facts.Map)
+	}
+
+	if cur.VaultVars.Map["db_password"].String != vaultText {
+		t.Fatalf("import did not keep vault vars: %#v", cur.VaultVars.Map)
+	}
+
+	s, err := testServer.db.ReadSecret(h.Name, "api_key")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if s.KeyID != sealed.KeyID || !bytes.Equal(s.WrappedKey, sealed.WrappedKey) ||
+		!bytes.Equal(s.Ciphertext, sealed.Ciphertext) {
+		t.Fatalf("import did not keep the sealed secret: %#v", s)
+	}
+}
+
+func TestReadImportHostsSkipsInvalid(t *testing.T) {
+	ini := `
+[web-servers]
+web01.example.com ansible_host=10.10.5.10
+
+[db]
+db01.example.com ansible_host=10.10.5.20
+`
+
+	hosts, err := readImportHosts("ansible-ini", strings.NewReader(ini))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(hosts) != 1 || hosts[0].Name != "db01.example.com" {
+		t.Fatalf("expected only the valid host, got %#v", hosts)
+	}
+
+	snap := `{"name": "web01.example.com", "ip": "10.10.5.10", "vars": {"has space": "yes"}}
+{"name": "db01.example.com", "ip": "10.10.5.20"}
+`
+
+	hosts, err = readImportHosts("snapshot", strings.NewReader(snap))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(hosts) != 1 || hosts[0].Name != "db01.example.com" {
+		t.Fatalf("expected only the valid host, got %#v", hosts)
+	}
+}
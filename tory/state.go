@@ -0,0 +1,65 @@
+package tory
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+var (
+	// defaultHostState is the state of hosts created without one
+	defaultHostState = "active"
+
+	// hostStateTransitions maps each host state to the states it may move to
+	hostStateTransitions = map[string][]string{
+		"provisioning":   []string{"active", "decommissioned"},
+		"active":         []string{"maintenance", "draining", "decommissioned"},
+		"maintenance":    []string{"active", "draining", "decommissioned"},
+		"draining":       []string{"active", "maintenance", "decommissioned"},
+		"decommissioned": []string{"provisioning"},
+	}
+
+	invalidStateError = fmt.Errorf("state must be one of \"provisioning\", " +
+		"\"active\", \"maintenance\", \"draining\", or \"decommissioned\"")
+)
+
+type invalidStateTransitionError struct {
+	From string
+	To   string
+}
+
+func (err *invalidStateTransitionError) Error() string {
+	return fmt.Sprintf("cannot transition from %q to %q, only to %s",
+		err.From, err.To, strings.Join(hostStateTransitions[err.From], ", "))
+}
+
+type hostStateTransition struct {
+	FromState string    `db:"from_state" json:"from"`
+	ToState   string    `db:"to_state" json:"to"`
+	Created   time.Time `db:"created" json:"created"`
+}
+
+func isValidHostState(state string) bool {
+	_, ok := hostStateTransitions[state]
+	return ok
+}
+
+// checkStateTransition returns an error unless moving from one state to the
+// other is allowed.  Staying in the same state is always allowed.
+func checkStateTransition(from, to string) error {
+	if !isValidHostState(to) {
+		return invalidStateError
+	}
+
+	if from == to {
+		return nil
+	}
+
+	for _, allowed := range hostStateTransitions[from] {
+		if allowed == to {
+			return nil
+		}
+	}
+
+	return &invalidStateTransitionError{From: from, To: to}
+}
@@ -0,0 +1,37 @@
+package tory
+
+import (
+	"testing"
+)
+
+func TestCheckStateTransition(t *testing.T) {
+	for _, allowed := range [][2]string{
+		{"provisioning", "active"},
+		{"active", "draining"},
+		{"draining", "maintenance"},
+		{"maintenance", "active"},
+		{"active", "decommissioned"},
+		{"decommissioned", "provisioning"},
+		{"active", "active"},
+	} {
+		err := checkStateTransition(allowed[0], allowed[1])
+		if err != nil {
+			t.Fatalf("%s -> %s: %v", allowed[0], allowed[1], err)
+		}
+	}
+
+	for _, disallowed := range [][2]string{
+		{"provisioning", "draining"},
+		{"decommissioned", "active"},
+	} {
+		err := checkStateTransition(disallowed[0], disallowed[1])
+		if _, ok := err.(*invalidStateTransitionError); !ok {
+			t.Fatalf("%s -> %s: expected transition error, got %v", disallowed[0], disallowed[1], err)
+		}
+	}
+
+	err := checkStateTransition("active", "retired")
+	if err != invalidStateError {
+		t.Fatalf("expected %v, got %v", invalidStateError, err)
+	}
+}
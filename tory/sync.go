@@ -0,0 +1,248 @@
+package tory
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/modcloth/tory/tory/api"
+	"golang.org/x/net/context"
+)
+
+var (
+	syncSourceVar = "tory_source"
+
+	unknownProviderError = fmt.Errorf("provider must be one of \"aws\", \"joyent\", \"terraform\", or \"file\"")
+)
+
+// Provider lists hosts from an external source such as a cloud API dump
+type Provider interface {
+	ListHosts(ctx context.Context) ([]api.HostJSON, error)
+}
+
+// SyncOptions contains everything needed to sync hosts from a provider
+type SyncOptions struct {
+	DatabaseURL string
+	Provider    string
+	File        string
+	MappingFile string
+	DryRun      bool
+	Prune       bool
+
+	Normalization NormalizationOptions
+}
+
+// syncMapping maps provider metadata keys to tag and var keys.  A source key
+// ending in "*" matches every metadata key with that prefix, substituting
+// the remainder for a "*" in the destination key, e.g. "tag:*" -> "aws_*".
+// ResourceTypes is only used by the terraform provider.
+type syncMapping struct {
+	Tags          map[string]string                    `json:"tags"`
+	Vars          map[string]string                    `json:"vars"`
+	ResourceTypes map[string]*terraformResourceMapping `json:"resource_types"`
+}
+
+// SyncMain lists hosts from the provider and upserts each one, or writes
+// them to stdout as NDJSON when opts.DryRun is true.  Every synced host gets
+// a "tory_source" var naming the provider and file so that, when opts.Prune
+// is true, hosts that came from the same source but are no longer listed
+// may be deleted.
+func SyncMain(opts *SyncOptions) {
+	err := opts.Normalization.Validate()
+	if err != nil {
+		toryLog.Fatal(err.Error())
+	}
+
+	mapping, err := readSyncMapping(opts.MappingFile)
+	if err != nil {
+		toryLog.Fatal(err.Error())
+	}
+
+	p, err := newProvider(opts.Provider, opts.File, mapping)
+	if err != nil {
+		toryLog.Fatal(err.Error())
+	}
+
+	hjs, err := p.ListHosts(context.Background())
+	if err != nil {
+		toryLog.Fatal(err.Error())
+	}
+
+	source, err := syncSource(opts.Provider, opts.File)
+	if err != nil {
+		toryLog.Fatal(err.Error())
+	}
+
+	for i := range hjs {
+		hjs[i].Vars[syncSourceVar] = source
+	}
+
+	if opts.DryRun {
+		enc := json.NewEncoder(os.Stdout)
+		for i := range hjs {
+			if skipInvalidHost(&hjs[i]) {
+				continue
+			}
+
+			err = enc.Encode(&hjs[i])
+			if err != nil {
+				toryLog.Fatal(err.Error())
+			}
+		}
+		return
+	}
+
+	db, err := newDatabase(opts.DatabaseURL)
+	if err != nil {
+		toryLog.Fatal(err.Error())
+	}
+
+	db.Normalization = opts.Normalization
+
+	created, updated, skipped, err := syncHosts(db, hjs)
+	if err != nil {
+		toryLog.Fatal(err.Error())
+	}
+
+	toryLog.WithFields(logrus.Fields{
+		"provider": opts.Provider,
+		"file":     opts.File,
+		"created":  created,
+		"updated":  updated,
+		"skipped":  skipped,
+	}).Info("synced hosts")
+
+	if !opts.Prune {
+		return
+	}
+
+	// skipped hosts are still listed by the provider, so they are kept
+	keep := map[string]bool{}
+	for _, hj := range hjs {
+		keep[hj.Name] = true
+	}
+
+	pruned, err := db.PruneSourceHosts(source, keep)
+	if err != nil {
+		toryLog.Fatal(err.Error())
+	}
+
+	toryLog.WithFields(logrus.Fields{
+		"source": source,
+		"hosts":  pruned,
+		"count":  len(pruned),
+	}).Info("pruned hosts")
+}
+
+func syncSource(provider, filename string) (string, error) {
+	absFilename, err := filepath.Abs(filename)
+	if err != nil {
+		return "", err
+	}
+
+	return provider + ":" + absFilename, nil
+}
+
+// syncHosts upserts each valid host, returning the created, updated, and
+// skipped counts
+func syncHosts(db *database, hjs []api.HostJSON) (int, int, int, error) {
+	created, updated, skipped := 0, 0, 0
+	for i := range hjs {
+		if skipInvalidHost(&hjs[i]) {
+			skipped++
+			continue
+		}
+
+		_, wasCreated, err := db.UpsertHost(hostJSONToHost(&hjs[i]))
+		if err != nil {
+			db.Log.WithFields(logrus.Fields{
+				"err":  err,
+				"host": hjs[i].Name,
+			}).Error("failed to sync host")
+			return created, updated, skipped, err
+		}
+
+		if wasCreated {
+			created++
+		} else {
+			updated++
+		}
+	}
+
+	return created, updated, skipped, nil
+}
+
+func newProvider(name, filename string, mapping *syncMapping) (Provider, error) {
+	switch name {
+	case "aws":
+		return newAWSProvider(filename, mapping), nil
+	case "joyent":
+		return newJoyentProvider(filename, mapping), nil
+	case "terraform":
+		return newTerraformProvider(filename, mapping), nil
+	case "file":
+		return newFileProvider(filename, mapping), nil
+	}
+
+	return nil, unknownProviderError
+}
+
+func readSyncMapping(filename string) (*syncMapping, error) {
+	if filename == "" {
+		return nil, nil
+	}
+
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	mapping := &syncMapping{}
+	err = json.NewDecoder(f).Decode(mapping)
+	if err != nil {
+		return nil, err
+	}
+
+	return mapping, nil
+}
+
+func (m *syncMapping) Apply(hj *api.HostJSON, meta map[string]string) {
+	mapSyncKeys(hj.Tags, m.Tags, meta)
+	mapSyncKeys(hj.Vars, m.Vars, meta)
+}
+
+func mapSyncKeys(dst map[string]interface{}, mapping, meta map[string]string) {
+	for src, key := range mapping {
+		if !strings.HasSuffix(src, "*") {
+			if value, ok := meta[src]; ok && value != "" {
+				dst[key] = value
+			}
+			continue
+		}
+
+		prefix := strings.TrimSuffix(src, "*")
+		for metaKey, value := range meta {
+			if value == "" || !strings.HasPrefix(metaKey, prefix) {
+				continue
+			}
+			dst[strings.Replace(key, "*", strings.TrimPrefix(metaKey, prefix), 1)] = value
+		}
+	}
+}
+
+// newSyncHostJSON builds a host with the mapping applied, using
+// defaultMapping when mapping is nil
+func newSyncHostJSON(mapping, defaultMapping *syncMapping, meta map[string]string) api.HostJSON {
+	hj := api.NewHostJSON()
+	if mapping == nil {
+		mapping = defaultMapping
+	}
+
+	mapping.Apply(hj, meta)
+	return *hj
+}
@@ -0,0 +1,117 @@
+package tory
+
+import (
+	"encoding/json"
+	"os"
+
+	"golang.org/x/net/context"
+
+	"github.com/modcloth/tory/tory/api"
+)
+
+var (
+	defaultAWSMapping = &syncMapping{
+		Tags: map[string]string{
+			"tag:*": "*",
+		},
+		Vars: map[string]string{
+			"instance_id":       "aws_instance_id",
+			"availability_zone": "aws_availability_zone",
+			"public_ip":         "aws_public_ip",
+		},
+	}
+)
+
+// awsProvider reads the JSON output of `aws ec2 describe-instances`
+type awsProvider struct {
+	filename string
+	mapping  *syncMapping
+}
+
+type awsDescribeInstances struct {
+	Reservations []struct {
+		Instances []*awsInstance `json:"Instances"`
+	} `json:"Reservations"`
+}
+
+type awsInstance struct {
+	InstanceID       string `json:"InstanceId"`
+	ImageID          string `json:"ImageId"`
+	InstanceType     string `json:"InstanceType"`
+	PrivateIPAddress string `json:"PrivateIpAddress"`
+	PublicIPAddress  string `json:"PublicIpAddress"`
+	PrivateDNSName   string `json:"PrivateDnsName"`
+	VpcID            string `json:"VpcId"`
+	SubnetID         string `json:"SubnetId"`
+	Placement        struct {
+		AvailabilityZone string `json:"AvailabilityZone"`
+	} `json:"Placement"`
+	State struct {
+		Name string `json:"Name"`
+	} `json:"State"`
+	Tags []struct {
+		Key   string `json:"Key"`
+		Value string `json:"Value"`
+	} `json:"Tags"`
+}
+
+func newAWSProvider(filename string, mapping *syncMapping) *awsProvider {
+	return &awsProvider{filename: filename, mapping: mapping}
+}
+
+// ListHosts returns a host per instance with a private ip, named by its
+// "Name" tag when present and its instance id otherwise
+func (p *awsProvider) ListHosts(ctx context.Context) ([]api.HostJSON, error) {
+	f, err := os.Open(p.filename)
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	dump := &awsDescribeInstances{}
+	err = json.NewDecoder(f).Decode(dump)
+	if err != nil {
+		return nil, err
+	}
+
+	hjs := []api.HostJSON{}
+	for _, res := range dump.Reservations {
+		for _, inst := range res.Instances {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+
+			if inst.PrivateIPAddress == "" || inst.State.Name == "terminated" {
+				continue
+			}
+
+			meta := map[string]string{
+				"instance_id":       inst.InstanceID,
+				"availability_zone": inst.Placement.AvailabilityZone,
+				"state":             inst.State.Name,
+				"vpc_id":            inst.VpcID,
+				"subnet_id":         inst.SubnetID,
+				"public_ip":         inst.PublicIPAddress,
+				"private_dns_name":  inst.PrivateDNSName,
+			}
+			for _, tag := range inst.Tags {
+				meta["tag:"+tag.Key] = tag.Value
+			}
+
+			hj := newSyncHostJSON(p.mapping, defaultAWSMapping, meta)
+			hj.Name = inst.InstanceID
+			if meta["tag:Name"] != "" {
+				hj.Name = meta["tag:Name"]
+			}
+			hj.IP = inst.PrivateIPAddress
+			hj.Package = inst.InstanceType
+			hj.Image = inst.ImageID
+			hj.Type = "virtualmachine"
+
+			hjs = append(hjs, hj)
+		}
+	}
+
+	return hjs, nil
+}
@@ -0,0 +1,135 @@
+package tory
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/net/context"
+
+	"github.com/modcloth/tory/tory/api"
+)
+
+var (
+	defaultFileMapping = &syncMapping{
+		Tags: map[string]string{
+			"tag:*": "*",
+		},
+		Vars: map[string]string{
+			"var:*": "*",
+		},
+	}
+)
+
+// fileProvider reads a generic list of hosts from either a JSON array of
+// objects or a CSV file with a header row.  The "name", "ip", "package",
+// "image", and "type" keys map directly onto the host, nested "tags" and
+// "vars" objects become "tag:{key}" and "var:{key}" metadata, and any other
+// key is available to the mapping as-is.
+type fileProvider struct {
+	filename string
+	mapping  *syncMapping
+}
+
+func newFileProvider(filename string, mapping *syncMapping) *fileProvider {
+	return &fileProvider{filename: filename, mapping: mapping}
+}
+
+func (p *fileProvider) ListHosts(ctx context.Context) ([]api.HostJSON, error) {
+	f, err := os.Open(p.filename)
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	var records []map[string]string
+	if strings.ToLower(filepath.Ext(p.filename)) == ".csv" {
+		records, err = readCSVRecords(f)
+	} else {
+		records, err = readJSONRecords(f)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	hjs := []api.HostJSON{}
+	for _, meta := range records {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+
+		if meta["name"] == "" || meta["ip"] == "" {
+			continue
+		}
+
+		hj := newSyncHostJSON(p.mapping, defaultFileMapping, meta)
+		hj.Name = meta["name"]
+		hj.IP = meta["ip"]
+		hj.Package = meta["package"]
+		hj.Image = meta["image"]
+		hj.Type = meta["type"]
+
+		hjs = append(hjs, hj)
+	}
+
+	return hjs, nil
+}
+
+func readCSVRecords(in io.Reader) ([]map[string]string, error) {
+	rows, err := csv.NewReader(in).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+
+	records := []map[string]string{}
+	if len(rows) == 0 {
+		return records, nil
+	}
+
+	header := rows[0]
+	for _, row := range rows[1:] {
+		record := map[string]string{}
+		for i, value := range row {
+			if i < len(header) {
+				record[strings.TrimSpace(header[i])] = strings.TrimSpace(value)
+			}
+		}
+		records = append(records, record)
+	}
+
+	return records, nil
+}
+
+func readJSONRecords(in io.Reader) ([]map[string]string, error) {
+	raw := []map[string]interface{}{}
+	err := json.NewDecoder(in).Decode(&raw)
+	if err != nil {
+		return nil, err
+	}
+
+	records := []map[string]string{}
+	for _, obj := range raw {
+		record := map[string]string{}
+		for key, value := range obj {
+			nested, isMap := value.(map[string]interface{})
+			switch {
+			case isMap && (key == "tags" || key == "vars"):
+				prefix := strings.TrimSuffix(key, "s") + ":"
+				for nestedKey, nestedValue := range nested {
+					record[prefix+nestedKey] = fmt.Sprintf("%v", nestedValue)
+				}
+			case !isMap && value != nil:
+				record[key] = fmt.Sprintf("%v", value)
+			}
+		}
+		records = append(records, record)
+	}
+
+	return records, nil
+}
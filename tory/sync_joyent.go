@@ -0,0 +1,116 @@
+package tory
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"golang.org/x/net/context"
+
+	"github.com/modcloth/tory/tory/api"
+)
+
+var (
+	defaultJoyentMapping = &syncMapping{
+		Tags: map[string]string{
+			"tag:*": "*",
+		},
+		Vars: map[string]string{
+			"memory":       "memory",
+			"disk":         "disk",
+			"id":           "joyent_id",
+			"compute_node": "joyent_compute_node",
+		},
+	}
+)
+
+// joyentProvider reads a Joyent CloudAPI ListMachines response, e.g. the
+// output of `sdc-listmachines`
+type joyentProvider struct {
+	filename string
+	mapping  *syncMapping
+}
+
+type joyentMachine struct {
+	ID          string                 `json:"id"`
+	Name        string                 `json:"name"`
+	Type        string                 `json:"type"`
+	State       string                 `json:"state"`
+	Image       string                 `json:"image"`
+	Dataset     string                 `json:"dataset"`
+	Package     string                 `json:"package"`
+	Memory      int                    `json:"memory"`
+	Disk        int                    `json:"disk"`
+	IPs         []string               `json:"ips"`
+	PrimaryIP   string                 `json:"primaryIp"`
+	ComputeNode string                 `json:"compute_node"`
+	Tags        map[string]interface{} `json:"tags"`
+	Metadata    map[string]interface{} `json:"metadata"`
+}
+
+func newJoyentProvider(filename string, mapping *syncMapping) *joyentProvider {
+	return &joyentProvider{filename: filename, mapping: mapping}
+}
+
+// ListHosts returns a host per machine that has an ip and isn't deleted
+func (p *joyentProvider) ListHosts(ctx context.Context) ([]api.HostJSON, error) {
+	f, err := os.Open(p.filename)
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	machines := []*joyentMachine{}
+	err = json.NewDecoder(f).Decode(&machines)
+	if err != nil {
+		return nil, err
+	}
+
+	hjs := []api.HostJSON{}
+	for _, m := range machines {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+
+		ip := m.PrimaryIP
+		if ip == "" && len(m.IPs) > 0 {
+			ip = m.IPs[0]
+		}
+
+		if ip == "" || m.State == "deleted" {
+			continue
+		}
+
+		meta := map[string]string{
+			"id":           m.ID,
+			"state":        m.State,
+			"memory":       fmt.Sprintf("%d", m.Memory),
+			"disk":         fmt.Sprintf("%d", m.Disk),
+			"compute_node": m.ComputeNode,
+		}
+		for key, value := range m.Tags {
+			meta["tag:"+key] = fmt.Sprintf("%v", value)
+		}
+		for key, value := range m.Metadata {
+			meta["metadata:"+key] = fmt.Sprintf("%v", value)
+		}
+
+		hj := newSyncHostJSON(p.mapping, defaultJoyentMapping, meta)
+		hj.Name = m.Name
+		if hj.Name == "" {
+			hj.Name = m.ID
+		}
+		hj.IP = ip
+		hj.Package = m.Package
+		hj.Image = m.Image
+		if hj.Image == "" {
+			hj.Image = m.Dataset
+		}
+		hj.Type = m.Type
+
+		hjs = append(hjs, hj)
+	}
+
+	return hjs, nil
+}
@@ -0,0 +1,336 @@
+package tory
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"golang.org/x/net/context"
+
+	"github.com/modcloth/tory/tory/api"
+)
+
+var (
+	unsupportedTerraformStateError = fmt.Errorf("terraform state must be version 3 or 4")
+
+	defaultTerraformMapping = &syncMapping{
+		Tags: map[string]string{
+			"tag:*": "*",
+		},
+		Vars: map[string]string{
+			"attr:id": "terraform_id",
+		},
+	}
+
+	// defaultTerraformResourceTypes describes where to find host fields in
+	// the flattened attributes of each supported compute resource type, in
+	// order of preference
+	defaultTerraformResourceTypes = map[string]*terraformResourceMapping{
+		"aws_instance": &terraformResourceMapping{
+			Name:    []string{"tags.Name", "id"},
+			IP:      []string{"private_ip", "public_ip"},
+			Image:   []string{"ami"},
+			Package: []string{"instance_type"},
+			Type:    "virtualmachine",
+			TagsKey: "tags",
+		},
+		"openstack_compute_instance_v2": &terraformResourceMapping{
+			Name:    []string{"name", "id"},
+			IP:      []string{"access_ip_v4", "network.0.fixed_ip_v4", "access_ip_v6"},
+			Image:   []string{"image_name", "image_id"},
+			Package: []string{"flavor_name", "flavor_id"},
+			Type:    "virtualmachine",
+			TagsKey: "metadata",
+		},
+		"triton_machine": &terraformResourceMapping{
+			Name:    []string{"name", "id"},
+			IP:      []string{"primaryip", "ips.0"},
+			Image:   []string{"image"},
+			Package: []string{"package"},
+			Type:    "smartmachine",
+			TagsKey: "tags",
+		},
+	}
+)
+
+// terraformProvider reads compute resources from a local terraform state
+// file, mapping each resource type's attributes onto hosts
+type terraformProvider struct {
+	filename      string
+	mapping       *syncMapping
+	resourceTypes map[string]*terraformResourceMapping
+}
+
+// terraformResourceMapping configures how a resource type becomes a host.
+// Name, IP, Image, and Package list flattened attribute keys to try in
+// order, Type is used verbatim, and each key of the TagsKey attribute map is
+// exposed as "tag:{key}" metadata.  Empty fields fall back to the defaults
+// for supported resource types.  Tags and Vars, when present, replace the
+// provider-wide mapping for this resource type.
+type terraformResourceMapping struct {
+	Name    []string          `json:"name"`
+	IP      []string          `json:"ip"`
+	Image   []string          `json:"image"`
+	Package []string          `json:"package"`
+	Type    string            `json:"type"`
+	TagsKey string            `json:"tags_key"`
+	Tags    map[string]string `json:"tags"`
+	Vars    map[string]string `json:"vars"`
+}
+
+type terraformState struct {
+	Version   int                  `json:"version"`
+	Resources []*terraformResource `json:"resources"`
+	Modules   []*terraformModule   `json:"modules"`
+}
+
+// terraformResource is a v4 resource
+type terraformResource struct {
+	Module    string `json:"module"`
+	Mode      string `json:"mode"`
+	Type      string `json:"type"`
+	Name      string `json:"name"`
+	Instances []struct {
+		IndexKey   interface{}            `json:"index_key"`
+		Attributes map[string]interface{} `json:"attributes"`
+	} `json:"instances"`
+}
+
+// terraformModule is a v3 module, whose resources are keyed by address and
+// whose attributes are already flattened
+type terraformModule struct {
+	Path      []string `json:"path"`
+	Resources map[string]struct {
+		Type    string `json:"type"`
+		Primary *struct {
+			ID         string            `json:"id"`
+			Attributes map[string]string `json:"attributes"`
+		} `json:"primary"`
+	} `json:"resources"`
+}
+
+// terraformInstance is a single resource instance from either version
+type terraformInstance struct {
+	Address    string
+	Type       string
+	Attributes map[string]string
+}
+
+func newTerraformProvider(filename string, mapping *syncMapping) *terraformProvider {
+	p := &terraformProvider{
+		filename:      filename,
+		mapping:       mapping,
+		resourceTypes: map[string]*terraformResourceMapping{},
+	}
+
+	for resourceType, rm := range defaultTerraformResourceTypes {
+		p.resourceTypes[resourceType] = rm
+	}
+
+	if mapping != nil {
+		for resourceType, rm := range mapping.ResourceTypes {
+			p.resourceTypes[resourceType] = rm.withDefaults(defaultTerraformResourceTypes[resourceType])
+		}
+	}
+
+	return p
+}
+
+// withDefaults fills any empty field from def, which may be nil for
+// resource types without defaults
+func (rm *terraformResourceMapping) withDefaults(def *terraformResourceMapping) *terraformResourceMapping {
+	if def == nil {
+		return rm
+	}
+
+	merged := *rm
+	if len(merged.Name) == 0 {
+		merged.Name = def.Name
+	}
+
+	if len(merged.IP) == 0 {
+		merged.IP = def.IP
+	}
+
+	if len(merged.Image) == 0 {
+		merged.Image = def.Image
+	}
+
+	if len(merged.Package) == 0 {
+		merged.Package = def.Package
+	}
+
+	if merged.Type == "" {
+		merged.Type = def.Type
+	}
+
+	if merged.TagsKey == "" {
+		merged.TagsKey = def.TagsKey
+	}
+
+	return &merged
+}
+
+// ListHosts returns a host per instance of every configured resource type
+// that has an ip, named by the first non-empty Name attribute and falling
+// back to its resource address
+func (p *terraformProvider) ListHosts(ctx context.Context) ([]api.HostJSON, error) {
+	instances, err := p.readInstances()
+	if err != nil {
+		return nil, err
+	}
+
+	hjs := []api.HostJSON{}
+	for _, inst := range instances {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+
+		rm, ok := p.resourceTypes[inst.Type]
+		if !ok {
+			continue
+		}
+
+		ip := firstTerraformAttr(inst.Attributes, rm.IP)
+		if ip == "" {
+			continue
+		}
+
+		meta := map[string]string{"address": inst.Address}
+		for key, value := range inst.Attributes {
+			meta["attr:"+key] = value
+			if rm.TagsKey != "" && strings.HasPrefix(key, rm.TagsKey+".") {
+				tagKey := strings.TrimPrefix(key, rm.TagsKey+".")
+				if tagKey != "%" && tagKey != "#" {
+					meta["tag:"+tagKey] = value
+				}
+			}
+		}
+
+		mapping := p.mapping
+		if rm.Tags != nil || rm.Vars != nil {
+			mapping = &syncMapping{Tags: rm.Tags, Vars: rm.Vars}
+		}
+
+		hj := newSyncHostJSON(mapping, defaultTerraformMapping, meta)
+		hj.Name = firstTerraformAttr(inst.Attributes, rm.Name)
+		if hj.Name == "" {
+			hj.Name = inst.Address
+		}
+		hj.IP = ip
+		hj.Image = firstTerraformAttr(inst.Attributes, rm.Image)
+		hj.Package = firstTerraformAttr(inst.Attributes, rm.Package)
+		hj.Type = rm.Type
+
+		hjs = append(hjs, hj)
+	}
+
+	return hjs, nil
+}
+
+func (p *terraformProvider) readInstances() ([]*terraformInstance, error) {
+	f, err := os.Open(p.filename)
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	state := &terraformState{}
+	err = json.NewDecoder(f).Decode(state)
+	if err != nil {
+		return nil, err
+	}
+
+	instances := []*terraformInstance{}
+	switch state.Version {
+	case 4:
+		for _, res := range state.Resources {
+			if res.Mode != "managed" {
+				continue
+			}
+
+			for _, inst := range res.Instances {
+				address := fmt.Sprintf("%s.%s", res.Type, res.Name)
+				if res.Module != "" {
+					address = res.Module + "." + address
+				}
+				if inst.IndexKey != nil {
+					address = fmt.Sprintf("%s[%v]", address, inst.IndexKey)
+				}
+
+				attrs := map[string]string{}
+				flattenTerraformAttrs("", inst.Attributes, attrs)
+				instances = append(instances, &terraformInstance{
+					Address:    address,
+					Type:       res.Type,
+					Attributes: attrs,
+				})
+			}
+		}
+	case 3:
+		for _, mod := range state.Modules {
+			prefix := ""
+			if len(mod.Path) > 1 {
+				prefix = "module." + strings.Join(mod.Path[1:], ".module.") + "."
+			}
+
+			addresses := []string{}
+			for address := range mod.Resources {
+				addresses = append(addresses, address)
+			}
+			sort.Strings(addresses)
+
+			for _, address := range addresses {
+				res := mod.Resources[address]
+				if res.Primary == nil || strings.HasPrefix(address, "data.") {
+					continue
+				}
+
+				instances = append(instances, &terraformInstance{
+					Address:    prefix + address,
+					Type:       res.Type,
+					Attributes: res.Primary.Attributes,
+				})
+			}
+		}
+	default:
+		return nil, unsupportedTerraformStateError
+	}
+
+	return instances, nil
+}
+
+// flattenTerraformAttrs flattens v4 attributes into the v3 "flatmap" style,
+// e.g. {"network": [{"fixed_ip_v4": "..."}]} -> "network.0.fixed_ip_v4"
+func flattenTerraformAttrs(prefix string, value interface{}, out map[string]string) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, nested := range v {
+			if prefix == "" {
+				flattenTerraformAttrs(key, nested, out)
+			} else {
+				flattenTerraformAttrs(prefix+"."+key, nested, out)
+			}
+		}
+	case []interface{}:
+		for i, nested := range v {
+			flattenTerraformAttrs(fmt.Sprintf("%s.%d", prefix, i), nested, out)
+		}
+	case nil:
+	default:
+		out[prefix] = fmt.Sprintf("%v", v)
+	}
+}
+
+func firstTerraformAttr(attrs map[string]string, keys []string) string {
+	for _, key := range keys {
+		if value := attrs[key]; value != "" {
+			return value
+		}
+	}
+
+	return ""
+}
@@ -0,0 +1,343 @@
+package tory
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/modcloth/tory/tory/api"
+)
+
+var (
+	testAWSDump = `{
+    "Reservations": [{
+        "Instances": [{
+            "InstanceId": "i-0abc123",
+            "ImageId": "ami-0DeadBeef",
+            "InstanceType": "m3.medium",
+            "PrivateIpAddress": "10.10.6.1",
+            "PublicIpAddress": "54.1.2.3",
+            "Placement": {"AvailabilityZone": "us-east-1a"},
+            "State": {"Name": "running"},
+            "Tags": [{"Key": "Name", "Value": "web1.example.com"}, {"Key": "team", "Value": "fribbles"}]
+        }, {
+            "InstanceId": "i-0def456",
+            "PrivateIpAddress": "10.10.6.2",
+            "State": {"Name": "terminated"}
+        }]
+    }]
+}`
+	testJoyentDump = `[{
+    "id": "f1e2d3c4-0000-4000-8000-000000000000",
+    "name": "db1.example.com",
+    "type": "smartmachine",
+    "state": "running",
+    "image": "base64-13.4.0",
+    "package": "fancy-town-80",
+    "memory": 512,
+    "disk": 16384,
+    "ips": ["165.225.1.1", "10.10.7.1"],
+    "primaryIp": "10.10.7.1",
+    "tags": {"team": "fribbles", "env": "prod"},
+    "metadata": {"user-script": "#!/bin/sh"}
+}]`
+	testTerraformStateV4 = `{
+    "version": 4,
+    "resources": [{
+        "mode": "managed",
+        "type": "aws_instance",
+        "name": "web",
+        "instances": [{
+            "index_key": 0,
+            "attributes": {
+                "id": "i-0aaa111",
+                "ami": "ami-0123",
+                "instance_type": "t2.micro",
+                "private_ip": "10.10.8.1",
+                "tags": {"env": "staging"}
+            }
+        }]
+    }, {
+        "mode": "managed",
+        "type": "openstack_compute_instance_v2",
+        "name": "db",
+        "instances": [{
+            "attributes": {
+                "id": "5c1d8f0e",
+                "name": "db1.example.com",
+                "image_name": "ubuntu-14.04",
+                "flavor_name": "m1.large",
+                "network": [{"name": "private", "fixed_ip_v4": "10.10.8.2"}],
+                "metadata": {"team": "fribbles"}
+            }
+        }]
+    }, {
+        "mode": "data",
+        "type": "aws_ami",
+        "name": "ubuntu",
+        "instances": [{"attributes": {"id": "ami-0123", "private_ip": "10.10.8.3"}}]
+    }]
+}`
+	testTerraformStateV3 = `{
+    "version": 3,
+    "modules": [{
+        "path": ["root", "cache"],
+        "resources": {
+            "triton_machine.cache": {
+                "type": "triton_machine",
+                "primary": {
+                    "id": "0e1f2a3b",
+                    "attributes": {
+                        "id": "0e1f2a3b",
+                        "name": "cache1.example.com",
+                        "image": "base64-15.4.0",
+                        "package": "g4-highcpu-1G",
+                        "primaryip": "10.10.8.4",
+                        "tags.%": "1",
+                        "tags.role": "cache"
+                    }
+                }
+            },
+            "null_resource.noop": {
+                "type": "null_resource",
+                "primary": {"id": "1234", "attributes": {"id": "1234"}}
+            }
+        }
+    }]
+}`
+	testFileCSV = "name,ip,type,tag:team,var:memory,rack\n" +
+		"csv1.example.com,10.10.9.1,virtualmachine,fribbles,512,r12\n" +
+		",10.10.9.2,virtualmachine,fribbles,512,r12\n"
+	testFileJSON = `[{"name": "json1.example.com", "ip": "10.10.9.3", "rack": "r12", "tags": {"team": "fribbles"}}]`
+)
+
+func mustListSyncHosts(t *testing.T, provider, filename, content string, mapping *syncMapping) map[string]api.HostJSON {
+	dir, err := ioutil.TempDir("", "tory-sync-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, filename)
+	mustWriteFile(t, path, content)
+
+	p, err := newProvider(provider, path, mapping)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hjs, err := p.ListHosts(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	byName := map[string]api.HostJSON{}
+	for _, hj := range hjs {
+		byName[hj.Name] = hj
+	}
+
+	return byName
+}
+
+func TestAWSProvider(t *testing.T) {
+	hosts := mustListSyncHosts(t, "aws", "instances.json", testAWSDump, nil)
+	if len(hosts) != 1 {
+		t.Fatalf("expected 1 host, got %v", len(hosts))
+	}
+
+	hj, ok := hosts["web1.example.com"]
+	if !ok {
+		t.Fatalf("host was not named by Name tag: %#v", hosts)
+	}
+
+	if hj.IP != "10.10.6.1" || hj.Package != "m3.medium" || hj.Image != "ami-0DeadBeef" {
+		t.Fatalf("instance fields were not mapped: %#v", hj)
+	}
+
+	if hj.Tags["team"] != "fribbles" {
+		t.Fatalf("aws tags were not mapped to tags: %#v", hj.Tags)
+	}
+
+	if hj.Vars["aws_availability_zone"] != "us-east-1a" {
+		t.Fatalf("metadata was not mapped to vars: %#v", hj.Vars)
+	}
+}
+
+func TestJoyentProvider(t *testing.T) {
+	hosts := mustListSyncHosts(t, "joyent", "machines.json", testJoyentDump, &syncMapping{
+		Tags: map[string]string{"tag:team": "team"},
+		Vars: map[string]string{"tag:env": "environment", "memory": "memory"},
+	})
+
+	hj, ok := hosts["db1.example.com"]
+	if !ok {
+		t.Fatalf("machine was not listed: %#v", hosts)
+	}
+
+	if hj.IP != "10.10.7.1" || hj.Type != "smartmachine" || hj.Package != "fancy-town-80" {
+		t.Fatalf("machine fields were not mapped: %#v", hj)
+	}
+
+	if _, ok := hj.Tags["env"]; ok || hj.Tags["team"] != "fribbles" {
+		t.Fatalf("configured tag mapping was not used: %#v", hj.Tags)
+	}
+
+	if hj.Vars["environment"] != "prod" || hj.Vars["memory"] != "512" {
+		t.Fatalf("configured var mapping was not used: %#v", hj.Vars)
+	}
+}
+
+func TestTerraformProvider(t *testing.T) {
+	hosts := mustListSyncHosts(t, "terraform", "terraform.tfstate", testTerraformStateV4, nil)
+	if len(hosts) != 2 {
+		t.Fatalf("expected 2 hosts, got %v", len(hosts))
+	}
+
+	hj, ok := hosts["i-0aaa111"]
+	if !ok {
+		t.Fatalf("aws_instance was not named by id: %#v", hosts)
+	}
+
+	if hj.IP != "10.10.8.1" || hj.Image != "ami-0123" || hj.Tags["env"] != "staging" {
+		t.Fatalf("aws_instance attributes were not mapped: %#v", hj)
+	}
+
+	hj, ok = hosts["db1.example.com"]
+	if !ok {
+		t.Fatalf("openstack instance was not named by name: %#v", hosts)
+	}
+
+	if hj.IP != "10.10.8.2" || hj.Package != "m1.large" || hj.Tags["team"] != "fribbles" {
+		t.Fatalf("openstack instance attributes were not mapped: %#v", hj)
+	}
+
+	hosts = mustListSyncHosts(t, "terraform", "terraform.tfstate", testTerraformStateV3, nil)
+	if len(hosts) != 1 {
+		t.Fatalf("expected 1 host, got %v", len(hosts))
+	}
+
+	hj, ok = hosts["cache1.example.com"]
+	if !ok {
+		t.Fatalf("v3 triton_machine was not listed: %#v", hosts)
+	}
+
+	if hj.IP != "10.10.8.4" || hj.Type != "smartmachine" || hj.Tags["role"] != "cache" {
+		t.Fatalf("v3 triton_machine attributes were not mapped: %#v", hj)
+	}
+
+	if _, ok := hj.Tags["%"]; ok {
+		t.Fatalf("v3 map count was mapped as a tag: %#v", hj.Tags)
+	}
+}
+
+func TestTerraformProviderResourceTypeMapping(t *testing.T) {
+	hosts := mustListSyncHosts(t, "terraform", "terraform.tfstate", testTerraformStateV4, &syncMapping{
+		ResourceTypes: map[string]*terraformResourceMapping{
+			"aws_instance": &terraformResourceMapping{
+				Type: "ec2",
+				Tags: map[string]string{"tag:env": "environment"},
+				Vars: map[string]string{"attr:ami": "ami"},
+			},
+		},
+	})
+
+	hj := hosts["i-0aaa111"]
+	if hj.Type != "ec2" || hj.Tags["environment"] != "staging" || hj.Vars["ami"] != "ami-0123" {
+		t.Fatalf("resource type mapping was not used: %#v", hj)
+	}
+
+	if hj.IP != "10.10.8.1" || hj.Image != "ami-0123" {
+		t.Fatalf("resource type mapping was not merged with defaults: %#v", hj)
+	}
+}
+
+func TestSyncHostsSkipsInvalid(t *testing.T) {
+	h, _ := getTestHostJSONReader()
+	h.Tags["aws:cloudformation:stack-name"] = "web"
+
+	created, updated, skipped, err := syncHosts(testServer.db, []api.HostJSON{*h})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if created != 0 || updated != 0 || skipped != 1 {
+		t.Fatalf("expected 1 skipped host, got %v created, %v updated, and %v skipped",
+			created, updated, skipped)
+	}
+}
+
+func TestPruneSourceHosts(t *testing.T) {
+	h1, _ := getTestHostJSONReader()
+	h2, _ := getTestHostJSONReader()
+	source := fmt.Sprintf("terraform:/tmp/Test-%d.tfstate", rand.Int())
+	h1.Vars[syncSourceVar] = source
+	h2.Vars[syncSourceVar] = source
+
+	_, _, _, err := syncHosts(testServer.db, []api.HostJSON{*h1, *h2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pruned, err := testServer.db.PruneSourceHosts(source, map[string]bool{h1.Name: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(pruned) != 1 || pruned[0] != h2.Name {
+		t.Fatalf("expected %q to be pruned, got %v", h2.Name, pruned)
+	}
+
+	_, err = testServer.db.ReadHost(h1.Name)
+	if err != nil {
+		t.Fatalf("kept host was pruned: %v", err)
+	}
+}
+
+func TestFileProvider(t *testing.T) {
+	for filename, content := range map[string]string{
+		"hosts.csv":  testFileCSV,
+		"hosts.json": testFileJSON,
+	} {
+		hosts := mustListSyncHosts(t, "file", filename, content, &syncMapping{
+			Tags: map[string]string{"tag:*": "*"},
+			Vars: map[string]string{"var:*": "*", "rack": "rack"},
+		})
+
+		if len(hosts) != 1 {
+			t.Fatalf("%s: expected 1 host, got %v", filename, len(hosts))
+		}
+
+		for _, hj := range hosts {
+			if hj.Tags["team"] != "fribbles" || hj.Vars["rack"] != "r12" {
+				t.Fatalf("%s: columns were not mapped: %#v", filename, hj)
+			}
+		}
+	}
+}
+
+func TestSyncHosts(t *testing.T) {
+	h, _ := getTestHostJSONReader()
+
+	created, updated, _, err := syncHosts(testServer.db, []api.HostJSON{*h})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if created != 1 || updated != 0 {
+		t.Fatalf("expected 1 created host, got %v created and %v updated", created, updated)
+	}
+
+	created, updated, _, err = syncHosts(testServer.db, []api.HostJSON{*h})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if created != 0 || updated != 1 {
+		t.Fatalf("expected 1 updated host, got %v created and %v updated", created, updated)
+	}
+}
@@ -0,0 +1,217 @@
+package tory
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/modcloth/tory/tory/api"
+)
+
+const (
+	// statusUnprocessableEntity is returned for payloads that parse but do
+	// not validate
+	statusUnprocessableEntity = 422
+
+	maxHostnameLength = 253
+	maxFieldLength    = 255
+	maxKeyLength      = 128
+	maxValueLength    = 65535
+)
+
+var (
+	hostnameLabelRegexp = regexp.MustCompile(`^[A-Za-z0-9]([-A-Za-z0-9]*[A-Za-z0-9])?$`)
+	keyRegexp           = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+	// reservedKeys are set on every host's hostvars by tory, so tags and
+	// vars may not use them
+	reservedKeys = map[string]bool{
+		"hostname": true,
+		"image":    true,
+		"ip":       true,
+		"modified": true,
+		"package":  true,
+		"type":     true,
+	}
+)
+
+type fieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+type validationErrors []*fieldError
+
+func (errs validationErrors) Error() string {
+	msgs := []string{}
+	for _, err := range errs {
+		msgs = append(msgs, err.Field+" "+err.Message)
+	}
+
+	return strings.Join(msgs, "; ")
+}
+
+func (errs *validationErrors) Add(field, format string, args ...interface{}) {
+	*errs = append(*errs, &fieldError{Field: field, Message: fmt.Sprintf(format, args...)})
+}
+
+// validateHostJSON checks a host payload, returning nil or an error per
+// invalid field
+func validateHostJSON(hj *api.HostJSON) validationErrors {
+	errs := validationErrors{}
+
+	if msg := hostnameProblem(hj.Name); msg != "" {
+		errs.Add("name", msg)
+	}
+
+	if hj.IP == "" && len(hj.Addresses) == 0 {
+		errs.Add("ip", "is required")
+	} else if hj.IP != "" && net.ParseIP(strings.TrimSpace(hj.IP)) == nil {
+		errs.Add("ip", "is not an IPv4 or IPv6 address")
+	}
+
+	for field, value := range map[string]string{
+		"package": hj.Package,
+		"image":   hj.Image,
+		"type":    hj.Type,
+	} {
+		if len(value) > maxFieldLength {
+			errs.Add(field, "must be at most %d characters", maxFieldLength)
+		}
+	}
+
+	if hj.State != "" && !isValidHostState(strings.ToLower(hj.State)) {
+		errs.Add("state", "is not a valid state")
+	}
+
+	labels := map[string]bool{}
+	matchesIP := false
+	for i, a := range hj.Addresses {
+		field := fmt.Sprintf("addresses[%d]", i)
+		label := strings.ToLower(strings.TrimSpace(a.Label))
+		if label == "" {
+			errs.Add(field+".label", "is required")
+		} else if !keyRegexp.MatchString(label) {
+			errs.Add(field+".label", "may only contain letters, digits, and underscores")
+		} else if labels[label] {
+			errs.Add(field+".label", "is used by more than one address")
+		}
+		labels[label] = true
+
+		if addressFamily(a.Address) == 0 {
+			errs.Add(field+".address", "is not an IPv4 or IPv6 address")
+		} else if normalizeIP(a.Address) == normalizeIP(hj.IP) {
+			matchesIP = true
+		}
+	}
+
+	// when no address matches the ip, it is added with the default label
+	if hj.IP != "" && len(hj.Addresses) > 0 && !matchesIP && labels[defaultAddressLabel] {
+		errs.Add("addresses", "label %q is taken by an address other than the ip", defaultAddressLabel)
+	}
+
+	for _, namespace := range []struct {
+		name   string
+		values map[string]interface{}
+	}{
+		{"tags", hj.Tags},
+		{"vars", hj.Vars},
+	} {
+		for key, value := range namespace.values {
+			field := namespace.name + "." + key
+			if msg := keyProblem(key); msg != "" {
+				errs.Add(field, msg)
+			}
+
+			if len(fmt.Sprintf("%v", value)) > maxValueLength {
+				errs.Add(field, "value must be at most %d characters", maxValueLength)
+			}
+		}
+	}
+
+	if len(errs) == 0 {
+		return nil
+	}
+
+	return errs
+}
+
+// skipInvalidHost logs and returns true for a host that does not validate,
+// so that sync and import leave out what the API would refuse with a 422
+func skipInvalidHost(hj *api.HostJSON) bool {
+	errs := validateHostJSON(hj)
+	if errs == nil {
+		return false
+	}
+
+	toryLog.WithFields(logrus.Fields{
+		"host":   hj.Name,
+		"errors": errs.Error(),
+	}).Warn("skipping invalid host")
+	return true
+}
+
+// validateKeyValue checks a single tag or var
+func validateKeyValue(keyType, key, value string) validationErrors {
+	errs := validationErrors{}
+	if msg := keyProblem(key); msg != "" {
+		errs.Add(keyType+"."+key, msg)
+	}
+
+	if len(value) > maxValueLength {
+		errs.Add(keyType+"."+key, "value must be at most %d characters", maxValueLength)
+	}
+
+	if len(errs) == 0 {
+		return nil
+	}
+
+	return errs
+}
+
+// hostnameProblem describes why name is not an RFC 1123 hostname, or
+// returns ""
+func hostnameProblem(name string) string {
+	if name == "" {
+		return "is required"
+	}
+
+	if len(name) > maxHostnameLength {
+		return fmt.Sprintf("must be at most %d characters", maxHostnameLength)
+	}
+
+	for _, label := range strings.Split(name, ".") {
+		if len(label) == 0 || len(label) > 63 {
+			return "must be dot-separated labels of 1 to 63 characters"
+		}
+
+		if !hostnameLabelRegexp.MatchString(label) {
+			return "may only contain letters, digits, and hyphens, " +
+				"and may not start or end a label with a hyphen"
+		}
+	}
+
+	return ""
+}
+
+// keyProblem describes why key is not usable as a tag or var key, which
+// ends up as an ansible variable name, or returns ""
+func keyProblem(key string) string {
+	if len(key) > maxKeyLength {
+		return fmt.Sprintf("key must be at most %d characters", maxKeyLength)
+	}
+
+	if !keyRegexp.MatchString(key) {
+		return "key must start with a letter or underscore and " +
+			"only contain letters, digits, and underscores"
+	}
+
+	lowerKey := strings.ToLower(key)
+	if reservedKeys[lowerKey] || strings.HasPrefix(lowerKey, factsHostvarPrefix) {
+		return "key is reserved"
+	}
+
+	return ""
+}
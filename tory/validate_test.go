@@ -0,0 +1,65 @@
+package tory
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/modcloth/tory/tory/api"
+)
+
+func TestValidateHostJSON(t *testing.T) {
+	hj, _ := getTestHostJSONReader()
+	if errs := validateHostJSON(hj); errs != nil {
+		t.Fatalf("valid host did not validate: %v", errs)
+	}
+
+	for _, tc := range []struct {
+		mutate func(*api.HostJSON)
+		field  string
+	}{
+		{func(hj *api.HostJSON) { hj.Name = "" }, "name"},
+		{func(hj *api.HostJSON) { hj.Name = "web 1.example.com" }, "name"},
+		{func(hj *api.HostJSON) { hj.Name = "-web1.example.com" }, "name"},
+		{func(hj *api.HostJSON) { hj.Name = "web1..example.com" }, "name"},
+		{func(hj *api.HostJSON) { hj.Name = strings.Repeat("a", 64) + ".example.com" }, "name"},
+		{func(hj *api.HostJSON) { hj.IP = "banana" }, "ip"},
+		{func(hj *api.HostJSON) { hj.IP = "" }, "ip"},
+		{func(hj *api.HostJSON) { hj.Package = strings.Repeat("a", 256) }, "package"},
+		{func(hj *api.HostJSON) { hj.State = "retired" }, "state"},
+		{func(hj *api.HostJSON) { hj.Tags["hostname"] = "web2" }, "tags.hostname"},
+		{func(hj *api.HostJSON) { hj.Tags["has space"] = "yes" }, "tags.has space"},
+		{func(hj *api.HostJSON) { hj.Vars["Modified"] = "now" }, "vars.Modified"},
+		{func(hj *api.HostJSON) { hj.Vars["tory_facts_kernel"] = "3.13" }, "vars.tory_facts_kernel"},
+		{func(hj *api.HostJSON) { hj.Vars["huge"] = strings.Repeat("a", maxValueLength+1) }, "vars.huge"},
+		{func(hj *api.HostJSON) {
+			hj.Addresses = []*api.AddressJSON{&api.AddressJSON{Label: "mgmt", Address: "banana"}}
+		}, "addresses[0].address"},
+		{func(hj *api.HostJSON) {
+			hj.Addresses = []*api.AddressJSON{
+				&api.AddressJSON{Label: "mgmt", Address: hj.IP},
+				&api.AddressJSON{Label: " MGMT", Address: "10.20.1.47"},
+			}
+		}, "addresses[1].label"},
+		{func(hj *api.HostJSON) {
+			hj.Addresses = []*api.AddressJSON{&api.AddressJSON{Label: "ip", Address: "10.20.1.47"}}
+		}, "addresses"},
+	} {
+		hj, _ := getTestHostJSONReader()
+		tc.mutate(hj)
+
+		errs := validateHostJSON(hj)
+		if len(errs) != 1 || errs[0].Field != tc.field {
+			t.Fatalf("expected a single %q error, got %v", tc.field, errs)
+		}
+	}
+}
+
+func TestValidateKeyValue(t *testing.T) {
+	if errs := validateKeyValue("vars", "java_home", "/opt/jdk"); errs != nil {
+		t.Fatalf("valid var did not validate: %v", errs)
+	}
+
+	if errs := validateKeyValue("tags", "ip", "10.10.1.47"); len(errs) != 1 || errs[0].Field != "tags.ip" {
+		t.Fatalf("reserved tag key validated: %v", errs)
+	}
+}
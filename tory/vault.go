@@ -0,0 +1,197 @@
+package tory
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+const (
+	vaultHeader     = "$ANSIBLE_VAULT;1.1;AES256"
+	vaultIterations = 10000
+	vaultSaltSize   = 32
+	vaultKeySize    = 32
+	vaultLineLength = 80
+
+	// vaultHostvarKey is how ansible recognizes a vault-encrypted value in
+	// JSON inventory
+	vaultHostvarKey = "__ansible_vault"
+)
+
+var (
+	noVaultPasswordError   = fmt.Errorf("no vault password given")
+	vaultNotSupportedError = fmt.Errorf("only vars may be vault-encrypted")
+)
+
+// VaultVarPutter is anything that can store a vault var on a tory server,
+// such as *client.Client
+type VaultVarPutter interface {
+	PutVaultVar(name, key, value string) error
+}
+
+// VaultEncryptVarOptions contains everything needed to vault-encrypt a var
+// value, and optionally store it on a host
+type VaultEncryptVarOptions struct {
+	PasswordFile string
+	Name         string
+	Value        string
+
+	Host   string
+	Client VaultVarPutter
+}
+
+// VaultEncryptVarMain encrypts the value, or stdin when empty, with the
+// password from the password file or TORY_VAULT_PASSWORD.  When a host is
+// given the result is stored as a vault var on that host, otherwise it is
+// written to stdout as a YAML var like "ansible-vault encrypt_string" does.
+func VaultEncryptVarMain(opts *VaultEncryptVarOptions) {
+	password, err := readVaultPassword(opts.PasswordFile)
+	if err != nil {
+		toryLog.Fatal(err.Error())
+	}
+
+	value := opts.Value
+	if value == "" {
+		b, err := ioutil.ReadAll(os.Stdin)
+		if err != nil {
+			toryLog.Fatal(err.Error())
+		}
+		value = strings.TrimRight(string(b), "\n")
+	}
+
+	text, err := vaultEncrypt([]byte(value), password)
+	if err != nil {
+		toryLog.Fatal(err.Error())
+	}
+
+	if opts.Host == "" {
+		if opts.Name == "" {
+			fmt.Print(text)
+			return
+		}
+
+		fmt.Printf("%s: !vault |\n", opts.Name)
+		for _, line := range strings.Split(strings.TrimSpace(text), "\n") {
+			fmt.Printf("  %s\n", line)
+		}
+		return
+	}
+
+	if opts.Name == "" {
+		toryLog.Fatal("a var name is required to store the value on a host")
+	}
+
+	err = opts.Client.PutVaultVar(opts.Host, opts.Name, text)
+	if err != nil {
+		toryLog.Fatal(err.Error())
+	}
+
+	toryLog.WithField("host", opts.Host).WithField("var", opts.Name).Info("stored vault var")
+}
+
+func readVaultPassword(filename string) ([]byte, error) {
+	password := os.Getenv("TORY_VAULT_PASSWORD")
+	if filename != "" {
+		b, err := ioutil.ReadFile(filename)
+		if err != nil {
+			return nil, err
+		}
+		password = strings.TrimSpace(string(b))
+	}
+
+	if password == "" {
+		return nil, noVaultPasswordError
+	}
+
+	return []byte(password), nil
+}
+
+// isVaultText reports whether the value looks like ansible vault text
+func isVaultText(value string) bool {
+	return strings.HasPrefix(strings.TrimSpace(value), vaultHeader+"\n")
+}
+
+// vaultEncrypt produces ansible vault 1.1 AES256 text, where keys derived
+// from the password and a random salt with PBKDF2-SHA256 encrypt the padded
+// plaintext with AES-256-CTR and sign it with HMAC-SHA256
+func vaultEncrypt(plaintext, password []byte) (string, error) {
+	salt := make([]byte, vaultSaltSize)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return "", err
+	}
+
+	cipherKey, hmacKey, iv := vaultKeys(password, salt)
+
+	padLen := aes.BlockSize - len(plaintext)%aes.BlockSize
+	padded := append(append([]byte{}, plaintext...), bytes.Repeat([]byte{byte(padLen)}, padLen)...)
+
+	block, err := aes.NewCipher(cipherKey)
+	if err != nil {
+		return "", err
+	}
+
+	ciphertext := make([]byte, len(padded))
+	cipher.NewCTR(block, iv).XORKeyStream(ciphertext, padded)
+
+	mac := hmac.New(sha256.New, hmacKey)
+	mac.Write(ciphertext)
+
+	body := hex.EncodeToString([]byte(strings.Join([]string{
+		hex.EncodeToString(salt),
+		hex.EncodeToString(mac.Sum(nil)),
+		hex.EncodeToString(ciphertext),
+	}, "\n")))
+
+	lines := []string{vaultHeader}
+	for len(body) > vaultLineLength {
+		lines = append(lines, body[:vaultLineLength])
+		body = body[vaultLineLength:]
+	}
+
+	return strings.Join(append(lines, body), "\n") + "\n", nil
+}
+
+func vaultKeys(password, salt []byte) ([]byte, []byte, []byte) {
+	derived := pbkdf2SHA256(password, salt, vaultIterations, 2*vaultKeySize+aes.BlockSize)
+	return derived[:vaultKeySize], derived[vaultKeySize : 2*vaultKeySize], derived[2*vaultKeySize:]
+}
+
+// pbkdf2SHA256 derives a key as described in RFC 2898
+func pbkdf2SHA256(password, salt []byte, iterations, keyLen int) []byte {
+	prf := hmac.New(sha256.New, password)
+	numBlocks := (keyLen + prf.Size() - 1) / prf.Size()
+
+	derived := []byte{}
+	counter := make([]byte, 4)
+	for block := 1; block <= numBlocks; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		binary.BigEndian.PutUint32(counter, uint32(block))
+		prf.Write(counter)
+		u := prf.Sum(nil)
+
+		t := append([]byte{}, u...)
+		for n := 1; n < iterations; n++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for i := range t {
+				t[i] ^= u[i]
+			}
+		}
+
+		derived = append(derived, t...)
+	}
+
+	return derived[:keyLen]
+}
@@ -0,0 +1,162 @@
+package tory
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/lib/pq/hstore"
+)
+
+var (
+	notVaultTextError        = fmt.Errorf("value is not ansible vault 1.1 AES256 text")
+	vaultHMACMismatchError   = fmt.Errorf("vault hmac does not match, wrong password?")
+	invalidVaultPaddingError = fmt.Errorf("vault plaintext padding is invalid")
+
+	testVaultPassword = []byte("tory-test-vault-password")
+
+	// testVaultText is "hunter2" encrypted with testVaultPassword in the
+	// format of ansible-vault encrypt_string, independently of vaultEncrypt
+	testVaultText = `$ANSIBLE_VAULT;1.1;AES256
+31353662353934663234633563326130643766343732373662363661303331666662656232346433
+3131616564633732383532623930396365376536623131370a396239613365303565366237613766
+34646461383562626530353035383033656135363464653737383166616636356236663661306632
+6233373634313162650a636263306534623633366363356161663061386464616166663465663032
+3664
+`
+)
+
+// vaultDecrypt opens ansible vault 1.1 AES256 text, which only the tests
+// need to do since ansible decrypts vault vars itself
+func vaultDecrypt(text string, password []byte) ([]byte, error) {
+	lines := strings.Split(strings.TrimSpace(text), "\n")
+	if len(lines) < 2 || strings.TrimSpace(lines[0]) != vaultHeader {
+		return nil, notVaultTextError
+	}
+
+	body, err := hex.DecodeString(strings.Join(lines[1:], ""))
+	if err != nil {
+		return nil, notVaultTextError
+	}
+
+	parts := strings.Split(string(body), "\n")
+	if len(parts) != 3 {
+		return nil, notVaultTextError
+	}
+
+	decoded := [][]byte{}
+	for _, part := range parts {
+		b, err := hex.DecodeString(part)
+		if err != nil {
+			return nil, notVaultTextError
+		}
+		decoded = append(decoded, b)
+	}
+
+	salt, sum, ciphertext := decoded[0], decoded[1], decoded[2]
+	cipherKey, hmacKey, iv := vaultKeys(password, salt)
+
+	mac := hmac.New(sha256.New, hmacKey)
+	mac.Write(ciphertext)
+	if !hmac.Equal(mac.Sum(nil), sum) {
+		return nil, vaultHMACMismatchError
+	}
+
+	block, err := aes.NewCipher(cipherKey)
+	if err != nil {
+		return nil, err
+	}
+
+	padded := make([]byte, len(ciphertext))
+	cipher.NewCTR(block, iv).XORKeyStream(padded, ciphertext)
+
+	if len(padded) == 0 {
+		return nil, invalidVaultPaddingError
+	}
+
+	padLen := int(padded[len(padded)-1])
+	if padLen == 0 || padLen > aes.BlockSize || padLen > len(padded) {
+		return nil, invalidVaultPaddingError
+	}
+
+	return padded[:len(padded)-padLen], nil
+}
+
+func TestPBKDF2SHA256(t *testing.T) {
+	derived := pbkdf2SHA256([]byte("passwd"), []byte("salt"), 1, 64)
+	expected := "55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc" +
+		"49ca9cccf179b645991664b39d77ef317c71b845b1e30bd509112041d3a19783"
+	if hex.EncodeToString(derived) != expected {
+		t.Fatalf("expected %s, got %x", expected, derived)
+	}
+}
+
+func TestVaultDecrypt(t *testing.T) {
+	plaintext, err := vaultDecrypt(testVaultText, testVaultPassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(plaintext) != "hunter2" {
+		t.Fatalf("expected %q, got %q", "hunter2", plaintext)
+	}
+
+	_, err = vaultDecrypt(testVaultText, []byte("wrong"))
+	if err != vaultHMACMismatchError {
+		t.Fatalf("expected %v, got %v", vaultHMACMismatchError, err)
+	}
+
+	_, err = vaultDecrypt("hunter2", testVaultPassword)
+	if err != notVaultTextError {
+		t.Fatalf("expected %v, got %v", notVaultTextError, err)
+	}
+}
+
+func TestVaultEncrypt(t *testing.T) {
+	for _, value := range []string{"", "hunter2", "sixteen bytes!!!", "a much longer secret value spanning blocks"} {
+		text, err := vaultEncrypt([]byte(value), testVaultPassword)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !isVaultText(text) {
+			t.Fatalf("expected vault text, got %q", text)
+		}
+
+		plaintext, err := vaultDecrypt(text, testVaultPassword)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(plaintext) != value {
+			t.Fatalf("expected %q, got %q", value, plaintext)
+		}
+	}
+}
+
+func TestHostvarsVaultVars(t *testing.T) {
+	h := newHost()
+	h.IP = &inet{Addr: "10.10.1.7"}
+	h.VaultVars.Map = map[string]sql.NullString{
+		"db_password": sql.NullString{String: testVaultText, Valid: true},
+	}
+	h.Vars = &hstore.Hstore{Map: map[string]sql.NullString{}}
+
+	r, _ := http.NewRequest("GET", "/", nil)
+	vars, err := (&server{db: &database{}}).hostvars(h, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	value, ok := vars["db_password"].(map[string]string)
+	if !ok || value[vaultHostvarKey] != testVaultText {
+		t.Fatalf("expected a %q object, got %#v", vaultHostvarKey, vars["db_password"])
+	}
+}